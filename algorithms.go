@@ -0,0 +1,131 @@
+package sshd
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AlgorithmPolicy restricts the algorithms negotiated with the clients.
+type AlgorithmPolicy struct {
+	// KeyExchanges are the allowed key exchange algorithms in preference order.
+	KeyExchanges []string
+	// Ciphers are the allowed ciphers in preference order.
+	Ciphers []string
+	// MACs are the allowed message authentication codes in preference order.
+	MACs []string
+	// PublicKeyAuthAlgorithms are the allowed signature algorithms for public key authentication.
+	// Certificates are allowed by the algorithm of their underlying key.
+	PublicKeyAuthAlgorithms []string
+
+	// Deny removes the algorithms from the lists above.
+	// Empty lists default to the algorithms of [DefaultAlgorithms], so Deny can be used alone.
+	Deny []string
+}
+
+// DefaultAlgorithms are the algorithms enabled by default in golang.org/x/crypto/ssh.
+var DefaultAlgorithms = AlgorithmPolicy{
+	KeyExchanges: []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	},
+	Ciphers: []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	},
+	PublicKeyAuthAlgorithms: []string{
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+		ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA,
+		ssh.KeyAlgoDSA,
+	},
+}
+
+// ModernAlgorithms only allows algorithms without known weaknesses, which are supported by openssh 7.4 and later.
+var ModernAlgorithms = AlgorithmPolicy{
+	KeyExchanges: []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+	},
+	Ciphers: []string{
+		"chacha20-poly1305@openssh.com",
+		"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+		"aes256-ctr", "aes192-ctr", "aes128-ctr",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+	},
+	PublicKeyAuthAlgorithms: []string{
+		ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoSKECDSA256,
+		ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512,
+	},
+}
+
+// CompatAlgorithms additionally allows the legacy algorithms needed by old clients and network equipment.
+var CompatAlgorithms = AlgorithmPolicy{
+	KeyExchanges: append(slices.Clone(ModernAlgorithms.KeyExchanges),
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"),
+	Ciphers: append(slices.Clone(ModernAlgorithms.Ciphers),
+		"aes128-cbc", "3des-cbc"),
+	MACs: append(slices.Clone(ModernAlgorithms.MACs),
+		"hmac-sha1", "hmac-sha1-96"),
+	PublicKeyAuthAlgorithms: append(slices.Clone(ModernAlgorithms.PublicKeyAuthAlgorithms),
+		ssh.KeyAlgoRSA, ssh.KeyAlgoDSA),
+}
+
+// apply sets the algorithms on config.
+func (p *AlgorithmPolicy) apply(config *ssh.ServerConfig) {
+	config.KeyExchanges = p.resolve(p.KeyExchanges, DefaultAlgorithms.KeyExchanges)
+	config.Ciphers = p.resolve(p.Ciphers, DefaultAlgorithms.Ciphers)
+	config.MACs = p.resolve(p.MACs, DefaultAlgorithms.MACs)
+	// x/crypto refuses the connections if an unsupported public key algorithm is listed.
+	config.PublicKeyAuthAlgorithms = slices.DeleteFunc(
+		p.resolve(p.PublicKeyAuthAlgorithms, DefaultAlgorithms.PublicKeyAuthAlgorithms),
+		func(algo string) bool {
+			return !slices.Contains(DefaultAlgorithms.PublicKeyAuthAlgorithms, algo)
+		})
+}
+
+func (p *AlgorithmPolicy) resolve(allowed, defaults []string) []string {
+	if len(allowed) == 0 {
+		if len(p.Deny) == 0 {
+			return nil
+		}
+		allowed = defaults
+	}
+
+	return slices.DeleteFunc(slices.Clone(allowed), func(algo string) bool {
+		return slices.Contains(p.Deny, algo)
+	})
+}
+
+// parseAlgorithmList parses the algorithm list of sshd_config, where the list can be prefixed by
+// + to append to the defaults, - to remove from the defaults (wildcards allowed), or ^ to prepend to the defaults.
+func parseAlgorithmList(value string, defaults []string) []string {
+	switch {
+	case strings.HasPrefix(value, "+"):
+		return append(slices.Clone(defaults), strings.Split(value[1:], ",")...)
+
+	case strings.HasPrefix(value, "-"):
+		patterns := strings.Split(value[1:], ",")
+		return slices.DeleteFunc(slices.Clone(defaults), func(algo string) bool {
+			return matchPatternList(patterns, algo)
+		})
+
+	case strings.HasPrefix(value, "^"):
+		return append(strings.Split(value[1:], ","), defaults...)
+
+	default:
+		return strings.Split(value, ",")
+	}
+}
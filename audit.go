@@ -0,0 +1,158 @@
+package sshd
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fardream/sshd/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditRecord is a line of the audit log of the server, see [Server.AuditLog].
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Event is channel_open, channel_request or global_request.
+	Event  string `json:"event"`
+	ConnID string `json:"conn_id"`
+	// SessionID is the id of the session channel of the channel requests.
+	SessionID string `json:"session_id,omitempty"`
+	User      string `json:"user"`
+	Remote    string `json:"remote"`
+	// Type is the type of the channel or the request.
+	Type      string `json:"type"`
+	WantReply bool   `json:"want_reply,omitempty"`
+	// OK is if the request succeeded, nil for the channel opens, which are recorded before they are accepted.
+	OK    *bool  `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Payload is the decoded payload of the known types, such as the command of exec,
+	// or its length for the others.
+	Payload map[string]any `json:"payload,omitempty"`
+}
+
+// audit writes rec to the audit log of the server with the connection filled in.
+func (s *ServerConn) audit(rec AuditRecord) {
+	if s.srv.AuditLog == nil {
+		return
+	}
+
+	rec.Time = time.Now()
+	rec.ConnID = s.id
+	rec.User = s.sshcon.User()
+	rec.Remote = s.sshcon.RemoteAddr().String()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		s.logger.Error("failed to encode audit record", "err", err.Error())
+		return
+	}
+
+	s.srv.auditMu.Lock()
+	defer s.srv.auditMu.Unlock()
+
+	if _, err := s.srv.AuditLog.Write(append(line, '\n')); err != nil {
+		s.logger.Error("failed to write audit log", "err", err.Error())
+	}
+}
+
+func (s *ServerConn) auditChannelOpen(newchannel ssh.NewChannel) {
+	if s.srv.AuditLog == nil {
+		return
+	}
+
+	var payload map[string]any
+	extra := newchannel.ExtraData()
+
+	switch newchannel.ChannelType() {
+	case directTCPIPChannel:
+		if host, port, originAddr, originPort, err := wire.ParseTCPIPChannel(extra); err == nil {
+			payload = map[string]any{"host": host, "port": port, "originator_address": originAddr, "originator_port": originPort}
+		}
+	case directStreamLocalChannel:
+		var msg directStreamLocalMsg
+		if err := ssh.Unmarshal(extra, &msg); err == nil {
+			payload = map[string]any{"path": msg.Path}
+		}
+	}
+
+	s.audit(AuditRecord{Event: "channel_open", Type: newchannel.ChannelType(), Payload: auditPayload(payload, extra)})
+}
+
+func (s *ServerConn) auditGlobalRequest(req *ssh.Request, ok bool) {
+	if s.srv.AuditLog == nil {
+		return
+	}
+
+	var payload map[string]any
+
+	switch req.Type {
+	case "tcpip-forward", "cancel-tcpip-forward":
+		var msg tcpipForwardMsg
+		if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+			payload = map[string]any{"address": msg.Addr, "port": msg.Port}
+		}
+	case "streamlocal-forward@openssh.com", "cancel-streamlocal-forward@openssh.com":
+		var msg streamLocalForwardMsg
+		if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+			payload = map[string]any{"path": msg.Path}
+		}
+	}
+
+	s.audit(AuditRecord{Event: "global_request", Type: req.Type, WantReply: req.WantReply, OK: &ok, Payload: auditPayload(payload, req.Payload)})
+}
+
+func (c *Channel) auditRequest(req *ssh.Request, err error) {
+	if c.srv.AuditLog == nil {
+		return
+	}
+
+	var payload map[string]any
+	b := req.Payload
+
+	switch req.Type {
+	case "pty-req":
+		if term, n, err := wire.ParseStringMax(b, wire.MaxNameLength); err == nil {
+			payload = map[string]any{"term": term}
+			if cols, rows, _, _, err := wire.ParseWindowSize(b[n:]); err == nil {
+				payload["cols"], payload["rows"] = cols, rows
+			}
+		}
+	case "window-change":
+		if cols, rows, _, _, err := wire.ParseWindowSize(b); err == nil {
+			payload = map[string]any{"cols": cols, "rows": rows}
+		}
+	case "env":
+		if name, n, err := wire.ParseString(b); err == nil {
+			value, _, _ := wire.ParseString(b[n:])
+			payload = map[string]any{"name": name, "value": value}
+		}
+	case "exec":
+		if command, _, err := wire.ParseString(b); err == nil {
+			payload = map[string]any{"command": command}
+		}
+	case "subsystem":
+		if name, _, err := wire.ParseStringMax(b, wire.MaxNameLength); err == nil {
+			payload = map[string]any{"name": name}
+		}
+	case "signal":
+		if name, _, err := wire.ParseStringMax(b, wire.MaxNameLength); err == nil {
+			payload = map[string]any{"signal": name}
+		}
+	}
+
+	ok := err == nil
+	rec := AuditRecord{Event: "channel_request", SessionID: c.id, Type: req.Type, WantReply: req.WantReply, OK: &ok, Payload: auditPayload(payload, b)}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	c.conn.audit(rec)
+}
+
+// auditPayload returns the decoded payload, or the length of raw if it is not decoded.
+func auditPayload(decoded map[string]any, raw []byte) map[string]any {
+	if decoded != nil || len(raw) == 0 {
+		return decoded
+	}
+
+	return map[string]any{"length": len(raw)}
+}
@@ -0,0 +1,18 @@
+package sshd
+
+// DefaultCgroupParent is the cgroup v2 directory the session cgroups are created in by default.
+const DefaultCgroupParent = "/sys/fs/cgroup/sshd"
+
+// CgroupLimits are the resource limits of each session, enforced by a cgroup v2 per session.
+// Zero values mean no limit.
+type CgroupLimits struct {
+	// Parent is the cgroup directory the session cgroups are created in, defaults to [DefaultCgroupParent].
+	// It is created if missing, with the cpu, memory and pids controllers enabled.
+	Parent string
+	// MemoryMax is the memory limit in bytes.
+	MemoryMax int64
+	// CPUQuota is the cpu limit in number of cpus, such as 0.5 for half a cpu.
+	CPUQuota float64
+	// PidsMax is the maximum number of processes.
+	PidsMax int
+}
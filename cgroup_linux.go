@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// cpuPeriod is the period of cpu.max in microseconds.
+const cpuPeriod = 100000
+
+// sessionCgroup is the cgroup of a session.
+type sessionCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newSessionCgroup creates the cgroup named name under the parent of limits, with the limits set.
+func newSessionCgroup(limits *CgroupLimits, name string) (*sessionCgroup, error) {
+	parent := limits.Parent
+	if parent == "" {
+		parent = DefaultCgroupParent
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0); err != nil {
+		return nil, fmt.Errorf("failed to enable controllers in cgroup %s: %w", parent, err)
+	}
+
+	path := filepath.Join(parent, name)
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", path, err)
+	}
+
+	g := &sessionCgroup{path: path}
+
+	settings := map[string]string{}
+	if limits.MemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMax, 10)
+	}
+	if limits.CPUQuota > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.CPUQuota*cpuPeriod), cpuPeriod)
+	}
+	if limits.PidsMax > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.PidsMax)
+	}
+
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0); err != nil {
+			g.Close()
+			return nil, fmt.Errorf("failed to set %s of cgroup %s: %w", file, path, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		g.Close()
+		return nil, fmt.Errorf("failed to open cgroup %s: %w", path, err)
+	}
+	g.dir = dir
+
+	return g, nil
+}
+
+// apply starts the process in the cgroup, so its whole process tree is contained from the start.
+func (g *sessionCgroup) apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(g.dir.Fd())
+}
+
+// Close kills the processes left in the cgroup and removes it.
+func (g *sessionCgroup) Close() error {
+	var errs []error
+	if g.dir != nil {
+		errs = append(errs, g.dir.Close())
+	}
+
+	// cgroup.kill needs linux 5.14, the removal fails on older kernels if processes are left.
+	_ = os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0)
+
+	// the killed processes take a moment to leave the cgroup.
+	var err error
+	for range 10 {
+		if err = syscall.Rmdir(g.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			err = nil
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove cgroup %s: %w", g.path, err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package sshd
+
+import (
+	"errors"
+	"syscall"
+)
+
+type sessionCgroup struct{}
+
+func newSessionCgroup(*CgroupLimits, string) (*sessionCgroup, error) {
+	return nil, errors.New("cgroups are only supported on linux")
+}
+
+func (*sessionCgroup) apply(*syscall.SysProcAttr) {}
+
+func (*sessionCgroup) Close() error {
+	return nil
+}
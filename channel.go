@@ -3,36 +3,47 @@ package sshd
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
-	"os/user"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/creack/pty"
+	"github.com/fardream/sshd/wire"
 	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
 )
 
-// Channel
+// Channel is a session channel, which serves the requests of the client to set up and run its [Session].
 type Channel struct {
 	channel ssh.Channel
+	// metered counts the bytes on channel
+	metered *meteredChannel
 
 	// out-of-band request
 	requests <-chan *ssh.Request
-	// environment variables by env requests
-	env []string
 	// user of this channel
-	user *user.User
+	user *UserInfo
 
-	// tty for shell
-	tty *os.File
-	// pty for other end of shell
-	pty *os.File
+	// session is the program of the channel with its pty, environment and process.
+	session Session
+
+	// recording records the pty session if recording is enabled
+	recording atomic.Pointer[sessionRecording]
+
+	// cgroup contains the processes of the session if cgroup limits are set.
+	cgroup *sessionCgroup
+	// pam is the pam session of the program if pam is enabled.
+	pam *pamSession
 
 	// baseCtx is the context for this channel,
 	// and is used to request the channel to shutdown
@@ -40,248 +51,487 @@ type Channel struct {
 	// baseCancel cancels the baseCtx
 	baseCancel context.CancelFunc
 
-	// sftpServer is the sftp server.
-	sftpServer *sftp.Server
+	// sftpServer is the sftp server, either an [sftp.Server] or an [sftp.RequestServer].
+	sftpServer interface {
+		Serve() error
+		Close() error
+	}
 
 	// wg is the wait group used to wait for all the goroutines
 	wg *sync.WaitGroup
+
+	// srv holds the settings of the server this channel belongs to.
+	srv *Server
+	// conn is the connection this channel belongs to.
+	conn *ServerConn
+
+	// motd is the message of the day printed before the output of the shell.
+	motd []byte
+
+	// logger is the logger of this channel
+	logger *slog.Logger
+
+	// id uniquely identifies the channel
+	id string
+	// start is the time the channel is opened
+	start time.Time
 }
 
+// SetLogger sets the logger of the channel, it should be called before Loop.
+func (c *Channel) SetLogger(l *slog.Logger) {
+	c.logger = l
+}
+
+// Logger returns the logger of the channel.
+func (c *Channel) Logger() *slog.Logger {
+	return c.logger
+}
+
+// Loop processes the requests of the channel until it is closed.
+//
+// Deprecated: use [Channel.LoopContext], which reports how the channel ended.
 func (c *Channel) Loop() {
-reqloop:
+	c.LoopContext(context.Background())
+}
+
+// LoopContext processes the requests of the channel until it is closed,
+// or ctx is done, in which case the channel is torn down and the error of ctx is returned.
+func (c *Channel) LoopContext(ctx context.Context) error {
 	for {
 		select {
 		case req, ok := <-c.requests:
 			if !ok {
-				break reqloop
+				return nil
 			}
 			c.processReq(req)
 
+		case <-ctx.Done():
+			c.baseCancel()
+			return ctx.Err()
 		case <-c.baseCtx.Done():
-			break reqloop
+			return nil
 		}
 	}
 }
 
+// processReq replies to req with the handler of the server for its type, or the builtin one.
 func (c *Channel) processReq(req *ssh.Request) {
-	ok := false
-	var payloadBuf *bytes.Buffer
+	err := c.checkRequest(req.Type)
+	if err == nil {
+		handler, found := c.srv.ChannelRequestHandlers[req.Type]
+		if !found {
+			handler, found = builtinChannelRequests[req.Type]
+		}
+
+		if found {
+			err = handler.ServeRequest(c, req)
+		} else {
+			err = fmt.Errorf("unsupported req type: %w", errors.New(req.Type))
+		}
+	}
+
+	c.auditRequest(req, err)
+
+	var payload []byte
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRequestDeclined):
+		c.logger.Debug("request is declined", "type", req.Type, "err", err.Error())
+	default:
+		c.logger.Error("request failed", "type", req.Type, "err", err.Error())
+		payload = []byte(err.Error())
+	}
 
 	if req.WantReply {
-		payloadBuf = &bytes.Buffer{}
-		defer func() {
-			req.Reply(ok, payloadBuf.Bytes())
-		}()
+		req.Reply(err == nil, payload)
 	}
+}
 
-	switch req.Type {
-	case "subsystem":
-		subsystem, _, err := parseString(req.Payload)
-		if err != nil {
-			msgLogError(req.WantReply, payloadBuf,
-				"failed to find the subsystem requested", err)
-			return
-		}
+// sftpRoot returns the directory sftp is confined to with the tokens expanded, empty if not confined.
+func (c *Channel) sftpRoot() string {
+	root := c.conn.features.SFTPRoot
+	if root == "" {
+		return ""
+	}
 
-		if subsystem != "sftp" {
-			msgLogError(req.WantReply, payloadBuf, "unsupported system", errors.New(subsystem))
-			return
+	var b strings.Builder
+	for i := 0; i < len(root); i++ {
+		if root[i] != '%' || i == len(root)-1 {
+			b.WriteByte(root[i])
+			continue
 		}
-
-		sftpserver, err := sftp.NewServer(c.channel)
-		if err != nil {
-			msgLogError(req.WantReply, payloadBuf,
-				"failed to create sftp server over channel", err)
-			return
+		i++
+		switch root[i] {
+		case 'h':
+			b.WriteString(c.user.HomeDir)
+		case 'u':
+			b.WriteString(c.user.Username)
+		default:
+			b.WriteByte(root[i])
 		}
+	}
 
-		ok = true
-
-		c.sftpServer = sftpserver
+	return filepath.Clean(b.String())
+}
 
-		c.wg.Add(1)
+// serveSFTP starts the sftp server on the channel, the external one if configured.
+func (c *Channel) serveSFTP() error {
+	if c.srv.SFTPServer != "" && c.srv.SFTPHandlers == nil {
+		return c.serveExternalSFTP(c.srv.SFTPServer)
+	}
 
-		go func() {
-			defer c.wg.Done()
-			defer c.channel.Close()
-			if err := sftpserver.Serve(); err != nil {
-				log.Info("error during sftp session", "err", err.Error())
-			}
-		}()
+	return c.serveInternalSFTP()
+}
 
-	case "pty-req":
-		_, parsed, err := parseString(req.Payload)
+// serveInternalSFTP starts the sftp server of this process on the channel,
+// with the handlers of the server if set.
+func (c *Channel) serveInternalSFTP() error {
+	var handlers *sftp.Handlers
+	if c.srv.SFTPHandlers != nil {
+		h, err := c.srv.SFTPHandlers(c.conn.Info())
 		if err != nil {
-			msgLogError(req.WantReply, payloadBuf, "failed to parse terminfo", err)
-			return
+			return fmt.Errorf("failed to get sftp handlers: %w", err)
 		}
+		handlers = &h
+	} else if cred, err := sessionCredential(c.user); err != nil || cred != nil {
+		// the sftp server runs in this process, which cannot act as another user on the local files.
+		return errors.New("sftp cannot run as another user in process, an external sftp server is required")
+	}
 
-		cols, rows, _, _, err := parseWindowSize(req.Payload[parsed:])
-		if err != nil {
-			msgLogError(req.WantReply, payloadBuf,
-				"failed to parse window size", err)
-			return
+	// the local files are served through the handlers to confine or audit them.
+	var options []sftp.RequestServerOption
+	perms := c.conn.features.SFTPPermissions
+	if root := c.sftpRoot(); handlers == nil && (root != "" || perms != nil || c.srv.Hooks.OnSFTP != nil) {
+		if root == "" {
+			root = "/"
+			options = append(options, sftp.WithStartDirectory(c.srv.workingDir(&c.user.User)))
+		}
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			return fmt.Errorf("sftp root %s is not a directory", root)
 		}
+		h := sftpDir(root, perms)
+		handlers = &h
+	}
 
-		pty, tty, err := pty.Open()
+	var releaseUsage func()
+	if quota := c.conn.features.SFTPQuota; quota != (SFTPQuota{}) {
+		if c.sftpRoot() == "" && c.srv.SFTPHandlers == nil {
+			return errors.New("sftp quota requires an sftp root or handlers")
+		}
+		usage, release, err := c.srv.acquireSFTPUsage(c.user.Username, quota, *handlers)
 		if err != nil {
-			msgLogError(req.WantReply, payloadBuf,
-				"failed to create new pty", err)
-			return
+			return err
 		}
+		releaseUsage = release
+		h := quotaSFTP(*handlers, usage)
+		handlers = &h
+	}
 
-		c.pty = pty
-		c.tty = tty
+	if handlers != nil && c.srv.Hooks.OnSFTP != nil {
+		info := c.conn.Info()
+		h := auditSFTP(*handlers, func(event SFTPEvent) {
+			c.srv.Hooks.OnSFTP(info, event)
+		})
+		handlers = &h
+	}
 
-		if err := setWindowSize(int(c.pty.Fd()), uint16(rows), uint16(cols)); err != nil {
-			log.Info("failed to set window size", "err", err.Error())
+	if !c.conn.resources.reserve(sftpCost()) {
+		if releaseUsage != nil {
+			releaseUsage()
 		}
+		return errResourcesExhausted
+	}
 
-		ok = true
+	// the program starts once nothing can fail, since the tap applied by startProgram wraps the channel.
+	c.startProgram("sftp", "")
 
-	case "window-change":
-		if c.pty == nil {
-			msgLogError(req.WantReply, payloadBuf, "cannot setup pty", errors.New("pty is not setup"))
-			return
-		}
-
-		cols, rows, _, _, err := parseWindowSize(req.Payload)
+	r, w := c.throttleSFTP(c.channel, c.channel)
+	if c.srv.Metrics != nil {
+		r = &sftpPacketObserver{Reader: r, onPacket: c.srv.Metrics.sftpOp}
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{Reader: r, Writer: w, Closer: c.channel}
+
+	if handlers != nil {
+		c.sftpServer = sftp.NewRequestServer(rw, *handlers, options...)
+	} else {
+		sftpserver, err := sftp.NewServer(rw, sftp.WithServerWorkingDirectory(c.srv.workingDir(&c.user.User)))
 		if err != nil {
-			msgLogError(req.WantReply, payloadBuf, "failed to parse window size", err)
-			return
+			c.conn.resources.release(sftpCost())
+			if releaseUsage != nil {
+				releaseUsage()
+			}
+			c.session.exit(0, "")
+			return fmt.Errorf("failed to create sftp server over channel: %w", err)
 		}
+		c.sftpServer = sftpserver
+	}
 
-		if err := setWindowSize(int(c.pty.Fd()), uint16(rows), uint16(cols)); err != nil {
-			msgLogError(req.WantReply, payloadBuf, "failed to set window size", err)
-			return
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+		defer c.conn.resources.release(sftpCost())
+		defer c.startSession("sftp")()
+		// the sftp server has no exit status.
+		defer c.session.exit(0, "")
+		defer c.channel.Close()
+		if releaseUsage != nil {
+			defer releaseUsage()
 		}
+		if err := c.sftpServer.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			c.logger.Info("error during sftp session", "err", err.Error())
+		}
+	}()
 
-		ok = true
+	return nil
+}
 
-	case "env":
-		envname, consumed, err := parseString(req.Payload)
-		if err != nil {
-			msgLogError(req.WantReply, payloadBuf, "failed to get environment name", err)
-			return
+// serveExternalSFTP runs the sftp server command as the user, with its stdio tied to the channel.
+func (c *Channel) serveExternalSFTP(command string) error {
+	torun := c.command(c.srv.shell(c.user), "-c", command)
+	torun.Env = c.cmdEnv()
+	torun.Dir = c.srv.workingDir(&c.user.User)
+	// stdin is copied from the channel, which is only closed by the client.
+	torun.WaitDelay = time.Second
+	torun.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if root := c.sftpRoot(); root != "" {
+		if err := checkChrootDir(root); err != nil {
+			return err
 		}
+		torun.SysProcAttr.Chroot = root
+		torun.Dir = "/"
+	}
 
-		envvalue, _, err := parseString(req.Payload[consumed:])
-		if err != nil {
-			msgLogError(req.WantReply, payloadBuf, "failed to get environment value", err)
-			return
-		}
+	if err := c.prepareCmd(torun); err != nil {
+		c.releaseCmd()
+		return err
+	}
 
-		c.env = append(c.env, fmt.Sprintf("%s=%s", envname, envvalue))
+	// the stdio are tied to the channel once wrapped by the tap applied by startProgram.
+	c.startProgram("sftp", "")
+	torun.Stdin, torun.Stdout = c.throttleSFTP(c.channel, c.channel)
+	torun.Stderr = c.channel.Stderr()
 
-		ok = true
+	if err := c.startCmd(torun); err != nil {
+		c.releaseCmd()
+		c.session.exit(0, "")
+		return fmt.Errorf("failed to start sftp server %s: %w", command, err)
+	}
 
-	case "shell":
-		if len(req.Payload) > 0 {
-			msgLogError(req.WantReply, payloadBuf, "shell doesn't accept payload", errors.New(string(req.Payload)))
-			return
-		}
+	c.wg.Add(1)
 
-		if c.pty == nil {
-			msgLogError(req.WantReply, payloadBuf, "pty is not yet setup", errors.New("pty is not yet setup"))
-			return
-		}
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("sftp")()
+		c.finishCmd(torun)
+	}()
 
-		c.wg.Add(1)
-		go func() {
-			defer c.wg.Done()
-			c.ttyCmd("bash")
-		}()
+	return nil
+}
 
-		ok = true
+// runCommand runs command with the exec handler if set, or with the shell, in the pty if one is requested.
+func (c *Channel) runCommand(command string) {
+	c.startProgram("exec", command)
 
-	case "exec":
+	c.wg.Add(1)
 
-		commands := make([]string, 0, 16)
-		commands = append(commands, "-c")
-		payload := req.Payload
-		for len(payload) > 0 {
-			cmd, parsed, err := parseString(payload)
-			if err != nil {
-				msgLogError(req.WantReply, payloadBuf, "failed to parse command", err)
-				return
-			}
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("exec", attribute.String("ssh.command", command))()
+		if c.srv.ExecHandler != nil {
+			c.execHandler(command)
+		} else if !c.session.HasPTY() {
+			c.noTtyCmd(c.srv.shell(c.user), "-c", command)
+		} else {
+			c.ttyCmd(c.srv.shell(c.user), "-c", command)
+		}
+	}()
+}
 
-			commands = append(commands, cmd)
+// cmdEnv returns the environment of the shells and commands.
+// The variables set by the server override the ones requested by the client.
+func (c *Channel) cmdEnv() []string {
+	return mergeEnv(c.loginEnv(), c.session.Env(), c.conn.env)
+}
 
-			payload = payload[parsed:]
+// prepareCmd checks the working directory and sets the identity of the user and the resource limits on cmd.
+func (c *Channel) prepareCmd(cmd *exec.Cmd) error {
+	// like openssh, fall back to / if the home directory doesn't exist.
+	if _, err := os.Stat(cmd.Dir); err != nil {
+		c.logger.Info("cannot use working directory, using /", "dir", cmd.Dir, "err", err.Error())
+		cmd.Dir = "/"
+	}
+
+	cred, err := sessionCredential(c.user)
+	if err != nil {
+		return fmt.Errorf("failed to get credential of user: %w", err)
+	}
+	if cred != nil {
+		cmd.SysProcAttr.Credential = cred
+		if _, tty := c.session.terminal(); tty != nil {
+			if err := chownTTY(tty, cred); err != nil {
+				return fmt.Errorf("failed to give tty to user: %w", err)
+			}
 		}
+	}
 
-		if len(commands) <= 1 {
-			msgLogError(req.WantReply, payloadBuf, "no commands in exec", errors.New(string(req.Payload)))
-			return
+	if c.srv.Cgroup != nil {
+		cgroup, err := newSessionCgroup(c.srv.Cgroup, "session-"+c.id)
+		if err != nil {
+			return err
 		}
+		cgroup.apply(cmd.SysProcAttr)
+		c.cgroup = cgroup
+	}
 
-		ok = true
+	if c.srv.PAMService != "" {
+		if err := c.openPAM(cmd); err != nil {
+			return err
+		}
+	}
 
-		c.wg.Add(1)
+	return nil
+}
 
-		go func() {
-			defer c.wg.Done()
-			if c.tty == nil {
-				c.noTtyCmd("bash", commands...)
-			} else {
-				c.ttyCmd("bash", commands...)
-			}
-		}()
+// cmdWaitDelay is the time to wait for the output of a killed command,
+// which may be held open by its descendants out of its process group.
+const cmdWaitDelay = 2 * time.Second
 
-	default:
-		msgLogError(req.WantReply, payloadBuf, "unsupported req type", errors.New(req.Type))
-		return
+// command returns the command killed with its process group once the channel is closed.
+// The command must lead its process group, with Setpgid or Setsid.
+func (c *Channel) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(c.baseCtx, name, args...)
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
+	cmd.WaitDelay = cmdWaitDelay
+
+	return cmd
 }
 
-func msgLogError(wantReplay bool, payloadBuf *bytes.Buffer, msg string, err error) {
-	log.Error(msg, "err", err.Error())
-	if wantReplay {
-		fmt.Fprintf(payloadBuf, "%s: %s", msg, err.Error())
+// startCmd starts cmd prepared by prepareCmd, and applies the settings of the pam session to it.
+func (c *Channel) startCmd(cmd *exec.Cmd) error {
+	if !c.conn.resources.reserve(commandCost) {
+		return errResourcesExhausted
+	}
+
+	if err := cmd.Start(); err != nil {
+		c.conn.resources.release(commandCost)
+		return err
+	}
+	c.session.process.Store(cmd.Process)
+
+	if c.pam != nil {
+		if err := c.pam.attach(cmd.Process.Pid); err != nil {
+			c.logger.Error("failed to apply pam session to process", "err", err.Error())
+		}
 	}
+
+	return nil
 }
 
 func (c *Channel) finishCmd(cmd *exec.Cmd) {
 	if err := cmd.Wait(); err != nil {
-		log.Error("error in waiting for a process to finish", "err", err.Error())
-	}
-
-	if err := c.channel.CloseWrite(); err != nil {
-		log.Error("error in closing channel write", "err", err.Error())
+		c.logger.Error("error in waiting for a process to finish", "err", err.Error())
 	}
+	c.session.process.Store(nil)
+	c.conn.resources.release(commandCost)
+	c.releaseCmd()
 
 	exitcode := uint32(255)
+	var status syscall.WaitStatus
 	if cmd.ProcessState != nil {
 		exitcode = uint32(cmd.ProcessState.ExitCode())
+		status, _ = cmd.ProcessState.Sys().(syscall.WaitStatus)
+	}
+
+	c.finishSession(exitcode, status)
+}
+
+// failCmd reports the command that failed to start to the client and ends the session,
+// with the exit status a shell uses for a command it cannot run.
+func (c *Channel) failCmd(err error) {
+	c.logger.Error("failed to start command", "err", err.Error())
+
+	c.releaseCmd()
+
+	_, tty := c.session.terminal()
+	if tty != nil {
+		if err := tty.Close(); err != nil {
+			c.logger.Info("error in closing tty", "err", err.Error())
+		}
+	}
+
+	newline := "\n"
+	if tty != nil {
+		newline = "\r\n"
+	}
+	if _, err := fmt.Fprintf(c.channel.Stderr(), "sshd: %s%s", err.Error(), newline); err != nil {
+		c.logger.Debug("failed to send error to remote", "err", err.Error())
+	}
+
+	exitcode := uint32(127)
+	if errors.Is(err, fs.ErrPermission) {
+		exitcode = 126
+	}
+
+	c.finishSession(exitcode, 0)
+}
+
+// releaseCmd releases the cgroup and the pam session set up by prepareCmd.
+func (c *Channel) releaseCmd() {
+	c.closePAM()
+
+	if c.cgroup == nil {
+		return
+	}
+
+	if err := c.cgroup.Close(); err != nil {
+		c.logger.Error("failed to clean up cgroup", "err", err.Error())
 	}
+	c.cgroup = nil
+}
 
-	if _, err := c.channel.SendRequest(
-		"exit-status",
-		false,
-		binary.BigEndian.AppendUint32(nil, exitcode)); err != nil {
-		log.Error("failed to send exit code to remote", "err", err.Error())
+// finishSession reports how the program of the session ended and closes the channel.
+// exit-signal is sent if status is signaled, exit-status with exitcode otherwise.
+func (c *Channel) finishSession(exitcode uint32, status syscall.WaitStatus) {
+	if err := c.channel.CloseWrite(); err != nil {
+		c.logger.Error("error in closing channel write", "err", err.Error())
+	}
+
+	if payload, ok := exitSignal(status); ok {
+		c.session.exit(0, sshSignalName(status.Signal()))
+		if _, err := c.channel.SendRequest("exit-signal", false, payload); err != nil {
+			c.logger.Error("failed to send exit signal to remote", "err", err.Error())
+		}
+	} else {
+		c.session.exit(exitcode, "")
+		if _, err := c.channel.SendRequest("exit-status", false, wire.MarshalExitStatus(exitcode)); err != nil {
+			c.logger.Error("failed to send exit code to remote", "err", err.Error())
+		}
 	}
 
 	if err := c.channel.Close(); err != nil {
-		log.Error("error in closing channel", "err", err.Error())
+		c.logger.Error("error in closing channel", "err", err.Error())
 	}
 }
 
 func (c *Channel) ttyCmd(cmd string, args ...string) {
-	torun := exec.Command(cmd, args...)
+	torun := c.command(cmd, args...)
 
-	torun.ExtraFiles = []*os.File{c.tty}
-	torun.Stdout = c.tty
-	torun.Stderr = c.tty
-	torun.Stdin = c.tty
+	pty, tty := c.session.terminal()
+	torun.ExtraFiles = []*os.File{tty}
+	torun.Stdout = tty
+	torun.Stderr = tty
+	torun.Stdin = tty
 
-	torun.Dir = c.user.HomeDir
-	torun.Env = append(
-		torun.Env,
-		fmt.Sprintf("USER=%s", c.user.Username),
-		fmt.Sprintf("HOME=%s", c.user.HomeDir))
-	torun.Env = append(torun.Env, c.env...)
+	torun.Dir = c.srv.workingDir(&c.user.User)
+	torun.Env = c.cmdEnv()
 
 	torun.SysProcAttr = &syscall.SysProcAttr{
 		Setsid:  true,
@@ -289,22 +539,55 @@ func (c *Channel) ttyCmd(cmd string, args ...string) {
 		Ctty:    3,
 	}
 
+	if err := c.prepareCmd(torun); err != nil {
+		c.failCmd(err)
+		return
+	}
+
+	var input io.Reader = c.channel
+	var output io.Reader = pty
+	if len(c.motd) > 0 {
+		output = io.MultiReader(bytes.NewReader(c.motd), output)
+	}
+
+	if opts := c.srv.Recording; opts != nil {
+		cols, rows := c.session.WindowSize()
+		recording, err := newSessionRecording(opts, c.user.Username, cols, rows, map[string]string{"SHELL": cmd})
+		if err != nil {
+			c.logger.Error("failed to start session recording", "err", err.Error())
+		} else {
+			c.recording.Store(recording)
+			defer func() {
+				if err := recording.Close(); err != nil {
+					c.logger.Error("failed to close session recording", "err", err.Error())
+				}
+			}()
+
+			input = &recordingReader{Reader: input, record: recording.recordInput}
+			output = &recordingReader{Reader: output, record: recording.recordOutput}
+		}
+	}
+
+	if err := c.startCmd(torun); err != nil {
+		c.failCmd(fmt.Errorf("failed to start %s: %w", cmd, err))
+		return
+	}
+
+	if c.srv.RecordLogins {
+		// deferred before finishCmd, so the logout is recorded after the process exits.
+		defer c.recordLogin(torun.Process.Pid)()
+	}
 	defer c.finishCmd(torun)
 
 	waiter := make(chan struct{})
 	defer func() {
-		if err := c.tty.Close(); err != nil {
-			log.Info("error in closing tty", "err", err.Error())
+		if err := tty.Close(); err != nil {
+			c.logger.Info("error in closing tty", "err", err.Error())
 		}
 
 		<-waiter
 	}()
 
-	if err := torun.Start(); err != nil {
-		log.Error("failed to start command", "err", err.Error(), "cmd", cmd)
-		return
-	}
-
 	go func() {
 		defer func() {
 			select {
@@ -314,7 +597,7 @@ func (c *Channel) ttyCmd(cmd string, args ...string) {
 			}
 		}()
 
-		_, _ = io.Copy(c.pty, c.channel)
+		_, _ = copyStream(pty, input)
 	}()
 
 	go func() {
@@ -326,20 +609,43 @@ func (c *Channel) ttyCmd(cmd string, args ...string) {
 			}
 		}()
 
-		_, _ = io.Copy(c.channel, c.pty)
+		_, _ = copyStream(c.channel, output)
 	}()
 }
 
 func (c *Channel) noTtyCmd(cmd string, args ...string) {
-	torun := exec.Command(cmd, args...)
+	torun := c.command(cmd, args...)
 
 	torun.Stdout = c.channel
-	torun.Stderr = c.channel
+	// stderr goes to the extended data stream, so the client can tell it from stdout.
+	torun.Stderr = c.channel.Stderr()
+	torun.Env = c.cmdEnv()
+	torun.Dir = c.srv.workingDir(&c.user.User)
+
+	// the command leads a process group, so signals reach its children too.
+	torun.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.prepareCmd(torun); err != nil {
+		c.failCmd(err)
+		return
+	}
 
-	defer c.finishCmd(torun)
+	// the pipe is fed by the session instead of exec, so Wait doesn't wait for the client to close its input.
+	stdin, err := torun.StdinPipe()
+	if err != nil {
+		c.failCmd(fmt.Errorf("failed to create stdin pipe: %w", err))
+		return
+	}
 
-	if err := torun.Start(); err != nil {
-		log.Error("failed to start command", "err", err.Error(), "cmd", cmd)
+	if err := c.startCmd(torun); err != nil {
+		c.failCmd(fmt.Errorf("failed to start %s: %w", cmd, err))
 		return
 	}
+
+	go func() {
+		// closing stdin passes the eof from the client to the command.
+		defer stdin.Close()
+		_, _ = copyStream(stdin, c.channel)
+	}()
+
+	c.finishCmd(torun)
 }
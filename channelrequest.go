@@ -0,0 +1,291 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/creack/pty"
+	"github.com/fardream/sshd/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// ChannelRequestHandler handles a request of a session channel, such as pty-req, env or exec.
+type ChannelRequestHandler interface {
+	// ServeRequest processes req on the channel c, returning an error rejects the request.
+	// The error is logged, and sent to the client in the reply unless it is [ErrRequestDeclined].
+	ServeRequest(c *Channel, req *ssh.Request) error
+}
+
+// ChannelRequestHandlerFunc is a function implementing [ChannelRequestHandler].
+type ChannelRequestHandlerFunc func(c *Channel, req *ssh.Request) error
+
+func (f ChannelRequestHandlerFunc) ServeRequest(c *Channel, req *ssh.Request) error {
+	return f(c, req)
+}
+
+// ErrRequestDeclined rejects a channel request without reporting a failure,
+// such as a disabled pty the client falls back from.
+var ErrRequestDeclined = errors.New("request declined")
+
+// builtinChannelRequests are the session channel requests handled by the server itself.
+var builtinChannelRequests = map[string]ChannelRequestHandler{
+	"subsystem":     ChannelRequestHandlerFunc(subsystemRequest),
+	"pty-req":       ChannelRequestHandlerFunc(ptyRequest),
+	"window-change": ChannelRequestHandlerFunc(windowChangeRequest),
+	"env":           ChannelRequestHandlerFunc(envRequest),
+	"signal":        ChannelRequestHandlerFunc(signalRequest),
+	"break":         ChannelRequestHandlerFunc(breakRequest),
+	"shell":         ChannelRequestHandlerFunc(shellRequest),
+	"exec":          ChannelRequestHandlerFunc(execRequest),
+}
+
+// DefaultChannelRequestHandler returns the builtin handler of requestType, nil if there is none.
+// Custom handlers can fall back to it.
+func DefaultChannelRequestHandler(requestType string) ChannelRequestHandler {
+	return builtinChannelRequests[requestType]
+}
+
+// checkRequest rejects the requests not allowed in the current state of the channel.
+func (c *Channel) checkRequest(requestType string) error {
+	if c.conn.features.SFTPOnly {
+		switch requestType {
+		case "shell", "exec", "pty-req", "x11-req", "auth-agent-req@openssh.com":
+			return fmt.Errorf("only sftp is allowed: %w", errors.New(requestType))
+		}
+	}
+
+	// per rfc 4254, a session channel runs a single program, and its pty is set up before the program starts.
+	switch requestType {
+	case "shell", "exec", "subsystem":
+		if state := c.session.State(); state != SessionPending {
+			return fmt.Errorf("program already started: %w", errors.New(c.session.Type()))
+		}
+	case "pty-req":
+		if c.session.HasPTY() || c.session.State() != SessionPending {
+			return errors.New("cannot request pty: pty already requested or program started")
+		}
+	}
+
+	return nil
+}
+
+func subsystemRequest(c *Channel, req *ssh.Request) error {
+	subsystem, _, err := wire.ParseStringMax(req.Payload, wire.MaxNameLength)
+	if err != nil {
+		return fmt.Errorf("failed to find the subsystem requested: %w", err)
+	}
+
+	if c.srv.Honeypot != nil {
+		return fmt.Errorf("unsupported system %s: %w", subsystem, errHoneypot)
+	}
+
+	if forced := c.forcedCommand(); forced != "" && !c.conn.features.SFTPOnly {
+		if err := c.runForced(forced, subsystem); err != nil {
+			return fmt.Errorf("failed to run forced command: %w", err)
+		}
+		return nil
+	}
+
+	if subsystem != "sftp" || c.conn.features.DisableSFTP {
+		return fmt.Errorf("unsupported system: %w", errors.New(subsystem))
+	}
+
+	if err := c.serveSFTP(); err != nil {
+		return fmt.Errorf("failed to start sftp: %w", err)
+	}
+
+	return nil
+}
+
+func ptyRequest(c *Channel, req *ssh.Request) error {
+	if c.conn.features.DisablePTY {
+		// not an error, the client falls back to a session without pty.
+		return fmt.Errorf("pty is not allowed: %w", ErrRequestDeclined)
+	}
+
+	term, parsed, err := wire.ParseStringMax(req.Payload, wire.MaxNameLength)
+	if err != nil {
+		return fmt.Errorf("failed to parse terminfo: %w", err)
+	}
+
+	cols, rows, _, _, err := wire.ParseWindowSize(req.Payload[parsed:])
+	if err != nil {
+		return fmt.Errorf("failed to parse window size: %w", err)
+	}
+
+	// modes are optional, some clients omit the string.
+	var modes ssh.TerminalModes
+	if encoded, _, err := wire.ParseString(req.Payload[parsed+16:]); err == nil {
+		if modes, err = wire.ParseTerminalModes([]byte(encoded)); err != nil {
+			c.logger.Info("failed to parse terminal modes", "err", err.Error())
+		}
+	}
+
+	if !c.conn.resources.reserve(ptyCost) {
+		return fmt.Errorf("failed to create new pty: %w", errResourcesExhausted)
+	}
+
+	pty, tty, err := pty.Open()
+	if err != nil {
+		c.conn.resources.release(ptyCost)
+		return fmt.Errorf("failed to create new pty: %w", err)
+	}
+
+	c.session.setTerminal(pty, tty, term, cols, rows)
+
+	if err := setWindowSize(int(pty.Fd()), uint16(rows), uint16(cols)); err != nil {
+		c.logger.Info("failed to set window size", "err", err.Error())
+	}
+
+	if err := applyTerminalModes(tty, modes); err != nil {
+		c.logger.Info("failed to apply terminal modes", "err", err.Error())
+	}
+
+	return nil
+}
+
+func windowChangeRequest(c *Channel, req *ssh.Request) error {
+	pty, _ := c.session.terminal()
+	if pty == nil {
+		return errors.New("cannot setup pty: pty is not setup")
+	}
+
+	cols, rows, _, _, err := wire.ParseWindowSize(req.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse window size: %w", err)
+	}
+
+	if err := setWindowSize(int(pty.Fd()), uint16(rows), uint16(cols)); err != nil {
+		return fmt.Errorf("failed to set window size: %w", err)
+	}
+
+	c.session.resize(cols, rows)
+	if recording := c.recording.Load(); recording != nil {
+		recording.recordResize(cols, rows)
+	}
+
+	return nil
+}
+
+func envRequest(c *Channel, req *ssh.Request) error {
+	maxLength, maxCount := c.srv.envLimits()
+
+	envname, consumed, err := wire.ParseStringMax(req.Payload, maxLength)
+	if err != nil {
+		return fmt.Errorf("failed to get environment name: %w", err)
+	}
+
+	envvalue, _, err := wire.ParseStringMax(req.Payload[consumed:], maxLength-len(envname))
+	if err != nil {
+		return fmt.Errorf("failed to get environment value: %w", err)
+	}
+
+	if !c.srv.acceptEnv(envname) {
+		return fmt.Errorf("environment variable %s is not accepted: %w", envname, ErrRequestDeclined)
+	}
+
+	if !c.session.addEnv(fmt.Sprintf("%s=%s", envname, envvalue), maxCount) {
+		return fmt.Errorf("too many environment variables: more than %d", maxCount)
+	}
+
+	return nil
+}
+
+func signalRequest(c *Channel, req *ssh.Request) error {
+	name, _, err := wire.ParseStringMax(req.Payload, wire.MaxNameLength)
+	if err != nil {
+		return fmt.Errorf("failed to parse signal: %w", err)
+	}
+
+	if err := c.signal(name); err != nil {
+		return fmt.Errorf("failed to signal process: %w", err)
+	}
+
+	return nil
+}
+
+func breakRequest(c *Channel, req *ssh.Request) error {
+	// the break length in the payload is meaningless for a pty.
+	if err := c.sendBreak(); err != nil {
+		return fmt.Errorf("failed to send break: %w", err)
+	}
+
+	return nil
+}
+
+func shellRequest(c *Channel, req *ssh.Request) error {
+	if c.conn.features.DisableShell {
+		return errors.New("shell is not allowed: shell is disabled")
+	}
+
+	if len(req.Payload) > 0 {
+		return fmt.Errorf("shell doesn't accept payload: %w", errors.New(string(req.Payload)))
+	}
+
+	if c.srv.Honeypot != nil {
+		c.honeypotShell()
+		return nil
+	}
+
+	if forced := c.forcedCommand(); forced != "" {
+		if err := c.runForced(forced, ""); err != nil {
+			return fmt.Errorf("failed to run forced command: %w", err)
+		}
+		return nil
+	}
+
+	if !c.session.HasPTY() {
+		return errors.New("pty is not yet setup")
+	}
+
+	c.startProgram("shell", "")
+	c.motd = c.loadMOTD()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("shell")()
+		c.ttyCmd(c.srv.shell(c.user))
+	}()
+
+	return nil
+}
+
+func execRequest(c *Channel, req *ssh.Request) error {
+	if c.conn.features.DisableExec {
+		return errors.New("exec is not allowed: exec is disabled")
+	}
+
+	command, _, err := wire.ParseStringMax(req.Payload, c.srv.maxCommandLength())
+	if err != nil {
+		return fmt.Errorf("failed to parse command: %w", err)
+	}
+
+	if command == "" {
+		return errors.New("no command in exec: empty command")
+	}
+
+	if c.srv.Honeypot != nil {
+		c.honeypotExec(command)
+		return nil
+	}
+
+	if forced := c.forcedCommand(); forced != "" {
+		if err := c.runForced(forced, command); err != nil {
+			return fmt.Errorf("failed to run forced command: %w", err)
+		}
+		return nil
+	}
+
+	if args, isSCP := parseSCPCommand(command); isSCP && c.srv.BuiltinSCP && c.srv.ExecHandler == nil && !c.session.HasPTY() {
+		// like sftp, scp in process cannot act as another user, and falls back to the scp of the system.
+		if cred, err := sessionCredential(c.user); err == nil && cred == nil {
+			c.serveSCP(command, args)
+			return nil
+		}
+	}
+
+	c.runCommand(command)
+
+	return nil
+}
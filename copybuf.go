@@ -0,0 +1,25 @@
+package sshd
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers copying the streams of the sessions and the forwardings.
+const copyBufferSize = 32 << 10
+
+// copyBuffers are the copy buffers shared by all the connections.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyStream copies src to dst like io.Copy, with a buffer from copyBuffers.
+func copyStream(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,135 @@
+package sshd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+)
+
+// sessionCredential returns the credential to run the processes of u with, including the supplementary groups,
+// nil if the server is not running as root or is already running as u.
+func sessionCredential(u *UserInfo) (*syscall.Credential, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %s of user %s: %w", u.Uid, u.Username, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %s of user %s: %w", u.Gid, u.Username, err)
+	}
+
+	if uid == 0 {
+		return nil, nil
+	}
+
+	groups, err := supplementaryGroups(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
+// supplementaryGroups returns the ids of the groups u is a member of, like initgroups(3).
+func supplementaryGroups(u *UserInfo) ([]uint32, error) {
+	gids, err := u.groupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups of user %s: %w", u.Username, err)
+	}
+
+	groups := make([]uint32, 0, len(gids))
+	for _, gid := range gids {
+		v, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group id %s of user %s: %w", gid, u.Username, err)
+		}
+		groups = append(groups, uint32(v))
+	}
+
+	return groups, nil
+}
+
+// chownTTY gives the tty to the user of the session like openssh does,
+// so the user can read and write the terminal after the privileges are dropped.
+func chownTTY(tty *os.File, cred *syscall.Credential) error {
+	if err := os.Chown(tty.Name(), int(cred.Uid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to change owner of %s: %w", tty.Name(), err)
+	}
+
+	if err := os.Chmod(tty.Name(), 0o620); err != nil {
+		return fmt.Errorf("failed to change mode of %s: %w", tty.Name(), err)
+	}
+
+	return nil
+}
+
+// checkAccess checks if the user of cred has the permission perm (the rwx bits) on path,
+// and can search all the directories leading to it, since the server itself may have more privileges.
+func checkAccess(path string, cred *syscall.Credential, perm uint32) error {
+	path = filepath.Clean(path)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if err := checkMode(dir, cred, 1); err != nil {
+			return err
+		}
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+
+	return checkMode(path, cred, perm)
+}
+
+func checkMode(path string, cred *syscall.Credential, perm uint32) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	mode := uint32(st.Mode)
+	switch {
+	case st.Uid == cred.Uid:
+		mode >>= 6
+	case st.Gid == cred.Gid || slices.Contains(cred.Groups, st.Gid):
+		mode >>= 3
+	}
+
+	if mode&perm != perm {
+		return fmt.Errorf("%s: %w", path, fs.ErrPermission)
+	}
+
+	return nil
+}
+
+// checkChrootDir checks that dir and all the directories leading to it are owned by root
+// and not writable by others, like openssh requires for ChrootDirectory,
+// so the user cannot plant files that the programs in the chroot trust.
+func checkChrootDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("chroot directory %s is not absolute", dir)
+	}
+
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			return fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return fmt.Errorf("chroot path %s is not a directory", dir)
+		}
+		if st.Uid != 0 || st.Mode&0o022 != 0 {
+			return fmt.Errorf("bad ownership or modes for chroot directory %s", dir)
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package sshd
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsCacheTTL is how long the resolved host names are cached.
+	dnsCacheTTL = 5 * time.Minute
+	// dnsLookupTimeout bounds the lookups for a remote address.
+	dnsLookupTimeout = 5 * time.Second
+	// dnsCacheMaxEntries bounds the cache, which is flushed once full.
+	dnsCacheMaxEntries = 4096
+)
+
+type hostCacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// hostCache caches the verified host names by ip.
+type hostCache struct {
+	mu      sync.Mutex
+	entries map[string]hostCacheEntry
+}
+
+// remoteHosts is shared by all the servers, since the names don't depend on the server.
+var remoteHosts = &hostCache{}
+
+// lookup returns the host name of ip, or ip itself if the reverse lookup fails
+// or the name doesn't resolve back to ip, which is how openssh guards against spoofed PTR records.
+func (c *hostCache) lookup(ip string) string {
+	c.mu.Lock()
+	entry, ok := c.entries[ip]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.name
+	}
+
+	name := resolveHost(ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= dnsCacheMaxEntries {
+		c.entries = make(map[string]hostCacheEntry)
+	}
+	c.entries[ip] = hostCacheEntry{name: name, expires: time.Now().Add(dnsCacheTTL)}
+
+	return name
+}
+
+// resolveHost does the forward confirmed reverse lookup of ip.
+func resolveHost(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		log.Debug("failed reverse lookup", "ip", ip, "err", err.Error())
+		return ip
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		if slices.Contains(addrs, ip) {
+			return strings.ToLower(name)
+		}
+	}
+
+	log.Info("reverse lookup doesn't map back to the address", "ip", ip, "names", names)
+
+	return ip
+}
+
+// RemoteHost returns the host name of addr resolved by reverse dns if UseDNS is set, or its ip otherwise.
+// The names are resolved when the connections are accepted and cached,
+// so it is cheap to call from the authentication callbacks.
+func (s *Server) RemoteHost(addr net.Addr) string {
+	ip := addrHost(addr)
+	if !s.UseDNS || net.ParseIP(ip) == nil {
+		return ip
+	}
+
+	return remoteHosts.lookup(ip)
+}
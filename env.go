@@ -0,0 +1,163 @@
+package sshd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// DefaultAcceptEnv are the environment variables accepted from the clients if none is configured,
+// which are the locale variables sent by openssh clients.
+var DefaultAcceptEnv = []string{"LANG", "LC_*"}
+
+const (
+	// DefaultPath is the PATH of the sessions, like the default of openssh.
+	DefaultPath = "/usr/local/bin:/usr/bin:/bin:/usr/games"
+	// DefaultRootPath is the PATH of the sessions of root.
+	DefaultRootPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// DefaultEnvironmentFile is the system wide environment file read by pam_env.
+	DefaultEnvironmentFile = "/etc/environment"
+
+	// DefaultMaxEnvLength is the longest environment variable the clients can set if none is configured.
+	DefaultMaxEnvLength = 32 << 10
+	// DefaultMaxEnvCount is the most environment variables a client can set in a session if none is configured,
+	// like openssh.
+	DefaultMaxEnvCount = 1000
+)
+
+// acceptEnv checks if the client can set the environment variable name.
+func (s *Server) acceptEnv(name string) bool {
+	patterns := s.AcceptEnv
+	if patterns == nil {
+		patterns = DefaultAcceptEnv
+	}
+
+	return matchPatternList(patterns, name)
+}
+
+// envLimits returns the longest environment variable, the name and the value together,
+// and the most environment variables the clients can set in a session.
+func (s *Server) envLimits() (int, int) {
+	maxLength, maxCount := s.MaxEnvLength, s.MaxEnvCount
+	if maxLength <= 0 {
+		maxLength = DefaultMaxEnvLength
+	}
+	if maxCount <= 0 {
+		maxCount = DefaultMaxEnvCount
+	}
+
+	return maxLength, maxCount
+}
+
+// sessionEnv returns the environment variables the server sets for the sessions of the connection.
+func (s *Server) sessionEnv(info ConnInfo) []string {
+	env := slices.Clone(s.Env)
+	if s.UserEnv != nil {
+		env = append(env, s.UserEnv(info)...)
+	}
+
+	return env
+}
+
+// mergeEnv merges the lists of key=value environment variables,
+// where a variable overrides the earlier ones of the same name.
+func mergeEnv(lists ...[]string) []string {
+	var merged []string
+	index := make(map[string]int)
+
+	for _, list := range lists {
+		for _, kv := range list {
+			name, _, _ := strings.Cut(kv, "=")
+			if i, ok := index[name]; ok {
+				merged[i] = kv
+				continue
+			}
+			index[name] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+
+	return merged
+}
+
+// loginEnv returns the environment of a login of the user of the channel,
+// with the variables of the environment file of the server if set.
+func (c *Channel) loginEnv() []string {
+	shell := c.srv.shell(c.user)
+	if path, err := exec.LookPath(shell); err == nil {
+		shell = path
+	}
+
+	path := DefaultPath
+	if c.user.Uid == "0" {
+		path = DefaultRootPath
+	}
+
+	env := []string{
+		"USER=" + c.user.Username,
+		"LOGNAME=" + c.user.Username,
+		"HOME=" + c.user.HomeDir,
+		"SHELL=" + shell,
+		"PATH=" + path,
+		"MAIL=/var/mail/" + c.user.Username,
+	}
+	if term := c.session.Term(); term != "" {
+		env = append(env, "TERM="+term)
+	}
+
+	if c.srv.EnvironmentFile != "" {
+		fileEnv, err := readEnvironmentFile(c.srv.EnvironmentFile)
+		if err != nil {
+			c.logger.Info("failed to read environment file", "err", err.Error())
+		}
+		env = mergeEnv(env, fileEnv)
+	}
+
+	return env
+}
+
+// readEnvironmentFile reads the key=value lines of an environment file like /etc/environment.
+// Comments, export prefixes and quotes around the values are stripped.
+func readEnvironmentFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open environment file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	env, err := parseEnvironmentFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment file %s: %w", path, err)
+	}
+
+	return env, nil
+}
+
+func parseEnvironmentFile(r io.Reader) ([]string, error) {
+	var env []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		env = append(env, name+"="+value)
+	}
+
+	return env, scanner.Err()
+}
@@ -0,0 +1,54 @@
+package sshd
+
+import (
+	"context"
+	"io"
+)
+
+// ExecRequest is an exec request passed to an [ExecHandler].
+type ExecRequest struct {
+	// Command is the command requested by the client, or the forced command.
+	Command string
+	// Env are the environment variables of the session, in the form of key=value.
+	Env []string
+	// User is the authenticated user.
+	User *UserInfo
+	// Channel is the session channel.
+	Channel *Channel
+
+	// Stdin reads the input of the client.
+	Stdin io.Reader
+	// Stdout and Stderr write to the client.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecHandler runs the exec requests instead of the shell,
+// such as for git only servers or application level command line interfaces.
+type ExecHandler interface {
+	// ServeExec runs the command of req, and returns the exit status sent to the client.
+	// ctx is canceled when the session is closed.
+	ServeExec(ctx context.Context, req *ExecRequest) uint32
+}
+
+// ExecHandlerFunc is a function implementing [ExecHandler].
+type ExecHandlerFunc func(ctx context.Context, req *ExecRequest) uint32
+
+func (f ExecHandlerFunc) ServeExec(ctx context.Context, req *ExecRequest) uint32 {
+	return f(ctx, req)
+}
+
+// execHandler runs command with the exec handler of the server and finishes the session.
+func (c *Channel) execHandler(command string) {
+	exitcode := c.srv.ExecHandler.ServeExec(c.baseCtx, &ExecRequest{
+		Command: command,
+		Env:     c.cmdEnv(),
+		User:    c.user,
+		Channel: c,
+		Stdin:   c.channel,
+		Stdout:  c.channel,
+		Stderr:  c.channel.Stderr(),
+	})
+
+	c.finishSession(exitcode, 0)
+}
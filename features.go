@@ -0,0 +1,107 @@
+package sshd
+
+import "slices"
+
+// Features controls the features available to the sessions of a connection, and the command forced on them.
+// The zero value allows everything.
+type Features struct {
+	// DisablePTY rejects pty requests.
+	DisablePTY bool
+	// DisableShell rejects shell requests.
+	DisableShell bool
+	// DisableExec rejects exec requests.
+	DisableExec bool
+	// DisableSFTP rejects the sftp subsystem.
+	DisableSFTP bool
+	// SFTPOnly allows nothing but the sftp subsystem, like the sftp chroot accounts of openssh:
+	// shell, exec, pty, other subsystems and forwarding are rejected, and forced commands are not run.
+	SFTPOnly bool
+	// SFTPRoot, if set, confines sftp to the directory, where %h is replaced by the home directory of the user,
+	// %u by the user name, and %% by %. The sftp server in process serves the directory as /,
+	// and an external sftp server is run chrooted to it, which requires the directory and its parents
+	// to be owned by root and not writable by others, like ChrootDirectory of openssh.
+	SFTPRoot string
+	// SFTPPermissions, if set, controls the modes and owners of the files created by the sftp server in process.
+	SFTPPermissions *SFTPPermissions
+	// SFTPQuota limits the storage of the user under SFTPRoot, or in the sftp handlers of the server.
+	// Without either, sftp is rejected since there is no tree to measure.
+	SFTPQuota SFTPQuota
+	// DisableLocalForwarding rejects the forwarding of connections from the client (ssh -L).
+	DisableLocalForwarding bool
+	// DisableRemoteForwarding rejects the forwarding of connections to the client (ssh -R).
+	DisableRemoteForwarding bool
+	// PermitOpen, if not nil, are the host:port destinations the clients can forward connections to,
+	// where either can be *, and any and none allow everything and nothing.
+	PermitOpen []string
+	// PermitListen, if not nil, are the [host:]port addresses the clients can listen on for remote forwarding,
+	// in the same format as PermitOpen.
+	PermitListen []string
+
+	// ForceCommand, if set, runs instead of the shell, command or subsystem requested by the client,
+	// which is passed in SSH_ORIGINAL_COMMAND. [InternalSFTP] serves sftp.
+	// The force-command critical option of the authentication permissions takes precedence.
+	ForceCommand string
+}
+
+// features returns the features available to the connection.
+func (s *Server) features(info ConnInfo) Features {
+	features := s.Features
+	if s.UserFeatures != nil {
+		features = s.UserFeatures(info)
+	}
+
+	if s.DisableSFTP {
+		features.DisableSFTP = true
+	}
+
+	if s.Honeypot != nil {
+		features = Features{
+			DisableSFTP:             true,
+			DisableLocalForwarding:  true,
+			DisableRemoteForwarding: true,
+		}
+	}
+
+	if features.SFTPOnly {
+		features.DisableLocalForwarding = true
+		features.DisableRemoteForwarding = true
+	}
+
+	return features
+}
+
+// DenyPTYFor returns a function for [Server.UserFeatures] which disables pty for users and the members of groups,
+// such as automation accounts, on top of the features of base.
+// The clients are refused the pty cleanly and fall back to sessions without a terminal.
+// The groups of the user are those of its account from [Server.Users].
+func DenyPTYFor(base Features, users, groups []string) func(info ConnInfo) Features {
+	return func(info ConnInfo) Features {
+		features := base
+
+		if slices.Contains(users, info.User) {
+			features.DisablePTY = true
+			return features
+		}
+
+		if len(groups) == 0 {
+			return features
+		}
+
+		names, err := userGroupNames(info.User, info.Account)
+		if err != nil {
+			// fail closed if the groups are unknown.
+			log.Warn("failed to get groups for PermitTTY", "user", info.User, "err", err.Error())
+			features.DisablePTY = true
+			return features
+		}
+
+		for _, name := range names {
+			if slices.Contains(groups, name) {
+				features.DisablePTY = true
+				break
+			}
+		}
+
+		return features
+	}
+}
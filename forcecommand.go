@@ -0,0 +1,34 @@
+package sshd
+
+// InternalSFTP is the forced command serving sftp in process, like internal-sftp of openssh.
+const InternalSFTP = "internal-sftp"
+
+// forcedCommand returns the command forced on the connection, empty if there is none.
+// The force-command option of the key or certificate takes precedence over the configured one.
+func (c *Channel) forcedCommand() string {
+	if perms := c.conn.sshcon.Permissions; perms != nil {
+		if command, ok := perms.CriticalOptions["force-command"]; ok {
+			return command
+		}
+	}
+
+	return c.conn.features.ForceCommand
+}
+
+// runForced runs the forced command instead of what the client requested,
+// with the requested command or subsystem in SSH_ORIGINAL_COMMAND.
+func (c *Channel) runForced(forced, original string) error {
+	c.logger.Info("running forced command", "command", forced, "original_command", original)
+
+	if original != "" {
+		c.session.addEnv("SSH_ORIGINAL_COMMAND="+original, 0)
+	}
+
+	if forced == InternalSFTP {
+		return c.serveInternalSFTP()
+	}
+
+	c.runCommand(forced)
+
+	return nil
+}
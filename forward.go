@@ -0,0 +1,370 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/fardream/sshd/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// tcpipForwardMsg is the payload of tcpip-forward and cancel-tcpip-forward requests.
+type tcpipForwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+// remoteForward listens on the address requested by the client,
+// and forwards the accepted connections to the client (ssh -R).
+func remoteForward(s *ServerConn, req *ssh.Request) (bool, []byte) {
+	if s.features.DisableRemoteForwarding {
+		s.logger.Info("remote forwarding is not allowed")
+		return false, nil
+	}
+
+	var msg tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		s.logger.Info("invalid tcpip-forward request", "err", err.Error())
+		return false, nil
+	}
+
+	if !s.permitListen(msg.Addr, msg.Port) {
+		s.logger.Info("remote forwarding is not permitted", "addr", msg.Addr, "port", msg.Port)
+		return false, nil
+	}
+
+	// like openssh, only root can listen on privileged ports.
+	if msg.Port != 0 && msg.Port < 1024 && s.user.Uid != "0" {
+		s.logger.Info("privileged port cannot be forwarded", "port", msg.Port)
+		return false, nil
+	}
+
+	if !s.resources.reserve(listenerCost) {
+		s.logger.Info("failed to listen for remote forwarding", "err", errResourcesExhausted.Error())
+		return false, nil
+	}
+
+	l, err := net.Listen("tcp", forwardListenAddr(msg.Addr, msg.Port))
+	if err != nil {
+		s.resources.release(listenerCost)
+		s.logger.Info("failed to listen for remote forwarding", "err", err.Error())
+		return false, nil
+	}
+
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	if !s.addForward(forwardKey(msg.Addr, port), l) {
+		s.resources.release(listenerCost)
+		l.Close()
+		s.logger.Info("remote forwarding already exists", "addr", msg.Addr, "port", port)
+		return false, nil
+	}
+
+	s.logger.Info("remote forwarding started", "addr", l.Addr().String())
+
+	go s.acceptForwarded(l, func(conn net.Conn) { s.forwardToClient(conn, msg.Addr, port) })
+
+	if msg.Port == 0 {
+		return true, binary.BigEndian.AppendUint32(nil, port)
+	}
+
+	return true, nil
+}
+
+// cancelRemoteForward stops the remote forwarding of the address and port in the request.
+func cancelRemoteForward(s *ServerConn, req *ssh.Request) (bool, []byte) {
+	var msg tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		s.logger.Info("invalid cancel-tcpip-forward request", "err", err.Error())
+		return false, nil
+	}
+
+	l := s.removeForward(forwardKey(msg.Addr, msg.Port))
+	if l == nil {
+		s.logger.Info("no remote forwarding to cancel", "addr", msg.Addr, "port", msg.Port)
+		return false, nil
+	}
+
+	if err := l.Close(); err != nil {
+		s.logger.Info("failed to close forwarding listener", "err", err.Error())
+	}
+	s.logger.Info("remote forwarding canceled", "addr", l.Addr().String())
+
+	return true, nil
+}
+
+// forwardKey identifies a remote forwarding by the bind address requested by the client and the bound port,
+// which are sent again to cancel it.
+func forwardKey(addr string, port uint32) string {
+	return net.JoinHostPort(addr, strconv.FormatUint(uint64(port), 10))
+}
+
+// addForward registers the listener of a remote forwarding, false if the forwarding already exists.
+func (s *ServerConn) addForward(key string, l net.Listener) bool {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+
+	if _, ok := s.forwards[key]; ok {
+		return false
+	}
+	if s.forwards == nil {
+		s.forwards = make(map[string]net.Listener)
+	}
+	s.forwards[key] = l
+
+	return true
+}
+
+// removeForward unregisters the remote forwarding and returns its listener, nil if there is none.
+func (s *ServerConn) removeForward(key string) net.Listener {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+
+	l := s.forwards[key]
+	delete(s.forwards, key)
+
+	return l
+}
+
+// closeForwards stops all the remote forwardings of the connection.
+func (s *ServerConn) closeForwards() error {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+
+	errs := make([]error, 0, len(s.forwards))
+	for key, l := range s.forwards {
+		if err := l.Close(); err != nil && !isClosedErr(err) {
+			errs = append(errs, err)
+		}
+		delete(s.forwards, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+// forwardListenAddr returns the address to listen on for the bind address of a forwarding request.
+// An empty address or * listens on all the addresses, and localhost on the loopback.
+func forwardListenAddr(addr string, port uint32) string {
+	switch addr {
+	case "", "*":
+		addr = ""
+	case "localhost":
+		addr = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(addr, strconv.FormatUint(uint64(port), 10))
+}
+
+// acceptForwarded forwards each connection accepted by l to the client with forward.
+// The connections wait in the backlog of l while the forwardings are at the limits,
+// and are closed if the connection is out of resources.
+func (s *ServerConn) acceptForwarded(l net.Listener, forward func(conn net.Conn)) {
+	defer s.resources.release(listenerCost)
+
+	for {
+		if !s.waitForward() {
+			return
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			s.releaseForward()
+			if !isClosedErr(err) {
+				s.logger.Info("failed to accept forwarded connection", "err", err.Error())
+			}
+			return
+		}
+
+		if !s.resources.reserve(forwardCost) {
+			s.logger.Info("forwarded connection is dropped", "err", errResourcesExhausted.Error())
+			conn.Close()
+			s.releaseForward()
+			continue
+		}
+
+		go func() {
+			defer s.releaseForward()
+			defer s.resources.release(forwardCost)
+			forward(conn)
+		}()
+	}
+}
+
+// forwardToClient forwards conn accepted for the remote forwarding of addr and port in a forwarded-tcpip channel.
+func (s *ServerConn) forwardToClient(conn net.Conn, addr string, port uint32) {
+	origin := conn.RemoteAddr().(*net.TCPAddr)
+	s.openForwarded(conn, "forwarded-tcpip", wire.MarshalTCPIPChannel(addr, port, origin.IP.String(), uint32(origin.Port)))
+}
+
+// openForwarded opens a channel of channelType to the client and forwards conn to it.
+func (s *ServerConn) openForwarded(conn net.Conn, channelType string, extraData []byte) {
+	defer conn.Close()
+
+	channel, requests, err := s.sshcon.OpenChannel(channelType, extraData)
+	if err != nil {
+		s.logger.Info("client rejected forwarded connection", "err", err.Error())
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	if err := s.forward(channel, conn, channelType, conn.LocalAddr().String(), conn.RemoteAddr().String()); err != nil {
+		s.logger.Debug("error in forwarding connection", "err", err.Error())
+	}
+}
+
+// directTCPIPChannel is the channel type forwarding connections from the client (ssh -L).
+const directTCPIPChannel = "direct-tcpip"
+
+// forwardDialTimeout is the time limit to connect to the destination of a local forwarding.
+const forwardDialTimeout = 10 * time.Second
+
+// directTCPIP connects the channel to the destination requested by the client.
+func (s *ServerConn) directTCPIP(newchannel ssh.NewChannel) {
+	if s.features.DisableLocalForwarding {
+		newchannel.Reject(ssh.Prohibited, "forwarding is not allowed")
+		return
+	}
+
+	host, port, originAddr, originPort, err := wire.ParseTCPIPChannel(newchannel.ExtraData())
+	if err != nil {
+		s.logger.Info("invalid direct-tcpip request", "err", err.Error())
+		newchannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	if !s.permitOpen(host, port) {
+		s.logger.Info("local forwarding is not permitted", "host", host, "port", port)
+		newchannel.Reject(ssh.Prohibited, "forwarding is not allowed")
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	conn, err := net.DialTimeout("tcp", target, forwardDialTimeout)
+	if err != nil {
+		s.logger.Info("failed to connect to forwarding destination", "host", host, "port", port, "err", err.Error())
+		newchannel.Reject(ssh.ConnectionFailed, "failed to connect to destination")
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := s.acceptChannel(newchannel)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	origin := net.JoinHostPort(originAddr, strconv.FormatUint(uint64(originPort), 10))
+	if err := s.forward(channel, conn, directTCPIPChannel, target, origin); err != nil {
+		s.logger.Debug("error in forwarding connection", "err", err.Error())
+	}
+}
+
+// tunnel is a forwarded connection.
+type tunnel struct {
+	channelType string
+	target      string
+	resolved    string
+	origin      string
+	start       time.Time
+
+	// in counts the bytes from the client, out the bytes to the client.
+	in, out rateMeter
+}
+
+// the directions of the forwarded bytes.
+const (
+	forwardIn = iota
+	forwardOut
+)
+
+// forward pipes the channel and the connection until both are done,
+// with the bytes metered and throttled by the limits of the server.
+func (s *ServerConn) forward(channel ssh.Channel, conn net.Conn, channelType, target, origin string) error {
+	t := &tunnel{
+		channelType: channelType,
+		target:      target,
+		origin:      origin,
+		start:       time.Now(),
+	}
+	if channelType == directTCPIPChannel || channelType == directStreamLocalChannel {
+		t.resolved = conn.RemoteAddr().String()
+	}
+
+	logger := s.logger.With("type", channelType, "target", target, "resolved", t.resolved, "origin", origin)
+	logger.Info("forwarded connection opened")
+
+	s.tunnelsMu.Lock()
+	if s.tunnels == nil {
+		s.tunnels = make(map[*tunnel]struct{})
+	}
+	s.tunnels[t] = struct{}{}
+	s.tunnelsMu.Unlock()
+
+	defer func() {
+		s.tunnelsMu.Lock()
+		delete(s.tunnels, t)
+		s.tunnelsMu.Unlock()
+
+		stats := t.stats()
+		logger.Info("forwarded connection closed",
+			"bytes_in", stats.BytesIn, "bytes_out", stats.BytesOut, "duration", time.Since(t.start))
+		if s.srv.Hooks.OnForwardClose != nil {
+			s.srv.Hooks.OnForwardClose(s.Info(), stats)
+		}
+	}()
+
+	user := s.srv.userForwardBuckets(s.sshcon.User())
+
+	return pipe(channel, conn,
+		&throttledReader{r: channel, ctx: s.baseCtx, meter: &t.in, buckets: s.forwardBuckets(user, forwardIn)},
+		&throttledReader{r: conn, ctx: s.baseCtx, meter: &t.out, buckets: s.forwardBuckets(user, forwardOut)})
+}
+
+func (t *tunnel) stats() ForwardStats {
+	stats := ForwardStats{
+		Type:     t.channelType,
+		Target:   t.target,
+		Resolved: t.resolved,
+		Origin:   t.origin,
+		Start:    t.start,
+	}
+	stats.BytesIn, stats.RateIn = t.in.snapshot()
+	stats.BytesOut, stats.RateOut = t.out.snapshot()
+
+	return stats
+}
+
+// closeWriter is a connection that can be half closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies between the channel and the connection in both directions until both ends are done,
+// half closing each side when the other side reaches eof.
+// fromChannel and fromConn read from the channel and the connection.
+func pipe(channel ssh.Channel, conn net.Conn, fromChannel, fromConn io.Reader) error {
+	errs := make(chan error, 2)
+
+	copyHalf := func(dst io.Writer, src io.Reader, closer closeWriter) {
+		_, err := copyStream(dst, src)
+		if closer != nil {
+			closer.CloseWrite()
+		}
+		errs <- err
+	}
+
+	connCloser, _ := conn.(closeWriter)
+	go copyHalf(channel, fromConn, channel)
+	go copyHalf(conn, fromChannel, connCloser)
+
+	err := errors.Join(<-errs, <-errs)
+	if closeErr := channel.Close(); closeErr != nil && !isClosedErr(closeErr) {
+		err = errors.Join(err, fmt.Errorf("failed to close channel: %w", closeErr))
+	}
+
+	return err
+}
@@ -0,0 +1,152 @@
+package sshd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// GeoLookup finds the country of ip addresses.
+type GeoLookup interface {
+	// Country returns the ISO 3166-1 alpha-2 code of the country of ip, empty if it is unknown.
+	Country(ip netip.Addr) string
+}
+
+// GeoLookupFunc is a function implementing [GeoLookup].
+type GeoLookupFunc func(ip netip.Addr) string
+
+func (f GeoLookupFunc) Country(ip netip.Addr) string {
+	return f(ip)
+}
+
+// GeoFilter filters the connections by the country of their addresses before the handshake,
+// and adds the country to the hooks and the logs of the connections.
+type GeoFilter struct {
+	// Lookup finds the countries. It is called for every connection and hook, so it should be fast,
+	// such as [GeoRanges] or a memory mapped database.
+	Lookup GeoLookup
+	// Allow, if not empty, are the only countries allowed, by ISO 3166-1 alpha-2 code.
+	Allow []string
+	// Deny are the countries denied.
+	Deny []string
+	// DenyUnknown denies the addresses whose country is unknown.
+	// They are allowed otherwise, such as private addresses, even if Allow is set.
+	DenyUnknown bool
+}
+
+// country returns the country of addr, empty if it is unknown.
+func (f *GeoFilter) country(addr net.Addr) string {
+	if f == nil || f.Lookup == nil {
+		return ""
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return ""
+	}
+
+	return strings.ToUpper(f.Lookup.Country(ip))
+}
+
+// check returns an error if the connections from country are not allowed.
+func (f *GeoFilter) check(country string) error {
+	if f == nil {
+		return nil
+	}
+
+	if country == "" {
+		if f.DenyUnknown {
+			return errors.New("country is unknown")
+		}
+		return nil
+	}
+
+	if slices.ContainsFunc(f.Deny, func(c string) bool { return strings.EqualFold(c, country) }) {
+		return fmt.Errorf("country %s is denied", country)
+	}
+	if len(f.Allow) > 0 && !slices.ContainsFunc(f.Allow, func(c string) bool { return strings.EqualFold(c, country) }) {
+		return fmt.Errorf("country %s is not allowed", country)
+	}
+
+	return nil
+}
+
+// GeoRanges is a [GeoLookup] over ranges of addresses, sorted by their first address and not overlapping.
+type GeoRanges []GeoRange
+
+// GeoRange is a range of addresses in a country.
+type GeoRange struct {
+	// First and Last are the first and the last addresses of the range.
+	First, Last netip.Addr
+	Country     string
+}
+
+// LoadGeoRanges reads the ranges from a csv file of first address, last address and country code,
+// such as the lite country database of db-ip. Ranges of the unknown country ZZ are skipped.
+func LoadGeoRanges(path string) (GeoRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geo database: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	var ranges GeoRanges
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read geo database %s: %w", path, err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("invalid geo database %s: line has %d fields", path, len(record))
+		}
+
+		first, err := netip.ParseAddr(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid geo database %s: %w", path, err)
+		}
+		last, err := netip.ParseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid geo database %s: %w", path, err)
+		}
+
+		if record[2] == "ZZ" {
+			continue
+		}
+
+		ranges = append(ranges, GeoRange{First: first.Unmap(), Last: last.Unmap(), Country: record[2]})
+	}
+
+	slices.SortFunc(ranges, func(a, b GeoRange) int { return a.First.Compare(b.First) })
+
+	return ranges, nil
+}
+
+func (g GeoRanges) Country(ip netip.Addr) string {
+	ip = ip.Unmap()
+
+	// the last range starting at or before ip.
+	i, found := slices.BinarySearchFunc(g, ip, func(r GeoRange, ip netip.Addr) int {
+		return r.First.Compare(ip)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || g[i].Last.Compare(ip) < 0 || g[i].First.BitLen() != ip.BitLen() {
+		return ""
+	}
+
+	return g[i].Country
+}
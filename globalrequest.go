@@ -0,0 +1,50 @@
+package sshd
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// GlobalRequestHandler handles a global request of the connection conn,
+// and returns if the request succeeded and the payload of the reply.
+type GlobalRequestHandler func(conn *ServerConn, req *ssh.Request) (ok bool, payload []byte)
+
+// builtinGlobalRequests are the global requests handled by the server itself.
+var builtinGlobalRequests = map[string]GlobalRequestHandler{
+	// keepalives from clients with ServerAliveInterval only need a reply.
+	"keepalive@openssh.com": func(*ServerConn, *ssh.Request) (bool, []byte) {
+		return true, nil
+	},
+	hostKeysProveRequest:   proveHostKeys,
+	"tcpip-forward":        remoteForward,
+	"cancel-tcpip-forward": cancelRemoteForward,
+
+	"streamlocal-forward@openssh.com":        remoteStreamLocalForward,
+	"cancel-streamlocal-forward@openssh.com": cancelRemoteStreamLocalForward,
+}
+
+// handleGlobalRequests replies to the global requests of the connection until it is closed.
+// The handlers of the server take precedence over the builtin ones, unknown requests are rejected.
+func (s *ServerConn) handleGlobalRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		handler, found := s.srv.GlobalRequestHandlers[req.Type]
+		if !found {
+			handler, found = builtinGlobalRequests[req.Type]
+		}
+
+		ok := false
+		var payload []byte
+		if found {
+			ok, payload = handler(s, req)
+		} else {
+			s.logger.Debug("unsupported global request", "type", req.Type)
+		}
+
+		s.auditGlobalRequest(req, ok)
+
+		if req.WantReply {
+			if err := req.Reply(ok, payload); err != nil {
+				s.logger.Debug("failed to reply to global request", "type", req.Type, "err", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/user"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// errHoneypot rejects the requests the honeypot doesn't fake.
+var errHoneypot = errors.New("not available in honeypot mode")
+
+// Honeypot turns the server into a honeypot: every password, public key and keyboard-interactive answer is accepted
+// and captured, and the sessions get a fake shell which never runs anything on the host.
+// sftp, other subsystems, forced commands and forwarding are rejected.
+// The captures are logged with the message "honeypot capture" and the event login or command.
+type Honeypot struct {
+	// Hostname is the host name shown by the fake shell, defaults to localhost.
+	Hostname string
+	// Logger receives the captures, defaults to the logger of the server.
+	Logger *slog.Logger
+}
+
+// configure accepts and captures all the credentials tried on config.
+func (h *Honeypot) configure(config *ssh.ServerConfig, logger *slog.Logger) {
+	logger = h.logger(logger)
+
+	capture := func(conn ssh.ConnMetadata, method string, attrs ...any) (*ssh.Permissions, error) {
+		logger.Info("honeypot capture", append([]any{
+			"event", "login",
+			"remote", conn.RemoteAddr().String(),
+			"client_version", string(conn.ClientVersion()),
+			"user", conn.User(),
+			"method", method,
+		}, attrs...)...)
+
+		return &ssh.Permissions{}, nil
+	}
+
+	config.NoClientAuth = false
+	config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return capture(conn, "password", "password", string(password))
+	}
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return capture(conn, "publickey", "key_type", key.Type(), "key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		return capture(conn, "keyboard-interactive", "answers", answers)
+	}
+}
+
+func (h *Honeypot) logger(fallback *slog.Logger) *slog.Logger {
+	if h.Logger == nil {
+		return fallback
+	}
+
+	return h.Logger
+}
+
+func (h *Honeypot) hostname() string {
+	if h.Hostname == "" {
+		return "localhost"
+	}
+
+	return h.Hostname
+}
+
+// honeypotUser returns a made up account of name, since the attackers try names that don't exist on the host.
+func honeypotUser(name string) *UserInfo {
+	u := &UserInfo{User: user.User{Uid: "1000", Gid: "1000", Username: name, Name: name, HomeDir: "/home/" + name}, Groups: []string{}}
+	if name == "root" {
+		u.Uid, u.Gid, u.HomeDir = "0", "0", "/root"
+	}
+
+	return u
+}
+
+// honeypotCapture logs the command line entered in the session of c.
+func (c *Channel) honeypotCapture(line string) {
+	c.srv.Honeypot.logger(c.srv.logger()).Info("honeypot capture",
+		"event", "command",
+		"conn_id", c.conn.id,
+		"session_id", c.id,
+		"remote", c.conn.sshcon.RemoteAddr().String(),
+		"user", c.user.Username,
+		"command", line,
+	)
+}
+
+// honeypotShell serves the fake shell of a shell request.
+func (c *Channel) honeypotShell() {
+	c.startProgram("shell", "")
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("shell")()
+
+		t := term.NewTerminal(c.channel, c.honeypotPrompt())
+		if cols, rows := c.session.WindowSize(); cols > 0 && rows > 0 {
+			t.SetSize(int(cols), int(rows))
+		}
+
+		var status uint32
+		for c.baseCtx.Err() == nil {
+			line, err := t.ReadLine()
+			if err != nil {
+				if !isClosedErr(err) {
+					c.logger.Debug("honeypot shell ended", "err", err.Error())
+				}
+				break
+			}
+
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			c.honeypotCapture(line)
+
+			var exit bool
+			status, exit = c.honeypotRun(line, t, t)
+			if exit {
+				break
+			}
+		}
+
+		c.finishSession(status, 0)
+	}()
+}
+
+// honeypotExec serves the fake shell of an exec request.
+func (c *Channel) honeypotExec(command string) {
+	c.startProgram("exec", command)
+	c.honeypotCapture(command)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("exec", attribute.String("ssh.command", command))()
+
+		status, _ := c.honeypotRun(command, c.channel, c.channel.Stderr())
+		c.finishSession(status, 0)
+	}()
+}
+
+func (c *Channel) honeypotPrompt() string {
+	if c.user.Uid == "0" {
+		return fmt.Sprintf("%s@%s:~# ", c.user.Username, c.srv.Honeypot.hostname())
+	}
+
+	return fmt.Sprintf("%s@%s:~$ ", c.user.Username, c.srv.Honeypot.hostname())
+}
+
+// honeypotRun pretends to run the commands of line, and returns the exit status of the last one,
+// and if the shell should exit.
+func (c *Channel) honeypotRun(line string, stdout, stderr io.Writer) (status uint32, exit bool) {
+	for _, command := range strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r == '\n' || r == '&' || r == '|' }) {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+
+		status = 0
+		switch args[0] {
+		case "exit", "logout":
+			return status, true
+		case "cd", "export", "unset", "history", "clear":
+		case "whoami":
+			fmt.Fprintf(stdout, "%s\n", c.user.Username)
+		case "id":
+			fmt.Fprintf(stdout, "uid=%[1]s(%[2]s) gid=%[3]s(%[2]s) groups=%[3]s(%[2]s)\n", c.user.Uid, c.user.Username, c.user.Gid)
+		case "pwd":
+			fmt.Fprintf(stdout, "%s\n", c.user.HomeDir)
+		case "hostname":
+			fmt.Fprintf(stdout, "%s\n", c.srv.Honeypot.hostname())
+		case "uname":
+			if len(args) > 1 && args[1] == "-a" {
+				fmt.Fprintf(stdout, "Linux %s 5.15.0-91-generic #101-Ubuntu SMP x86_64 x86_64 x86_64 GNU/Linux\n", c.srv.Honeypot.hostname())
+			} else {
+				fmt.Fprint(stdout, "Linux\n")
+			}
+		case "echo":
+			fmt.Fprintf(stdout, "%s\n", strings.Join(args[1:], " "))
+		case "ls", "true":
+		case "cat", "wget", "curl":
+			status = 1
+			if len(args) > 1 {
+				fmt.Fprintf(stderr, "%s: %s: No such file or directory\n", args[0], args[len(args)-1])
+			}
+		default:
+			status = 127
+			fmt.Fprintf(stderr, "bash: %s: command not found\n", args[0])
+		}
+	}
+
+	return status, false
+}
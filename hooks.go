@@ -0,0 +1,139 @@
+package sshd
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnInfo describes a connection for the hooks.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// RemoteHost is the host name of RemoteAddr if UseDNS of the server is set, or its ip otherwise.
+	RemoteHost string
+	// Country is the country code of RemoteAddr if the server has a [GeoFilter], empty if it is unknown.
+	Country string
+
+	// ID, User, ClientVersion and SessionID are empty before the handshake.
+	// ID is the id of the connection, which is the conn_id of its log lines.
+	ID            string
+	User          string
+	ClientVersion string
+	SessionID     []byte
+
+	// Permissions are the permissions returned by the authentication callbacks, nil before authentication.
+	Permissions *ssh.Permissions
+	// Account is the account of User from [Server.Users], nil before authentication.
+	Account *UserInfo
+
+	// TLS is the state of the tls connection for the connections accepted by [Server.ListenTLS],
+	// with the server name and the verified client certificates. It is nil before the handshake.
+	TLS *tls.ConnectionState
+}
+
+func (s *Server) connInfo(meta ssh.ConnMetadata) ConnInfo {
+	return ConnInfo{
+		RemoteAddr:    meta.RemoteAddr(),
+		LocalAddr:     meta.LocalAddr(),
+		RemoteHost:    s.RemoteHost(meta.RemoteAddr()),
+		Country:       s.Geo.country(meta.RemoteAddr()),
+		User:          meta.User(),
+		ClientVersion: string(meta.ClientVersion()),
+		SessionID:     meta.SessionID(),
+	}
+}
+
+// Info returns the information of the connection.
+func (s *ServerConn) Info() ConnInfo {
+	info := s.srv.connInfo(s.sshcon)
+	info.ID = s.id
+	info.TLS = s.tlsState
+	info.Permissions = s.sshcon.Permissions
+	info.Account = s.user
+
+	return info
+}
+
+// SessionInfo describes a shell, exec, sftp or scp session for the hooks.
+type SessionInfo struct {
+	// ID is the id of the session channel, which is the session_id of its log lines.
+	ID string
+	// Type is shell, exec, sftp or scp.
+	Type string
+	// Command is the command line of exec and scp sessions, which is the forced command if there is one.
+	Command string
+	Start   time.Time
+
+	// End, ExitStatus, ExitSignal, BytesIn and BytesOut are only set when the session ends.
+	End time.Time
+	// ExitStatus is the exit status sent to the client,
+	// or ExitSignal the name of the signal that killed the program.
+	ExitStatus uint32
+	ExitSignal string
+	// BytesIn and BytesOut are the numbers of bytes from and to the client.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Hooks are called at the stages of the lifecycle of the connections.
+// Hooks returning an error veto the further processing.
+// All hooks are optional.
+type Hooks struct {
+	// OnConnect is called when a connection is accepted, before the handshake.
+	// Returning an error closes the connection.
+	OnConnect func(info ConnInfo) error
+
+	// OnAuth is called once the client is authenticated, with the method completing the authentication
+	// and the final permissions in info. Returning an error closes the connection.
+	OnAuth func(info ConnInfo, method string) error
+
+	// OnChannelOpen is called when the client requests a new channel.
+	// Returning an error rejects the channel, with the error message sent to the client.
+	OnChannelOpen func(info ConnInfo, channelType string, extraData []byte) error
+
+	// OnChannelError is called when a channel requested by the client fails to be accepted.
+	OnChannelError func(info ConnInfo, channelType string, err error)
+
+	// OnSessionStart is called when the program of a session starts,
+	// and OnSessionEnd when it ends, for example for billing or auditing.
+	OnSessionStart func(info ConnInfo, session SessionInfo)
+	OnSessionEnd   func(info ConnInfo, session SessionInfo)
+
+	// OnForwardClose is called when a forwarded connection is closed, with its final stats,
+	// for example to audit the tunnels.
+	OnForwardClose func(info ConnInfo, forward ForwardStats)
+
+	// OnSFTP is called for the file operations of the sftp sessions served in process,
+	// such as opens, reads, writes, renames and removes, for example to audit file transfers.
+	OnSFTP func(info ConnInfo, event SFTPEvent)
+
+	// OnDisconnect is called after the connection is closed and all its sessions finished.
+	OnDisconnect func(info ConnInfo)
+}
+
+// recordAuth records the method completing the authentication with config, and returns it for OnAuth.
+// The authentication callbacks can't tell it, the public key callback is also called for the keys
+// the client only queries without proving it holds them, but the authentication log only reports verified attempts.
+func (h *Hooks) recordAuth(config *ssh.ServerConfig) (method func() string) {
+	var last string
+	method = func() string { return last }
+
+	if h.OnAuth == nil {
+		return method
+	}
+
+	authLog := config.AuthLogCallback
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, m string, err error) {
+		if err == nil {
+			last = m
+		}
+		if authLog != nil {
+			authLog(conn, m, err)
+		}
+	}
+
+	return method
+}
@@ -0,0 +1,201 @@
+package sshd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyType is the algorithm of a host key.
+type HostKeyType string
+
+const (
+	HostKeyEd25519 HostKeyType = "ed25519"
+	HostKeyECDSA   HostKeyType = "ecdsa"
+	HostKeyRSA     HostKeyType = "rsa"
+)
+
+// DefaultHostKeyTypes are the host key types generated when none is specified.
+var DefaultHostKeyTypes = []HostKeyType{HostKeyEd25519, HostKeyECDSA, HostKeyRSA}
+
+// HostKeyPath returns the path of the host key of keytype in dir,
+// which follows the openssh naming of ssh_host_<type>_key.
+func HostKeyPath(dir string, keytype HostKeyType) string {
+	return filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", keytype))
+}
+
+// LoadOrGenerateHostKey loads the host key of keytype from dir.
+// If the key doesn't exist, a new one is generated and saved into dir,
+// with the private key only readable by the owner and the public key in a .pub file next to it.
+func LoadOrGenerateHostKey(dir string, keytype HostKeyType) (ssh.Signer, error) {
+	keypath := HostKeyPath(dir, keytype)
+
+	keybytes, err := os.ReadFile(keypath)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(keybytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key %s: %w", keypath, err)
+		}
+
+		return signer, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read host key %s: %w", keypath, err)
+	}
+
+	key, err := generateHostKey(keytype)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer for %s host key: %w", keytype, err)
+	}
+
+	pemblock, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s host key: %w", keytype, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory %s: %w", dir, err)
+	}
+
+	if err := writeFileExclusive(keypath, pem.EncodeToMemory(pemblock), 0o600); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(keypath+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write host public key %s.pub: %w", keypath, err)
+	}
+
+	log.Info("generated new host key", "path", keypath, "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+
+	return signer, nil
+}
+
+// LoadOrGenerateHostKeys loads or generates host keys of keytypes in dir and adds them to config.
+// [DefaultHostKeyTypes] are used if keytypes is empty.
+func LoadOrGenerateHostKeys(config *ssh.ServerConfig, dir string, keytypes ...HostKeyType) error {
+	if len(keytypes) == 0 {
+		keytypes = DefaultHostKeyTypes
+	}
+
+	for _, keytype := range keytypes {
+		signer, err := LoadOrGenerateHostKey(dir, keytype)
+		if err != nil {
+			return err
+		}
+
+		config.AddHostKey(signer)
+	}
+
+	return nil
+}
+
+// LoadHostKeys loads all the host keys named ssh_host_*_key in dir.
+// An error is returned if no host key is found.
+func LoadHostKeys(dir string) ([]ssh.Signer, error) {
+	keypaths, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host keys in %s: %w", dir, err)
+	}
+
+	signers := make([]ssh.Signer, 0, len(keypaths))
+	for _, keypath := range keypaths {
+		keybytes, err := os.ReadFile(keypath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host key %s: %w", keypath, err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(keybytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key %s: %w", keypath, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no host key found in %s", dir)
+	}
+
+	return signers, nil
+}
+
+// AddHostKeysFromDir loads all the host keys in dir and adds them to config,
+// so clients can negotiate whichever algorithm they support.
+func AddHostKeysFromDir(config *ssh.ServerConfig, dir string) error {
+	signers, err := LoadHostKeys(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+	}
+
+	return nil
+}
+
+func generateHostKey(keytype HostKeyType) (crypto.PrivateKey, error) {
+	switch keytype {
+	case HostKeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ed25519 key: %w", err)
+		}
+		return key, nil
+
+	case HostKeyECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ecdsa key: %w", err)
+		}
+		return key, nil
+
+	case HostKeyRSA:
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate rsa key: %w", err)
+		}
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported host key type: %s", keytype)
+	}
+}
+
+// writeFileExclusive writes data to a new file at path, failing if the file already exists.
+func writeFileExclusive(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SetHostKeys replaces the host keys presented to new connections.
+// Once set, the host keys in [Server.Config] are no longer used.
+// Existing connections are not affected.
+func (s *Server) SetHostKeys(signers ...ssh.Signer) error {
+	if len(signers) == 0 {
+		return errors.New("no host key is provided")
+	}
+
+	signers = slices.Clone(signers)
+	s.hostKeys.Store(&signers)
+
+	return nil
+}
+
+// HostKeys returns the host keys set by [Server.SetHostKeys].
+func (s *Server) HostKeys() []ssh.Signer {
+	hostKeys := s.hostKeys.Load()
+	if hostKeys == nil {
+		return nil
+	}
+
+	return slices.Clone(*hostKeys)
+}
+
+// ReloadHostKeys loads all the host keys in dir with [LoadHostKeys] and sets them on the server.
+func (s *Server) ReloadHostKeys(dir string) error {
+	signers, err := LoadHostKeys(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := s.SetHostKeys(signers...); err != nil {
+		return err
+	}
+
+	s.logger().Info("reloaded host keys", "dir", dir, "count", len(signers))
+
+	return nil
+}
+
+// WatchHostKeys checks the host keys in dir every interval,
+// and reloads them when any of them is added, removed or modified.
+// It blocks until ctx is done.
+func (s *Server) WatchHostKeys(ctx context.Context, dir string, interval time.Duration) error {
+	last, err := hostKeysState(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := s.ReloadHostKeys(dir); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		current, err := hostKeysState(dir)
+		if err != nil {
+			s.logger().Error("failed to check host keys", "err", err.Error(), "dir", dir)
+			continue
+		}
+
+		if current == last {
+			continue
+		}
+
+		if err := s.ReloadHostKeys(dir); err != nil {
+			s.logger().Error("failed to reload host keys", "err", err.Error(), "dir", dir)
+			continue
+		}
+
+		last = current
+	}
+}
+
+// hostKeysState summarizes the names, sizes and modification times of the host keys in dir.
+func hostKeysState(dir string) (string, error) {
+	keypaths, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list host keys in %s: %w", dir, err)
+	}
+
+	state := ""
+	for _, keypath := range keypaths {
+		info, err := os.Stat(keypath)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat host key %s: %w", keypath, err)
+		}
+
+		state += fmt.Sprintf("%s:%d:%d\n", keypath, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return state, nil
+}
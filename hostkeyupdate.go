@@ -0,0 +1,114 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/fardream/sshd/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// the global requests of the openssh host key rotation, see PROTOCOL of openssh.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// addHostKey adds signer to Config, and records it to be announced to the clients.
+func (s *Server) addHostKey(signer ssh.Signer) {
+	s.Config.AddHostKey(signer)
+	s.configHostKeys = append(s.configHostKeys, signer)
+}
+
+// announcedHostKeys returns the host keys announced to new connections,
+// which are the ones set by SetHostKeys, or the ones added by the options.
+func (s *Server) announcedHostKeys() []ssh.Signer {
+	if hostKeys := s.hostKeys.Load(); hostKeys != nil {
+		return *hostKeys
+	}
+
+	return s.configHostKeys
+}
+
+// announceHostKeys sends all the host keys of the connection to the client,
+// so clients with UpdateHostKeys learn the keys added before the old ones are retired.
+func (s *ServerConn) announceHostKeys() {
+	if len(s.hostKeys) == 0 {
+		return
+	}
+
+	var payload []byte
+	for _, signer := range s.hostKeys {
+		payload = wire.MarshalString(payload, string(signer.PublicKey().Marshal()))
+	}
+
+	if _, _, err := s.sshcon.SendRequest(hostKeysRequest, false, payload); err != nil {
+		s.logger.Debug("failed to announce host keys", "err", err.Error())
+	}
+}
+
+// proveHostKeys signs the session with each of the host keys requested by the client,
+// proving the server holds their private keys.
+func proveHostKeys(s *ServerConn, req *ssh.Request) (bool, []byte) {
+	var reply []byte
+
+	for rest := req.Payload; len(rest) > 0; {
+		blob, consumed, err := wire.ParseString(rest)
+		if err != nil {
+			s.logger.Info("invalid host key prove request", "err", err.Error())
+			return false, nil
+		}
+		rest = rest[consumed:]
+
+		signature, err := s.signHostKeyProof([]byte(blob))
+		if err != nil {
+			s.logger.Info("failed to prove host key", "err", err.Error())
+			return false, nil
+		}
+
+		reply = append(reply, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(signature)})...)
+	}
+
+	return true, reply
+}
+
+func (s *ServerConn) signHostKeyProof(blob []byte) (*ssh.Signature, error) {
+	var signer ssh.Signer
+	for _, candidate := range s.hostKeys {
+		if bytes.Equal(candidate.PublicKey().Marshal(), blob) {
+			signer = candidate
+			break
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("host key is not announced")
+	}
+
+	data := ssh.Marshal(struct {
+		Request   string
+		SessionID []byte
+		Key       []byte
+	}{hostKeysProveRequest, s.sshcon.SessionID(), blob})
+
+	// like openssh, rsa keys are proven with sha-512.
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, errors.New("rsa host key cannot sign with rsa-sha2-512")
+		}
+		signature, err := algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign with rsa host key: %w", err)
+		}
+		return signature, nil
+	}
+
+	signature, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with %s host key: %w", signer.PublicKey().Type(), err)
+	}
+
+	return signature, nil
+}
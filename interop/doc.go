@@ -0,0 +1,5 @@
+// Package interop tests the server against the openssh client binaries through scripted scenarios.
+// The tests need ssh and sftp on the PATH, and are only built with the interop tag:
+//
+//	go test -tags interop ./interop
+package interop
@@ -0,0 +1,160 @@
+//go:build interop
+
+package interop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/fardream/sshd"
+	"github.com/fardream/sshd/sshdtest"
+)
+
+// harness is a server and the arguments of the openssh clients to reach it.
+type harness struct {
+	port string
+}
+
+// newHarness starts a server for the test, whose logs are only shown with -v.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	for _, bin := range []string{"ssh", "sftp"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s is not installed: %v", bin, err)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if testing.Verbose() {
+		logger = slog.Default()
+	}
+
+	s := sshdtest.NewServer(t, sshd.WithLogger(logger))
+
+	_, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		t.Fatalf("invalid server address %s: %v", s.Addr, err)
+	}
+
+	return &harness{port: port}
+}
+
+// sshArgs returns the arguments of ssh or sftp to connect without checking the host key.
+func (h *harness) sshArgs(portFlag string, extra ...string) []string {
+	args := []string{
+		portFlag, h.port,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+	}
+
+	return append(append(args, extra...), "interop@127.0.0.1")
+}
+
+// ssh runs command with the ssh client, opts are the extra options of the client.
+func (h *harness) ssh(command string, opts ...string) *exec.Cmd {
+	return exec.Command("ssh", append(h.sshArgs("-p", opts...), command)...)
+}
+
+func TestExecExitCodes(t *testing.T) {
+	h := newHarness(t)
+
+	for _, code := range []int{0, 1, 7, 127} {
+		t.Run(strconv.Itoa(code), func(t *testing.T) {
+			err := h.ssh("exit " + strconv.Itoa(code)).Run()
+
+			got := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				got = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("failed to run ssh: %v", err)
+			}
+			if got != code {
+				t.Errorf("exit code is %d, want %d", got, code)
+			}
+		})
+	}
+}
+
+func TestEnvPassing(t *testing.T) {
+	h := newHarness(t)
+
+	cmd := h.ssh("echo $LC_INTEROP", "-o", "SendEnv=LC_INTEROP")
+	cmd.Env = append(os.Environ(), "LC_INTEROP=passed")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to run ssh: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "passed" {
+		t.Errorf("LC_INTEROP is %q, want passed", got)
+	}
+}
+
+func TestPTYSizeAndResize(t *testing.T) {
+	h := newHarness(t)
+
+	cmd := h.ssh("stty size; sleep 1; stty size", "-tt")
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 30, Cols: 100})
+	if err != nil {
+		t.Fatalf("failed to start ssh: %v", err)
+	}
+	defer f.Close()
+
+	time.AfterFunc(500*time.Millisecond, func() {
+		pty.Setsize(f, &pty.Winsize{Rows: 40, Cols: 120})
+	})
+
+	var out bytes.Buffer
+	out.ReadFrom(f)
+	cmd.Wait()
+
+	lines := strings.Fields(strings.ReplaceAll(out.String(), "\r", ""))
+	if got := strings.Join(lines, " "); got != "30 100 40 120" {
+		t.Errorf("sizes are %q, want 30 100 then 40 120", out.String())
+	}
+}
+
+func TestSFTPPutAndGet(t *testing.T) {
+	h := newHarness(t)
+	dir := t.TempDir()
+
+	local := filepath.Join(dir, "local")
+	back := filepath.Join(dir, "back")
+	data := bytes.Repeat([]byte("interop"), 100000)
+	if err := os.WriteFile(local, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := filepath.Join(dir, "batch")
+	script := fmt.Sprintf("put %s uploaded\nget uploaded %s\nrm uploaded\n", local, back)
+	if err := os.WriteFile(batch, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := exec.Command("sftp", h.sshArgs("-P", "-b", batch)...).CombinedOutput(); err != nil {
+		t.Fatalf("sftp failed: %v: %s", err, out)
+	}
+
+	got, err := os.ReadFile(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded file differs")
+	}
+}
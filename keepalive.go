@@ -0,0 +1,48 @@
+package sshd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clientAlive probes the client with keepalive@openssh.com requests every interval,
+// and closes the connection after countMax consecutive probes are unanswered.
+func (s *ServerConn) clientAlive(interval time.Duration, countMax int) {
+	if countMax <= 0 {
+		countMax = 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var unanswered atomic.Int64
+	var inflight atomic.Bool
+
+	for {
+		select {
+		case <-s.baseCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if inflight.Load() {
+			if unanswered.Add(1) >= int64(countMax) {
+				s.logger.Info("client is not responding to keepalive, closing connection")
+				s.sshcon.Close()
+				return
+			}
+			continue
+		}
+
+		inflight.Store(true)
+		go func() {
+			// any reply, including failure, means the client is alive.
+			_, _, err := s.sshcon.SendRequest("keepalive@openssh.com", true, nil)
+			if err != nil {
+				return
+			}
+			unanswered.Store(0)
+			inflight.Store(false)
+		}()
+	}
+}
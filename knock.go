@@ -0,0 +1,297 @@
+package sshd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultKnockWindow is how long an address is admitted after knocking.
+	DefaultKnockWindow = 30 * time.Second
+	// DefaultKnockTimeout is the time to complete the knock sequence.
+	DefaultKnockTimeout = 10 * time.Second
+
+	// spaMaxSkew is the largest difference between the time of a spa packet and the time of the server.
+	spaMaxSkew = 30 * time.Second
+	// spaNonceLength, and the timestamp and the hmac make up a spa packet.
+	spaNonceLength  = 16
+	spaPacketLength = 8 + spaNonceLength + sha256.Size
+)
+
+// KnockGate keeps the server silent to the addresses which haven't knocked:
+// their connections are closed before the server sends anything.
+// An address is admitted for Window after it sends udp packets to Ports in order,
+// or a single packet authorization packet made by [NewSPAPacket] to SPAAddr.
+// The gate only admits addresses while [KnockGate.Serve] runs.
+type KnockGate struct {
+	// Ports is the sequence of udp ports to knock, empty disables knocking.
+	Ports []int
+	// KnockTimeout is the time to complete the sequence, defaults to [DefaultKnockTimeout].
+	KnockTimeout time.Duration
+
+	// SPAAddr, if set, is the udp address receiving the single packet authorization packets.
+	SPAAddr string
+	// SPAKey is the key authenticating the single packet authorization packets.
+	SPAKey []byte
+
+	// Window is how long an address is admitted, defaults to [DefaultKnockWindow].
+	// Established connections are not affected when it expires.
+	Window time.Duration
+
+	mu sync.Mutex
+	// admitted are the admitted addresses and when they expire.
+	admitted map[netip.Addr]time.Time
+	// knocks are the progress of the addresses knocking.
+	knocks map[netip.Addr]knockProgress
+	// nonces are the nonces of the spa packets seen, kept until the packets expire to reject replays.
+	nonces map[[spaNonceLength]byte]time.Time
+}
+
+// knockProgress is the number of ports knocked in order, and the time to knock the rest.
+type knockProgress struct {
+	next     int
+	deadline time.Time
+}
+
+// NewSPAPacket returns a single packet authorization packet signed with key, to send to the spa address of a [KnockGate].
+func NewSPAPacket(key []byte) ([]byte, error) {
+	packet := binary.BigEndian.AppendUint64(make([]byte, 0, spaPacketLength), uint64(time.Now().Unix()))
+	packet = packet[:8+spaNonceLength]
+	if _, err := rand.Read(packet[8:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return appendSPAMAC(packet, key), nil
+}
+
+func appendSPAMAC(packet, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet)
+
+	return mac.Sum(packet)
+}
+
+// Serve listens for the knocks and the spa packets until ctx is done.
+func (g *KnockGate) Serve(ctx context.Context) error {
+	if len(g.Ports) == 0 && g.SPAAddr == "" {
+		return errors.New("no knock ports or spa address")
+	}
+	if g.SPAAddr != "" && len(g.SPAKey) == 0 {
+		return errors.New("spa key is not set")
+	}
+
+	var conns []net.PacketConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	listen := func(addr string) (net.PacketConn, error) {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	errs := make(chan error, len(g.Ports)+1)
+
+	for i, port := range g.Ports {
+		conn, err := listen(":" + strconv.Itoa(port))
+		if err != nil {
+			return err
+		}
+		go func() { errs <- g.readPackets(conn, func(from netip.Addr, _ []byte) { g.knock(from, i) }) }()
+	}
+
+	if g.SPAAddr != "" {
+		conn, err := listen(g.SPAAddr)
+		if err != nil {
+			return err
+		}
+		go func() { errs <- g.readPackets(conn, g.authorize) }()
+	}
+
+	ticker := time.NewTicker(g.window())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+			g.prune()
+		}
+	}
+}
+
+// readPackets calls handle with the packets read from conn until it is closed.
+func (g *KnockGate) readPackets(conn net.PacketConn, handle func(from netip.Addr, packet []byte)) error {
+	buf := make([]byte, spaPacketLength+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isClosedErr(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to read knock: %w", err)
+		}
+
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			handle(udp.AddrPort().Addr().Unmap(), buf[:n])
+		}
+	}
+}
+
+// knock records the knock of from on the port at index i of the sequence.
+func (g *KnockGate) knock(from netip.Addr, i int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	progress := g.knocks[from]
+	if now.After(progress.deadline) {
+		progress = knockProgress{}
+	}
+
+	switch {
+	case i == progress.next:
+		if progress.next == 0 {
+			progress.deadline = now.Add(g.knockTimeout())
+		}
+		progress.next++
+	case i == 0:
+		// a knock out of order starts the sequence again.
+		progress = knockProgress{next: 1, deadline: now.Add(g.knockTimeout())}
+	default:
+		progress = knockProgress{}
+	}
+
+	if progress.next == len(g.Ports) {
+		delete(g.knocks, from)
+		g.admitLocked(from, now)
+		return
+	}
+
+	if g.knocks == nil {
+		g.knocks = make(map[netip.Addr]knockProgress)
+	}
+	g.knocks[from] = progress
+}
+
+// authorize admits from if packet is a valid spa packet not seen before.
+func (g *KnockGate) authorize(from netip.Addr, packet []byte) {
+	if len(packet) != spaPacketLength {
+		return
+	}
+
+	if !hmac.Equal(appendSPAMAC(packet[:8+spaNonceLength:8+spaNonceLength], g.SPAKey), packet) {
+		return
+	}
+
+	now := time.Now()
+	sent := time.Unix(int64(binary.BigEndian.Uint64(packet)), 0)
+	if sent.Before(now.Add(-spaMaxSkew)) || sent.After(now.Add(spaMaxSkew)) {
+		return
+	}
+
+	nonce := [spaNonceLength]byte(packet[8 : 8+spaNonceLength])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, seen := g.nonces[nonce]; seen {
+		return
+	}
+	if g.nonces == nil {
+		g.nonces = make(map[[spaNonceLength]byte]time.Time)
+	}
+	g.nonces[nonce] = sent.Add(spaMaxSkew)
+
+	g.admitLocked(from, now)
+}
+
+func (g *KnockGate) admitLocked(addr netip.Addr, now time.Time) {
+	if g.admitted == nil {
+		g.admitted = make(map[netip.Addr]time.Time)
+	}
+	g.admitted[addr] = now.Add(g.window())
+}
+
+// Admitted reports if the address is admitted.
+func (g *KnockGate) Admitted(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return time.Now().Before(g.admitted[ip])
+}
+
+// prune forgets the expired admissions, knocks and nonces.
+func (g *KnockGate) prune() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for addr, expiry := range g.admitted {
+		if now.After(expiry) {
+			delete(g.admitted, addr)
+		}
+	}
+	for addr, progress := range g.knocks {
+		if now.After(progress.deadline) {
+			delete(g.knocks, addr)
+		}
+	}
+	for nonce, expiry := range g.nonces {
+		if now.After(expiry) {
+			delete(g.nonces, nonce)
+		}
+	}
+}
+
+func (g *KnockGate) window() time.Duration {
+	if g.Window <= 0 {
+		return DefaultKnockWindow
+	}
+
+	return g.Window
+}
+
+func (g *KnockGate) knockTimeout() time.Duration {
+	if g.KnockTimeout <= 0 {
+		return DefaultKnockTimeout
+	}
+
+	return g.KnockTimeout
+}
+
+// addrIP returns the ip of a tcp or udp address.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
@@ -0,0 +1,138 @@
+package sshd
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxStartups limits the concurrent unauthenticated connections, same as the MaxStartups of openssh.
+// Once there are Start unauthenticated connections, new connections are dropped with a probability of Rate percent,
+// which increases linearly to 100 percent when there are Full unauthenticated connections.
+//
+// The zero value doesn't limit anything.
+type MaxStartups struct {
+	Start int
+	Rate  int
+	Full  int
+}
+
+// ParseMaxStartups parses the start:rate:full notation, or a single number which is both start and full.
+func ParseMaxStartups(s string) (MaxStartups, error) {
+	parts := strings.Split(s, ":")
+
+	values := make([]int, 0, len(parts))
+	for _, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return MaxStartups{}, fmt.Errorf("invalid MaxStartups: %s", s)
+		}
+		values = append(values, v)
+	}
+
+	switch len(values) {
+	case 1:
+		return MaxStartups{Start: values[0], Rate: 100, Full: values[0]}, nil
+	case 3:
+		m := MaxStartups{Start: values[0], Rate: values[1], Full: values[2]}
+		if m.Rate > 100 || m.Full < m.Start {
+			return MaxStartups{}, fmt.Errorf("invalid MaxStartups: %s", s)
+		}
+		return m, nil
+	default:
+		return MaxStartups{}, fmt.Errorf("invalid MaxStartups: %s", s)
+	}
+}
+
+// shouldDrop decides if a new connection should be dropped when there are n unauthenticated connections.
+func (m MaxStartups) shouldDrop(n int) bool {
+	if m.Full <= 0 || n < m.Start {
+		return false
+	}
+
+	if n >= m.Full {
+		return true
+	}
+
+	p := m.Rate + (100-m.Rate)*(n-m.Start)/(m.Full-m.Start)
+
+	return rand.IntN(100) < p
+}
+
+// forwardWaitInterval is how often the accept loops of remote forwardings check for a free forwarding.
+const forwardWaitInterval = 100 * time.Millisecond
+
+// tryAcquire increments n unless it would exceed limit, no limit if not positive.
+func tryAcquire(n *atomic.Int64, limit int) bool {
+	if n.Add(1) > int64(limit) && limit > 0 {
+		n.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+// acquireSession counts a session channel against MaxTotalSessions.
+func (s *Server) acquireSession() bool {
+	return tryAcquire(&s.sessionCount, s.MaxTotalSessions)
+}
+
+func (s *Server) releaseSession() {
+	s.sessionCount.Add(-1)
+}
+
+// acquireForward counts a forwarded connection against MaxForwards and MaxTotalForwards,
+// failing if either is reached.
+func (s *ServerConn) acquireForward() bool {
+	if !tryAcquire(&s.forwardCount, s.srv.MaxForwards) {
+		return false
+	}
+	if !tryAcquire(&s.srv.forwardCount, s.srv.MaxTotalForwards) {
+		s.forwardCount.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+func (s *ServerConn) releaseForward() {
+	s.forwardCount.Add(-1)
+	s.srv.forwardCount.Add(-1)
+}
+
+// waitForward waits until a forwarded connection is acquired, failing once the connection is closed.
+func (s *ServerConn) waitForward() bool {
+	for !s.acquireForward() {
+		select {
+		case <-time.After(forwardWaitInterval):
+		case <-s.baseCtx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// goForward runs the forwarding of the channel opened by the client, unless the forwardings are at the limits.
+func (s *ServerConn) goForward(newchannel ssh.NewChannel, forward func(ssh.NewChannel)) {
+	if !s.acquireForward() {
+		newchannel.Reject(ssh.ResourceShortage, "too many forwarded connections")
+		return
+	}
+	if !s.resources.reserve(forwardCost) {
+		s.releaseForward()
+		newchannel.Reject(ssh.ResourceShortage, errResourcesExhausted.Error())
+		return
+	}
+
+	go func() {
+		defer s.releaseForward()
+		defer s.resources.release(forwardCost)
+		forward(newchannel)
+	}()
+}
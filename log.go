@@ -4,6 +4,7 @@ import "log/slog"
 
 var log = slog.Default()
 
+// SetLogger sets the package level logger, which is used when [Server.Logger] is not set.
 func SetLogger(l *slog.Logger) {
 	log = l
 }
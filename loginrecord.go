@@ -0,0 +1,45 @@
+package sshd
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// loginRecord is an interactive session recorded in utmp, wtmp and lastlog.
+type loginRecord struct {
+	user string
+	// line is the terminal without /dev/, such as pts/3.
+	line string
+	host string
+	ip   net.IP
+	pid  int
+	time time.Time
+}
+
+// recordLogin records the login of the interactive session with the process pid,
+// and returns the function recording the logout.
+func (c *Channel) recordLogin(pid int) (logout func()) {
+	_, tty := c.session.terminal()
+	r := &loginRecord{
+		user: c.user.Username,
+		line: strings.TrimPrefix(tty.Name(), "/dev/"),
+		host: c.srv.RemoteHost(c.conn.sshcon.RemoteAddr()),
+		pid:  pid,
+		time: time.Now(),
+	}
+	if addr, ok := c.conn.sshcon.RemoteAddr().(*net.TCPAddr); ok {
+		r.ip = addr.IP
+	}
+
+	if err := writeLogin(r, c.user.Uid); err != nil {
+		c.logger.Info("failed to record login", "err", err.Error())
+	}
+
+	return func() {
+		r.time = time.Now()
+		if err := writeLogout(r); err != nil {
+			c.logger.Info("failed to record logout", "err", err.Error())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package sshd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// the login records are only written to the files that exist, like openssh.
+const (
+	utmpPath    = "/var/run/utmp"
+	wtmpPath    = "/var/log/wtmp"
+	lastlogPath = "/var/log/lastlog"
+)
+
+// the types of utmp entries.
+const (
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+// utmpEntry is struct utmp of glibc.
+type utmpEntry struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	Addr    [16]byte
+	_       [20]byte
+}
+
+// lastlogEntry is struct lastlog of glibc.
+type lastlogEntry struct {
+	Time int32
+	Line [32]byte
+	Host [256]byte
+}
+
+func newUtmpEntry(r *loginRecord, entrytype int16) *utmpEntry {
+	e := &utmpEntry{
+		Type: entrytype,
+		Pid:  int32(r.pid),
+		Sec:  int32(r.time.Unix()),
+		Usec: int32(r.time.Nanosecond() / 1000),
+	}
+	copy(e.Line[:], r.line)
+	// like openssh, the id is the end of the line.
+	copy(e.ID[:], r.line[max(0, len(r.line)-len(e.ID)):])
+	if entrytype == utmpUserProcess {
+		copy(e.User[:], r.user)
+		copy(e.Host[:], r.host)
+		if ip4 := r.ip.To4(); ip4 != nil {
+			copy(e.Addr[:], ip4)
+		} else {
+			copy(e.Addr[:], r.ip.To16())
+		}
+	}
+
+	return e
+}
+
+func writeLogin(r *loginRecord, uid string) error {
+	e := newUtmpEntry(r, utmpUserProcess)
+
+	errs := []error{writeUtmp(e), appendWtmp(e)}
+
+	if id, err := strconv.ParseUint(uid, 10, 32); err == nil {
+		errs = append(errs, writeLastlog(r, id))
+	}
+
+	return errors.Join(errs...)
+}
+
+func writeLogout(r *loginRecord) error {
+	e := newUtmpEntry(r, utmpDeadProcess)
+
+	return errors.Join(writeUtmp(e), appendWtmp(e))
+}
+
+// writeUtmp replaces the entry of the same terminal in utmp, or appends e if there is none.
+func writeUtmp(e *utmpEntry) error {
+	f, err := os.OpenFile(utmpPath, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", utmpPath, err)
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", utmpPath, err)
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	size := int64(binary.Size(e))
+	offset := int64(0)
+	var existing utmpEntry
+	for ; ; offset += size {
+		if err := binary.Read(f, binary.NativeEndian, &existing); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return fmt.Errorf("failed to read %s: %w", utmpPath, err)
+		}
+		if existing.ID == e.ID || existing.Line == e.Line {
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, e); err != nil {
+		return fmt.Errorf("failed to encode utmp entry: %w", err)
+	}
+	if _, err := f.WriteAt(buf.Bytes(), offset); err != nil {
+		return fmt.Errorf("failed to write %s: %w", utmpPath, err)
+	}
+
+	return nil
+}
+
+func appendWtmp(e *utmpEntry) error {
+	f, err := os.OpenFile(wtmpPath, os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", wtmpPath, err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, e); err != nil {
+		return fmt.Errorf("failed to encode utmp entry: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", wtmpPath, err)
+	}
+
+	return nil
+}
+
+// writeLastlog sets the last login of the user uid, lastlog is indexed by uid.
+func writeLastlog(r *loginRecord, uid uint64) error {
+	f, err := os.OpenFile(lastlogPath, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", lastlogPath, err)
+	}
+	defer f.Close()
+
+	e := &lastlogEntry{Time: int32(r.time.Unix())}
+	copy(e.Line[:], r.line)
+	copy(e.Host[:], r.host)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, e); err != nil {
+		return fmt.Errorf("failed to encode lastlog entry: %w", err)
+	}
+	if _, err := f.WriteAt(buf.Bytes(), int64(uid)*int64(buf.Len())); err != nil {
+		return fmt.Errorf("failed to write %s: %w", lastlogPath, err)
+	}
+
+	return nil
+}
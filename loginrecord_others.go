@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sshd
+
+func writeLogin(*loginRecord, string) error {
+	return nil
+}
+
+func writeLogout(*loginRecord) error {
+	return nil
+}
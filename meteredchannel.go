@@ -0,0 +1,70 @@
+package sshd
+
+import (
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// meteredChannel counts the bytes read from and written to the channel, including the stderr stream.
+type meteredChannel struct {
+	ssh.Channel
+
+	metrics *Metrics
+
+	// bytesIn is the number of bytes received from the client.
+	bytesIn atomic.Int64
+	// bytesOut is the number of bytes sent to the client.
+	bytesOut atomic.Int64
+}
+
+func newMeteredChannel(channel ssh.Channel, metrics *Metrics) *meteredChannel {
+	return &meteredChannel{
+		Channel: channel,
+		metrics: metrics,
+	}
+}
+
+func (c *meteredChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	c.countIn(n)
+	return n, err
+}
+
+func (c *meteredChannel) Write(b []byte) (int, error) {
+	n, err := c.Channel.Write(b)
+	c.countOut(n)
+	return n, err
+}
+
+func (c *meteredChannel) Stderr() io.ReadWriter {
+	return &meteredStderr{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+func (c *meteredChannel) countIn(n int) {
+	c.bytesIn.Add(int64(n))
+	c.metrics.bytesIn(n)
+}
+
+func (c *meteredChannel) countOut(n int) {
+	c.bytesOut.Add(int64(n))
+	c.metrics.bytesOut(n)
+}
+
+type meteredStderr struct {
+	io.ReadWriter
+	c *meteredChannel
+}
+
+func (s *meteredStderr) Read(b []byte) (int, error) {
+	n, err := s.ReadWriter.Read(b)
+	s.c.countIn(n)
+	return n, err
+}
+
+func (s *meteredStderr) Write(b []byte) (int, error) {
+	n, err := s.ReadWriter.Write(b)
+	s.c.countOut(n)
+	return n, err
+}
@@ -0,0 +1,240 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics collects the metrics of a [Server], and is a [prometheus.Collector].
+//
+// A nil *Metrics records nothing.
+type Metrics struct {
+	connsAccepted   prometheus.Counter
+	channelAccepts  *prometheus.CounterVec
+	authFailures    *prometheus.CounterVec
+	activeSessions  *prometheus.GaugeVec
+	sessionDuration *prometheus.HistogramVec
+	bytesCopied     *prometheus.CounterVec
+	sftpOps         *prometheus.CounterVec
+}
+
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// NewMetrics creates the metrics, namespace is prefixed to the metric names.
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		connsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "connections_accepted_total",
+			Help:      "Number of accepted connections.",
+		}),
+		channelAccepts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "channel_accepts_total",
+			Help:      "Number of channels accepted by type and result, which is ok or failed.",
+		}, []string{"type", "result"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "auth_failures_total",
+			Help:      "Number of failed authentication attempts by method.",
+		}, []string{"method"}),
+		activeSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "active_sessions",
+			Help:      "Number of running sessions by type.",
+		}, []string{"type"}),
+		sessionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "session_duration_seconds",
+			Help:      "Duration of the sessions by type.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+		}, []string{"type"}),
+		bytesCopied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "channel_bytes_total",
+			Help:      "Number of bytes copied over the channels, in is from the client and out is to the client.",
+		}, []string{"direction"}),
+		sftpOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sshd",
+			Name:      "sftp_operations_total",
+			Help:      "Number of sftp requests by operation.",
+		}, []string{"op"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.connsAccepted,
+		m.channelAccepts,
+		m.authFailures,
+		m.activeSessions,
+		m.sessionDuration,
+		m.bytesCopied,
+		m.sftpOps,
+	}
+}
+
+// Describe implements [prometheus.Collector].
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements [prometheus.Collector].
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) connAccepted() {
+	if m == nil {
+		return
+	}
+
+	m.connsAccepted.Inc()
+}
+
+func (m *Metrics) channelAccepted(channeltype string, ok bool) {
+	if m == nil {
+		return
+	}
+
+	result := "ok"
+	if !ok {
+		result = "failed"
+	}
+	m.channelAccepts.WithLabelValues(channeltype, result).Inc()
+}
+
+func (m *Metrics) authFailed(method string) {
+	if m == nil {
+		return
+	}
+
+	m.authFailures.WithLabelValues(method).Inc()
+}
+
+// sessionStarted records the start of a session, and returns the function to call when it ends.
+func (m *Metrics) sessionStarted(sessiontype string) func() {
+	if m == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	m.activeSessions.WithLabelValues(sessiontype).Inc()
+
+	return func() {
+		m.activeSessions.WithLabelValues(sessiontype).Dec()
+		m.sessionDuration.WithLabelValues(sessiontype).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) bytesIn(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+
+	m.bytesCopied.WithLabelValues("in").Add(float64(n))
+}
+
+func (m *Metrics) bytesOut(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+
+	m.bytesCopied.WithLabelValues("out").Add(float64(n))
+}
+
+func (m *Metrics) sftpOp(op string) {
+	if m == nil {
+		return
+	}
+
+	m.sftpOps.WithLabelValues(op).Inc()
+}
+
+// sftpPacketNames are the names of the sftp packets sent by clients.
+var sftpPacketNames = map[byte]string{
+	1:   "init",
+	3:   "open",
+	4:   "close",
+	5:   "read",
+	6:   "write",
+	7:   "lstat",
+	8:   "fstat",
+	9:   "setstat",
+	10:  "fsetstat",
+	11:  "opendir",
+	12:  "readdir",
+	13:  "remove",
+	14:  "mkdir",
+	15:  "rmdir",
+	16:  "realpath",
+	17:  "stat",
+	18:  "rename",
+	19:  "readlink",
+	20:  "symlink",
+	200: "extended",
+}
+
+// sftpPacketObserver is a reader that follows the framing of the sftp packets read through it,
+// and reports the type of each packet.
+type sftpPacketObserver struct {
+	io.Reader
+
+	onPacket func(name string)
+
+	// header is the partially read length and type of the current packet.
+	header    [5]byte
+	headerLen int
+	// remaining is the number of bytes left in the body of the current packet.
+	remaining uint32
+}
+
+func (o *sftpPacketObserver) Read(b []byte) (int, error) {
+	n, err := o.Reader.Read(b)
+	o.observe(b[:n])
+	return n, err
+}
+
+func (o *sftpPacketObserver) observe(b []byte) {
+	for len(b) > 0 {
+		if o.remaining > 0 {
+			skip := min(uint32(len(b)), o.remaining)
+			o.remaining -= skip
+			b = b[skip:]
+			continue
+		}
+
+		copied := copy(o.header[o.headerLen:], b)
+		o.headerLen += copied
+		b = b[copied:]
+
+		if o.headerLen < len(o.header) {
+			return
+		}
+
+		name, ok := sftpPacketNames[o.header[4]]
+		if !ok {
+			name = strconv.Itoa(int(o.header[4]))
+		}
+		o.onPacket(name)
+
+		// the length includes the type byte
+		o.remaining = max(binary.BigEndian.Uint32(o.header[:4]), 1) - 1
+		o.headerLen = 0
+	}
+}
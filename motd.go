@@ -0,0 +1,85 @@
+package sshd
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// DefaultMOTDPath is the file of the message of the day printed if no other is configured.
+const DefaultMOTDPath = "/etc/motd"
+
+// MOTDOptions configures the message of the day printed at the start of shell sessions.
+// Like openssh, nothing is printed for users with a ~/.hushlogin file.
+type MOTDOptions struct {
+	// Path is the file of the message, defaults to [DefaultMOTDPath]. It is ignored if Template is set.
+	Path string
+	// Template, if set, is executed with [MOTDData] to generate the message.
+	Template *template.Template
+}
+
+// MOTDData is the data for the template of the message of the day.
+type MOTDData struct {
+	Hostname   string
+	User       string
+	RemoteAddr string
+	Time       time.Time
+}
+
+// loadMOTD returns the message of the day for the shell session of the channel, nil if there is none.
+func (c *Channel) loadMOTD() []byte {
+	opts := c.srv.MOTD
+	if opts == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(c.user.HomeDir, ".hushlogin")); err == nil {
+		return nil
+	}
+
+	if opts.Template == nil {
+		path := opts.Path
+		if path == "" {
+			path = DefaultMOTDPath
+		}
+
+		msg, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.logger.Info("failed to read motd", "path", path, "err", err.Error())
+		}
+
+		return toCRLF(msg)
+	}
+
+	hostname, _ := os.Hostname()
+	data := MOTDData{
+		Hostname: hostname,
+		User:     c.user.Username,
+		Time:     time.Now(),
+	}
+	if c.conn != nil {
+		data.RemoteAddr = c.conn.sshcon.RemoteAddr().String()
+	}
+
+	var msg bytes.Buffer
+	if err := opts.Template.Execute(&msg, data); err != nil {
+		c.logger.Info("failed to execute motd template", "err", err.Error())
+		return nil
+	}
+
+	return toCRLF(msg.Bytes())
+}
+
+// toCRLF converts the line endings to CR LF as the terminal expects,
+// since the message is not written through the line discipline of the pty.
+func toCRLF(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,592 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/user"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// Option configures a [Server] created by [NewServer].
+type Option func(s *Server) error
+
+// NewServer creates a server with the options applied in order.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		Config: &ssh.ServerConfig{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// WithConfig replaces the ssh server configuration.
+// It should be the first option since other options modify the configuration,
+// though the host keys added by the options before it are added to config.
+func WithConfig(config *ssh.ServerConfig) Option {
+	return func(s *Server) error {
+		if config == nil {
+			return errors.New("ssh server config is nil")
+		}
+
+		for _, signer := range s.configHostKeys {
+			config.AddHostKey(signer)
+		}
+
+		s.Config = config
+		return nil
+	}
+}
+
+// WithHostKey adds a host key.
+func WithHostKey(signer ssh.Signer) Option {
+	return func(s *Server) error {
+		s.addHostKey(signer)
+		return nil
+	}
+}
+
+// WithHostKeysFromDir adds all the host keys in dir, see [LoadHostKeys].
+func WithHostKeysFromDir(dir string) Option {
+	return func(s *Server) error {
+		signers, err := LoadHostKeys(dir)
+		if err != nil {
+			return err
+		}
+		for _, signer := range signers {
+			s.addHostKey(signer)
+		}
+		return nil
+	}
+}
+
+// WithGeneratedHostKeys loads the host keys of keytypes in dir, generating them if missing, see [LoadOrGenerateHostKeys].
+func WithGeneratedHostKeys(dir string, keytypes ...HostKeyType) Option {
+	return func(s *Server) error {
+		if len(keytypes) == 0 {
+			keytypes = DefaultHostKeyTypes
+		}
+		for _, keytype := range keytypes {
+			signer, err := LoadOrGenerateHostKey(dir, keytype)
+			if err != nil {
+				return err
+			}
+			s.addHostKey(signer)
+		}
+		return nil
+	}
+}
+
+// WithPasswordCallback sets the callback for password authentication.
+func WithPasswordCallback(cb func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)) Option {
+	return func(s *Server) error {
+		s.Config.PasswordCallback = cb
+		return nil
+	}
+}
+
+// WithPublicKeyCallback sets the callback for public key authentication.
+func WithPublicKeyCallback(cb func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)) Option {
+	return func(s *Server) error {
+		s.Config.PublicKeyCallback = cb
+		return nil
+	}
+}
+
+// WithSSHDConfig applies the sshd_config, see [SSHDConfig.Apply].
+// It should come after the authentication options.
+func WithSSHDConfig(c *SSHDConfig) Option {
+	return func(s *Server) error {
+		return c.Apply(s)
+	}
+}
+
+// WithServerVersion sets the identification string announced to the clients, such as SSH-2.0-fardream_sshd_1.2.
+func WithServerVersion(v string) Option {
+	return func(s *Server) error {
+		if err := ValidateServerVersion(v); err != nil {
+			return err
+		}
+		s.Config.ServerVersion = v
+		return nil
+	}
+}
+
+// WithRandomServerVersion announces a random one of versions to every connection,
+// or one of [CommonServerVersions] if versions is empty.
+func WithRandomServerVersion(versions ...string) Option {
+	return func(s *Server) error {
+		for _, v := range versions {
+			if err := ValidateServerVersion(v); err != nil {
+				return err
+			}
+		}
+		s.VersionFunc = RandomServerVersion(versions...)
+		return nil
+	}
+}
+
+// WithUseDNS resolves the host names of the clients by reverse dns.
+func WithUseDNS(useDNS bool) Option {
+	return func(s *Server) error {
+		s.UseDNS = useDNS
+		return nil
+	}
+}
+
+// WithAlgorithms restricts the algorithms negotiated with the clients,
+// for example to [ModernAlgorithms] or [CompatAlgorithms].
+func WithAlgorithms(p AlgorithmPolicy) Option {
+	return func(s *Server) error {
+		s.Algorithms = &p
+		return nil
+	}
+}
+
+// WithShell sets the shell used for shell and exec requests.
+func WithShell(shell string) Option {
+	return func(s *Server) error {
+		s.Shell = shell
+		return nil
+	}
+}
+
+// WithShellFunc sets the callback returning the shell of the sessions of each user,
+// empty falls back to the shell of the server.
+func WithShellFunc(f func(u *UserInfo) string) Option {
+	return func(s *Server) error {
+		s.ShellFunc = f
+		return nil
+	}
+}
+
+// WithWorkingDir sets the working directory of the sessions, such as a fixed jail directory.
+func WithWorkingDir(dir string) Option {
+	return func(s *Server) error {
+		s.WorkingDir = dir
+		return nil
+	}
+}
+
+// WithWorkingDirFunc sets the callback returning the working directory of the sessions of each user.
+func WithWorkingDirFunc(f func(u *user.User) string) Option {
+	return func(s *Server) error {
+		s.WorkingDirFunc = f
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the server.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) error {
+		s.Logger = l
+		return nil
+	}
+}
+
+// WithIdleTimeout closes connections that have not received anything for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) error {
+		s.IdleTimeout = d
+		return nil
+	}
+}
+
+// WithSessionTimeouts closes the sessions idle for idle or open for longer than maxDuration,
+// either of which can be 0 for no limit.
+func WithSessionTimeouts(idle, maxDuration time.Duration) Option {
+	return func(s *Server) error {
+		s.SessionIdleTimeout = idle
+		s.SessionMaxDuration = maxDuration
+		return nil
+	}
+}
+
+// WithClientAlive probes the clients every interval, and closes the connection after countMax unanswered probes.
+func WithClientAlive(interval time.Duration, countMax int) Option {
+	return func(s *Server) error {
+		s.ClientAliveInterval = interval
+		s.ClientAliveCountMax = countMax
+		return nil
+	}
+}
+
+// WithTCPOptions sets the socket options of the accepted tcp connections.
+func WithTCPOptions(o TCPOptions) Option {
+	return func(s *Server) error {
+		s.TCP = o
+		return nil
+	}
+}
+
+// WithMetrics collects the metrics of the server into m, which should be registered to a prometheus registry.
+func WithMetrics(m *Metrics) Option {
+	return func(s *Server) error {
+		s.Metrics = m
+		return nil
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer for connections and sessions.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Server) error {
+		s.TracerProvider = tp
+		return nil
+	}
+}
+
+// WithCgroupLimits limits the resources of each session with a cgroup v2.
+func WithCgroupLimits(limits CgroupLimits) Option {
+	return func(s *Server) error {
+		s.Cgroup = &limits
+		return nil
+	}
+}
+
+// WithMOTD prints the message of the day at the start of shell sessions.
+func WithMOTD(opts MOTDOptions) Option {
+	return func(s *Server) error {
+		s.MOTD = &opts
+		return nil
+	}
+}
+
+// WithRecording records the interactive sessions.
+func WithRecording(opts RecordingOptions) Option {
+	return func(s *Server) error {
+		s.Recording = &opts
+		return nil
+	}
+}
+
+// WithHooks sets the connection lifecycle hooks.
+func WithHooks(h Hooks) Option {
+	return func(s *Server) error {
+		s.Hooks = h
+		return nil
+	}
+}
+
+// WithSFTP enables or disables the sftp subsystem, which is enabled by default.
+func WithSFTP(enabled bool) Option {
+	return func(s *Server) error {
+		s.DisableSFTP = !enabled
+		return nil
+	}
+}
+
+// WithSFTPServer serves the sftp subsystem with the external sftp server command.
+func WithSFTPServer(command string) Option {
+	return func(s *Server) error {
+		s.SFTPServer = command
+		return nil
+	}
+}
+
+// WithSFTPHandlers serves sftp with the handlers returned by f for each connection, see [Server.SFTPHandlers].
+func WithSFTPHandlers(f func(info ConnInfo) (sftp.Handlers, error)) Option {
+	return func(s *Server) error {
+		s.SFTPHandlers = f
+		return nil
+	}
+}
+
+// WithInMemorySFTP serves sftp from filesystems in memory, one per user, see [InMemorySFTP].
+func WithInMemorySFTP() Option {
+	return WithSFTPHandlers(InMemorySFTP())
+}
+
+// WithSFTPExtensions sets the openssh extensions advertised by the sftp server in process,
+// among posix-rename@openssh.com, statvfs@openssh.com and hardlink@openssh.com, which are all advertised by default.
+// The sftp package keeps them for the whole process.
+// fsync@openssh.com is only supported by the external sftp servers, see [WithSFTPServer].
+func WithSFTPExtensions(extensions ...string) Option {
+	return func(s *Server) error {
+		if err := sftp.SetSFTPExtensions(extensions...); err != nil {
+			return fmt.Errorf("failed to set sftp extensions: %w", err)
+		}
+		return nil
+	}
+}
+
+// WithMaxCommandLength limits the length of the commands of exec requests, see [Server.MaxCommandLength].
+func WithMaxCommandLength(n int) Option {
+	return func(s *Server) error {
+		s.MaxCommandLength = n
+		return nil
+	}
+}
+
+// WithEnvLimits limits the length of each environment variable set by the clients, the name and the value together,
+// and their number in a session. Zero means the default.
+func WithEnvLimits(maxLength, maxCount int) Option {
+	return func(s *Server) error {
+		s.MaxEnvLength = maxLength
+		s.MaxEnvCount = maxCount
+		return nil
+	}
+}
+
+// WithExecHandler runs the exec requests with h instead of the shell.
+func WithExecHandler(h ExecHandler) Option {
+	return func(s *Server) error {
+		s.ExecHandler = h
+		return nil
+	}
+}
+
+// WithAuditLog writes the channel opens, channel requests and global requests to w as json lines.
+func WithAuditLog(w io.Writer) Option {
+	return func(s *Server) error {
+		s.AuditLog = w
+		return nil
+	}
+}
+
+// WithHoneypot runs the server as a honeypot, see [Honeypot].
+func WithHoneypot(h Honeypot) Option {
+	return func(s *Server) error {
+		s.Honeypot = &h
+		return nil
+	}
+}
+
+// WithTap wraps the streams of the sessions with the tap returned by f.
+func WithTap(f func(info ConnInfo, sessionType string) *IOTap) Option {
+	return func(s *Server) error {
+		s.Tap = f
+		return nil
+	}
+}
+
+// WithBuiltinSCP serves the scp requests in process instead of running the scp of the system.
+func WithBuiltinSCP(enabled bool) Option {
+	return func(s *Server) error {
+		s.BuiltinSCP = enabled
+		return nil
+	}
+}
+
+// WithAcceptEnv sets the patterns of the environment variables the clients can set.
+func WithAcceptEnv(patterns ...string) Option {
+	return func(s *Server) error {
+		s.AcceptEnv = patterns
+		return nil
+	}
+}
+
+// WithEnv sets the environment variables in the form of key=value for every session.
+func WithEnv(env ...string) Option {
+	return func(s *Server) error {
+		s.Env = env
+		return nil
+	}
+}
+
+// WithUserEnv adds the environment variables returned by f to the sessions of each connection.
+func WithUserEnv(f func(info ConnInfo) []string) Option {
+	return func(s *Server) error {
+		s.UserEnv = f
+		return nil
+	}
+}
+
+// WithEnvironmentFile reads the environment variables of the sessions from path, such as [DefaultEnvironmentFile].
+func WithEnvironmentFile(path string) Option {
+	return func(s *Server) error {
+		s.EnvironmentFile = path
+		return nil
+	}
+}
+
+// WithForwardRateLimit limits the bytes per second in each direction of each forwarded connection,
+// and of all the forwarded connections of a user together. Zero means no limit.
+func WithForwardRateLimit(perForward, perUser int64) Option {
+	return func(s *Server) error {
+		s.ForwardRateLimit = perForward
+		s.UserForwardRateLimit = perUser
+		return nil
+	}
+}
+
+// WithSFTPRateLimit limits the bytes per second uploaded and downloaded by each sftp session,
+// and by all the sftp sessions of a user together. Zero means no limit.
+func WithSFTPRateLimit(perSession, perUser int64) Option {
+	return func(s *Server) error {
+		s.SFTPRateLimit = perSession
+		s.UserSFTPRateLimit = perUser
+		return nil
+	}
+}
+
+// WithStreamLocalPolicy checks the unix socket paths the clients forward connections to with policy.
+func WithStreamLocalPolicy(policy func(info ConnInfo, path string) error) Option {
+	return func(s *Server) error {
+		s.StreamLocalPolicy = policy
+		return nil
+	}
+}
+
+// WithGlobalRequestHandler handles the global requests of requestType with h.
+func WithGlobalRequestHandler(requestType string, h GlobalRequestHandler) Option {
+	return func(s *Server) error {
+		if s.GlobalRequestHandlers == nil {
+			s.GlobalRequestHandlers = make(map[string]GlobalRequestHandler)
+		}
+		s.GlobalRequestHandlers[requestType] = h
+		return nil
+	}
+}
+
+// WithChannelRequestHandler handles the session channel requests of requestType with h.
+func WithChannelRequestHandler(requestType string, h ChannelRequestHandler) Option {
+	return func(s *Server) error {
+		if s.ChannelRequestHandlers == nil {
+			s.ChannelRequestHandlers = make(map[string]ChannelRequestHandler)
+		}
+		s.ChannelRequestHandlers[requestType] = h
+		return nil
+	}
+}
+
+// WithUserBackend looks up the accounts of the users with b.
+func WithUserBackend(b UserBackend) Option {
+	return func(s *Server) error {
+		s.Users = b
+		return nil
+	}
+}
+
+// WithPAM opens a pam session of service around each program of the sessions.
+func WithPAM(service string) Option {
+	return func(s *Server) error {
+		s.PAMService = service
+		return nil
+	}
+}
+
+// WithRecordLogins records the interactive sessions in utmp, wtmp and lastlog.
+func WithRecordLogins(enabled bool) Option {
+	return func(s *Server) error {
+		s.RecordLogins = enabled
+		return nil
+	}
+}
+
+// WithFeatures sets the features available to the sessions.
+func WithFeatures(features Features) Option {
+	return func(s *Server) error {
+		s.Features = features
+		return nil
+	}
+}
+
+// WithUserFeatures sets the callback deciding the features available to each authenticated connection.
+func WithUserFeatures(f func(info ConnInfo) Features) Option {
+	return func(s *Server) error {
+		s.UserFeatures = f
+		return nil
+	}
+}
+
+// WithGeoFilter filters the connections by the country of their addresses with f.
+func WithGeoFilter(f *GeoFilter) Option {
+	return func(s *Server) error {
+		s.Geo = f
+		return nil
+	}
+}
+
+// WithKnockGate only serves the connections from the addresses admitted by g, see [KnockGate].
+func WithKnockGate(g *KnockGate) Option {
+	return func(s *Server) error {
+		s.KnockGate = g
+		return nil
+	}
+}
+
+// WithMaxSessions limits the number of open session channels per connection.
+func WithMaxSessions(n int) Option {
+	return func(s *Server) error {
+		s.MaxSessions = n
+		return nil
+	}
+}
+
+// WithMaxForwards limits the number of concurrent forwarded connections per connection.
+func WithMaxForwards(n int) Option {
+	return func(s *Server) error {
+		s.MaxForwards = n
+		return nil
+	}
+}
+
+// WithServerLimits limits the number of open session channels and concurrent forwarded connections
+// of all the connections together. Zero means no limit.
+func WithServerLimits(sessions, forwards int) Option {
+	return func(s *Server) error {
+		s.MaxTotalSessions = sessions
+		s.MaxTotalForwards = forwards
+		return nil
+	}
+}
+
+// WithConnLimits limits the approximate resources of each connection, see [Server.ConnLimits].
+func WithConnLimits(limits ConnResources) Option {
+	return func(s *Server) error {
+		s.ConnLimits = limits
+		return nil
+	}
+}
+
+// WithMaxStartups limits the concurrent unauthenticated connections.
+func WithMaxStartups(m MaxStartups) Option {
+	return func(s *Server) error {
+		s.MaxStartups = m
+		return nil
+	}
+}
+
+// WithPerSourceMaxStartups limits the concurrent unauthenticated connections from the same source address.
+func WithPerSourceMaxStartups(n int) Option {
+	return func(s *Server) error {
+		s.PerSourceMaxStartups = n
+		return nil
+	}
+}
+
+// WithRekeyLimit renegotiates the session keys after n bytes are transmitted.
+// There is no time limit, x/crypto doesn't support renegotiating the keys on a timer.
+func WithRekeyLimit(n uint64) Option {
+	return func(s *Server) error {
+		s.Config.RekeyThreshold = n
+		return nil
+	}
+}
+
+// WithLoginGraceTime limits the time for clients to finish the handshake and authentication.
+func WithLoginGraceTime(d time.Duration) Option {
+	return func(s *Server) error {
+		s.LoginGraceTime = d
+		return nil
+	}
+}
+
+// WithShutdownMessage sets the message written to interactive sessions when the server shuts down.
+func WithShutdownMessage(msg string) Option {
+	return func(s *Server) error {
+		s.ShutdownMessage = msg
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+package sshd_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/fardream/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWithConfigKeepsHostKeys(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := sshd.NewServer(
+		sshd.WithHostKey(signer),
+		sshd.WithConfig(&ssh.ServerConfig{NoClientAuth: true}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(context.Background(), l)
+	defer srv.Close()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatalf("failed to connect with the host key added before WithConfig: %v", err)
+	}
+	client.Close()
+}
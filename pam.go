@@ -0,0 +1,41 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// errPAMUnsupported is returned when the pam service is set but pam support is not built in.
+var errPAMUnsupported = errors.New("pam is not supported, build with the pam tag on linux")
+
+// openPAM opens the pam session of the channel, and adds the environment set by the pam modules to cmd.
+func (c *Channel) openPAM(cmd *exec.Cmd) error {
+	tty := "ssh"
+	if _, t := c.session.terminal(); t != nil {
+		tty = strings.TrimPrefix(t.Name(), "/dev/")
+	}
+
+	session, err := openPAMSession(c.srv.PAMService, c.user.Username, c.srv.RemoteHost(c.conn.sshcon.RemoteAddr()), tty)
+	if err != nil {
+		return fmt.Errorf("failed to open pam session: %w", err)
+	}
+	c.pam = session
+
+	cmd.Env = mergeEnv(cmd.Env, session.env())
+
+	return nil
+}
+
+// closePAM closes the pam session of the channel if one is open.
+func (c *Channel) closePAM() {
+	if c.pam == nil {
+		return
+	}
+
+	if err := c.pam.close(); err != nil {
+		c.logger.Error("failed to close pam session", "err", err.Error())
+	}
+	c.pam = nil
+}
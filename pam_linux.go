@@ -0,0 +1,250 @@
+//go:build pam && linux && cgo
+
+package sshd
+
+/*
+#cgo LDFLAGS: -lpam
+
+#include <stdlib.h>
+#include <security/pam_appl.h>
+
+// conv rejects the prompts, since the client cannot be asked once the session starts.
+static int conv(int n, const struct pam_message **msg, struct pam_response **resp, void *data) {
+	for (int i = 0; i < n; i++) {
+		if (msg[i]->msg_style == PAM_PROMPT_ECHO_OFF || msg[i]->msg_style == PAM_PROMPT_ECHO_ON) {
+			return PAM_CONV_ERR;
+		}
+	}
+
+	*resp = calloc(n, sizeof(struct pam_response));
+	return *resp == NULL ? PAM_BUF_ERR : PAM_SUCCESS;
+}
+
+static struct pam_conv sshd_conv = {conv, NULL};
+
+static int sshd_pam_start(const char *service, const char *user, pam_handle_t **h) {
+	return pam_start(service, user, &sshd_conv, h);
+}
+
+static int sshd_pam_set_item(pam_handle_t *h, int item, const char *value) {
+	return pam_set_item(h, item, value);
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pamMu serializes opening the pam sessions,
+// since the modules change the limits and the cgroup of the whole process.
+var pamMu sync.Mutex
+
+// pamRlimits are the resource limits pam_limits can set.
+var pamRlimits = []int{
+	unix.RLIMIT_AS, unix.RLIMIT_CORE, unix.RLIMIT_CPU, unix.RLIMIT_DATA, unix.RLIMIT_FSIZE,
+	unix.RLIMIT_MEMLOCK, unix.RLIMIT_NOFILE, unix.RLIMIT_NPROC, unix.RLIMIT_RSS, unix.RLIMIT_STACK,
+	unix.RLIMIT_LOCKS, unix.RLIMIT_SIGPENDING, unix.RLIMIT_MSGQUEUE, unix.RLIMIT_NICE, unix.RLIMIT_RTPRIO,
+}
+
+// pamSession is an open pam session.
+// Unlike openssh, the modules run in the server process instead of a forked one,
+// so the limits and the cgroup they set are moved from the server to the session process.
+type pamSession struct {
+	h       *C.pam_handle_t
+	envs    []string
+	rlimits map[int]unix.Rlimit
+	// cgroup is the cgroup v2 of the session, such as the scope created by pam_systemd.
+	cgroup string
+}
+
+func openPAMSession(service, user, rhost, tty string) (*pamSession, error) {
+	cservice := C.CString(service)
+	defer C.free(unsafe.Pointer(cservice))
+	cuser := C.CString(user)
+	defer C.free(unsafe.Pointer(cuser))
+
+	s := &pamSession{}
+	if rc := C.sshd_pam_start(cservice, cuser, &s.h); rc != C.PAM_SUCCESS {
+		return nil, fmt.Errorf("failed to start pam service %s: %d", service, int(rc))
+	}
+
+	for item, value := range map[C.int]string{C.PAM_RHOST: rhost, C.PAM_TTY: tty} {
+		cvalue := C.CString(value)
+		rc := C.sshd_pam_set_item(s.h, item, cvalue)
+		C.free(unsafe.Pointer(cvalue))
+		if rc != C.PAM_SUCCESS {
+			return nil, s.end(rc, "failed to set pam item")
+		}
+	}
+
+	pamMu.Lock()
+	defer pamMu.Unlock()
+
+	rlimits, err := getRlimits()
+	if err != nil {
+		return nil, s.end(C.PAM_SUCCESS, err.Error())
+	}
+	cgroup, err := selfCgroup()
+	if err != nil {
+		return nil, s.end(C.PAM_SUCCESS, err.Error())
+	}
+
+	if rc := C.pam_setcred(s.h, C.PAM_ESTABLISH_CRED); rc != C.PAM_SUCCESS {
+		return nil, s.end(rc, "failed to establish pam credentials")
+	}
+	if rc := C.pam_open_session(s.h, 0); rc != C.PAM_SUCCESS {
+		C.pam_setcred(s.h, C.PAM_DELETE_CRED)
+		return nil, s.end(rc, "failed to open pam session")
+	}
+
+	s.envs = s.getenvlist()
+
+	s.rlimits, err = getRlimits()
+	if err == nil {
+		err = setRlimits(rlimits)
+	}
+	if err != nil {
+		return nil, errors.Join(err, s.close())
+	}
+
+	if sessionCgroup, err := selfCgroup(); err == nil && sessionCgroup != cgroup {
+		s.cgroup = sessionCgroup
+		if err := moveToCgroup(cgroup, os.Getpid()); err != nil {
+			return nil, errors.Join(err, s.close())
+		}
+	}
+
+	return s, nil
+}
+
+func (s *pamSession) env() []string {
+	return s.envs
+}
+
+// attach applies the limits and the cgroup set by the modules to the session process pid.
+func (s *pamSession) attach(pid int) error {
+	var errs []error
+	for resource, limit := range s.rlimits {
+		if err := unix.Prlimit(pid, resource, &limit, nil); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set resource limit %d: %w", resource, err))
+		}
+	}
+
+	if s.cgroup != "" {
+		errs = append(errs, moveToCgroup(s.cgroup, pid))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *pamSession) close() error {
+	var errs []error
+	if rc := C.pam_close_session(s.h, 0); rc != C.PAM_SUCCESS {
+		errs = append(errs, s.error(rc, "failed to close pam session"))
+	}
+	if rc := C.pam_setcred(s.h, C.PAM_DELETE_CRED); rc != C.PAM_SUCCESS {
+		errs = append(errs, s.error(rc, "failed to delete pam credentials"))
+	}
+	errs = append(errs, s.end(C.PAM_SUCCESS, ""))
+
+	return errors.Join(errs...)
+}
+
+func (s *pamSession) getenvlist() []string {
+	list := C.pam_getenvlist(s.h)
+	if list == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(list))
+
+	var envs []string
+	for p := list; *p != nil; p = (**C.char)(unsafe.Add(unsafe.Pointer(p), unsafe.Sizeof(*p))) {
+		envs = append(envs, C.GoString(*p))
+		C.free(unsafe.Pointer(*p))
+	}
+
+	return envs
+}
+
+func (s *pamSession) error(rc C.int, msg string) error {
+	return fmt.Errorf("%s: %s", msg, C.GoString(C.pam_strerror(s.h, rc)))
+}
+
+// end terminates the pam transaction, and returns the error of rc if it is not a success.
+func (s *pamSession) end(rc C.int, msg string) error {
+	var err error
+	if rc != C.PAM_SUCCESS {
+		err = s.error(rc, msg)
+	} else if msg != "" {
+		err = errors.New(msg)
+	}
+
+	C.pam_end(s.h, rc)
+
+	return err
+}
+
+func getRlimits() (map[int]unix.Rlimit, error) {
+	rlimits := make(map[int]unix.Rlimit, len(pamRlimits))
+	for _, resource := range pamRlimits {
+		var limit unix.Rlimit
+		if err := unix.Getrlimit(resource, &limit); err != nil {
+			return nil, fmt.Errorf("failed to get resource limit %d: %w", resource, err)
+		}
+		rlimits[resource] = limit
+	}
+
+	return rlimits, nil
+}
+
+func setRlimits(rlimits map[int]unix.Rlimit) error {
+	for resource, limit := range rlimits {
+		if err := unix.Setrlimit(resource, &limit); err != nil {
+			return fmt.Errorf("failed to restore resource limit %d: %w", resource, err)
+		}
+	}
+
+	return nil
+}
+
+// selfCgroup returns the cgroup v2 of the process, empty if there is none.
+func selfCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+func moveToCgroup(cgroup string, pid int) error {
+	if cgroup == "" {
+		return nil
+	}
+
+	procs := filepath.Join("/sys/fs/cgroup", cgroup, "cgroup.procs")
+	if err := os.WriteFile(procs, []byte(strconv.Itoa(pid)), 0o644); err != nil {
+		return fmt.Errorf("failed to move process %d to cgroup %s: %w", pid, cgroup, err)
+	}
+
+	return nil
+}
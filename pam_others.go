@@ -0,0 +1,21 @@
+//go:build !pam || !linux || !cgo
+
+package sshd
+
+type pamSession struct{}
+
+func openPAMSession(service, user, rhost, tty string) (*pamSession, error) {
+	return nil, errPAMUnsupported
+}
+
+func (*pamSession) env() []string {
+	return nil
+}
+
+func (*pamSession) attach(pid int) error {
+	return nil
+}
+
+func (*pamSession) close() error {
+	return nil
+}
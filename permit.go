@@ -0,0 +1,79 @@
+package sshd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the extensions of the authentication permissions restricting the forwardings of a key,
+// like the permitopen and permitlisten options of authorized_keys.
+// The values are comma separated lists in the format of [Features.PermitOpen] and [Features.PermitListen].
+const (
+	PermitOpenExtension   = "permitopen"
+	PermitListenExtension = "permitlisten"
+)
+
+// permitOpen checks if the connection may forward connections to host and port.
+func (s *ServerConn) permitOpen(host string, port uint32) bool {
+	return permitted(s.features.PermitOpen, host, port) &&
+		permitted(s.permissionList(PermitOpenExtension), host, port)
+}
+
+// permitListen checks if the connection may listen on host and port for remote forwarding.
+func (s *ServerConn) permitListen(host string, port uint32) bool {
+	return permitted(s.features.PermitListen, host, port) &&
+		permitted(s.permissionList(PermitListenExtension), host, port)
+}
+
+// permissionList returns the comma separated list in the extension of the authentication permissions,
+// nil if the extension is absent.
+func (s *ServerConn) permissionList(extension string) []string {
+	if s.sshcon.Permissions == nil {
+		return nil
+	}
+
+	value, ok := s.sshcon.Permissions.Extensions[extension]
+	if !ok {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// permitted checks host and port against the entries of a permitopen or permitlisten list,
+// which are host:port, or just port for listening on any address.
+// Either can be * for any, and the entries any and none allow everything and nothing.
+// A nil list allows everything.
+func permitted(entries []string, host string, port uint32) bool {
+	if entries == nil {
+		return true
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "any":
+			return true
+		case "none":
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			// only the port is given.
+			entryHost, entryPort = "*", entry
+		}
+
+		if entryHost != "*" && !strings.EqualFold(entryHost, host) {
+			continue
+		}
+		if entryPort != "*" && entryPort != strconv.FormatUint(uint64(port), 10) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,139 @@
+package sshd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxIdentLength is the maximum length of the identification line of the client, including CR LF, per RFC 4253.
+const maxIdentLength = 255
+
+// readClientIdent reads the identification line of the client, so clients sending garbage are dropped
+// before any handshake state is allocated. The returned conn replays what is read to the handshake.
+func readClientIdent(conn net.Conn) (net.Conn, error) {
+	buf := make([]byte, 0, maxIdentLength)
+	chunk := make([]byte, 64)
+
+	for {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		if len(buf) >= 4 && !bytes.HasPrefix(buf, []byte("SSH-")) {
+			return nil, errors.New("client did not send an ssh identification")
+		}
+
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			ident := bytes.TrimRight(buf[:i], "\r")
+			if !bytes.HasPrefix(ident, []byte("SSH-2.0-")) && !bytes.HasPrefix(ident, []byte("SSH-1.99-")) {
+				return nil, fmt.Errorf("unsupported client identification: %q", ident)
+			}
+			break
+		}
+
+		if len(buf) > maxIdentLength {
+			return nil, errors.New("client identification is too long")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client identification: %w", err)
+		}
+	}
+
+	return &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}, nil
+}
+
+// replayConn reads from r, which replays the bytes already read from Conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// deadlineConn enforces the idle timeout and the deadline for the handshake on reads.
+type deadlineConn struct {
+	net.Conn
+
+	// idleTimeout, if positive, is the maximum duration of no data from the client
+	idleTimeout time.Duration
+
+	// handshakeDeadline, in unix nanoseconds, is the deadline for the client to finish the handshake,
+	// 0 if there is none or the handshake is finished.
+	handshakeDeadline atomic.Int64
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(c.readDeadline()); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+// finishHandshake removes the handshake deadline, including from the read that may be pending.
+func (c *deadlineConn) finishHandshake() {
+	c.handshakeDeadline.Store(0)
+	c.Conn.SetReadDeadline(c.readDeadline())
+}
+
+func (c *deadlineConn) readDeadline() time.Time {
+	var deadline time.Time
+	if c.idleTimeout > 0 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+
+	if hd := c.handshakeDeadline.Load(); hd != 0 {
+		if t := time.Unix(0, hd); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+
+	return deadline
+}
+
+// acquireSourceStartup counts an unauthenticated connection from the source address,
+// and returns false if the source has reached PerSourceMaxStartups.
+func (s *Server) acquireSourceStartup(addr net.Addr) bool {
+	if s.PerSourceMaxStartups <= 0 {
+		return true
+	}
+
+	source := addrHost(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sourceStartups[source] >= s.PerSourceMaxStartups {
+		return false
+	}
+
+	if s.sourceStartups == nil {
+		s.sourceStartups = make(map[string]int)
+	}
+	s.sourceStartups[source]++
+
+	return true
+}
+
+func (s *Server) releaseSourceStartup(addr net.Addr) {
+	if s.PerSourceMaxStartups <= 0 {
+		return
+	}
+
+	source := addrHost(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sourceStartups[source]--
+	if s.sourceStartups[source] <= 0 {
+		delete(s.sourceStartups, source)
+	}
+}
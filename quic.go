@@ -0,0 +1,144 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// quicStreamTimeout is the time for a quic connection to open its stream before it is closed.
+const quicStreamTimeout = 10 * time.Second
+
+// QUICListener accepts quic connections. The server doesn't implement quic:
+// the caller supplies a thin adapter around a quic library, such as quic-go, to [Server.ListenQUICStreams].
+type QUICListener interface {
+	// Accept waits for the next connection, and fails once the listener is closed.
+	Accept(ctx context.Context) (QUICConn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// QUICConn is a quic connection.
+type QUICConn interface {
+	// AcceptStream waits for the next bidirectional stream opened by the client.
+	AcceptStream(ctx context.Context) (QUICStream, error)
+	// CloseWithError closes the connection with an application error code and reason.
+	CloseWithError(code uint64, reason string) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// QUICStream is a bidirectional quic stream.
+type QUICStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// ListenQUICStreams adds a listener serving ssh over the streams of the quic connections accepted by l,
+// which is provided by the caller. This is experimental.
+// Each quic connection carries a single ssh connection on the first stream the client opens,
+// which benefits from the loss recovery of quic and survives the changes of the client address.
+// Other streams are ignored.
+func (s *Server) ListenQUICStreams(l QUICListener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ql := &quicListener{l: l, cancel: cancel, conns: make(chan net.Conn), done: make(chan struct{})}
+	go ql.accept(ctx)
+
+	return s.addListener(ql, false)
+}
+
+// quicListener is the [net.Listener] of the first streams of the connections of a [QUICListener].
+type quicListener struct {
+	l      QUICListener
+	cancel context.CancelFunc
+
+	conns chan net.Conn
+	// done is closed once the listener is closed or fails, with err.
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// accept accepts the connections and their streams until ctx is done.
+func (l *quicListener) accept(ctx context.Context) {
+	for {
+		conn, err := l.l.Accept(ctx)
+		if err != nil {
+			l.stop(fmt.Errorf("failed to accept quic connection: %w", err))
+			return
+		}
+
+		go l.acceptStream(ctx, conn)
+	}
+}
+
+// acceptStream waits for the first stream of conn and hands it to Accept.
+func (l *quicListener) acceptStream(ctx context.Context, conn QUICConn) {
+	streamctx, cancel := context.WithTimeout(ctx, quicStreamTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(streamctx)
+	if err != nil {
+		conn.CloseWithError(0, "no stream opened")
+		return
+	}
+
+	select {
+	case l.conns <- &quicConn{QUICStream: stream, conn: conn}:
+	case <-l.done:
+		stream.Close()
+		conn.CloseWithError(0, "server closed")
+	}
+}
+
+func (l *quicListener) stop(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		l.cancel()
+		close(l.done)
+	})
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.stop(net.ErrClosed)
+
+	return l.l.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// quicConn is a [net.Conn] over the stream of a quic connection, closing the connection with the stream.
+type quicConn struct {
+	QUICStream
+	conn QUICConn
+}
+
+func (c *quicConn) Close() error {
+	return errors.Join(c.QUICStream.Close(), c.conn.CloseWithError(0, ""))
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -0,0 +1,330 @@
+package sshd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordFormat is the file format of session recordings.
+type RecordFormat int
+
+const (
+	// RecordAsciicast records in asciinema asciicast v2 format, in a .cast file.
+	RecordAsciicast RecordFormat = iota
+	// RecordTypescript records in the format of script(1): the output in a .typescript file,
+	// the timing in a .timing file, and the input, if recorded, in a .input file.
+	RecordTypescript
+)
+
+// RecordingOptions configures recording of the interactive (pty) sessions.
+type RecordingOptions struct {
+	// Dir is the directory the recordings are written to.
+	Dir string
+	// Format is the format of the recordings.
+	Format RecordFormat
+	// RecordInput records the input from the client too, which may contain passwords.
+	RecordInput bool
+}
+
+// recordingSeq disambiguates the recordings started in the same second.
+var recordingSeq atomic.Uint64
+
+// sessionRecording records the terminal input and output of one session.
+type sessionRecording struct {
+	mu    sync.Mutex
+	start time.Time
+	w     recordingWriter
+	input bool
+	// closed is set after Close, since the copies may still be running.
+	closed bool
+}
+
+// recordingWriter writes the events in a specific format.
+type recordingWriter interface {
+	output(t time.Duration, b []byte) error
+	input(t time.Duration, b []byte) error
+	resize(t time.Duration, cols, rows uint32) error
+	Close() error
+}
+
+// newSessionRecording creates the recording files for a session of username.
+func newSessionRecording(opts *RecordingOptions, username string, cols, rows uint32, env map[string]string) (*sessionRecording, error) {
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory %s: %w", opts.Dir, err)
+	}
+
+	start := time.Now()
+	base := filepath.Join(opts.Dir,
+		fmt.Sprintf("%s-%s-%d", start.Format("20060102T150405"), username, recordingSeq.Add(1)))
+
+	var w recordingWriter
+	var err error
+
+	switch opts.Format {
+	case RecordAsciicast:
+		w, err = newAsciicastWriter(base+".cast", start, cols, rows, env)
+	case RecordTypescript:
+		w, err = newTypescriptWriter(base, start, opts.RecordInput)
+	default:
+		err = fmt.Errorf("unknown recording format: %d", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionRecording{start: start, w: w, input: opts.RecordInput}, nil
+}
+
+func (r *sessionRecording) recordOutput(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	if err := r.w.output(time.Since(r.start), b); err != nil {
+		log.Debug("failed to record output", "err", err.Error())
+	}
+}
+
+func (r *sessionRecording) recordInput(b []byte) {
+	if !r.input {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	if err := r.w.input(time.Since(r.start), b); err != nil {
+		log.Debug("failed to record input", "err", err.Error())
+	}
+}
+
+func (r *sessionRecording) recordResize(cols, rows uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	if err := r.w.resize(time.Since(r.start), cols, rows); err != nil {
+		log.Debug("failed to record resize", "err", err.Error())
+	}
+}
+
+func (r *sessionRecording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.w.Close()
+}
+
+// recordingReader passes the bytes read from Reader to record.
+type recordingReader struct {
+	io.Reader
+	record func([]byte)
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.record(b[:n])
+	}
+	return n, err
+}
+
+// asciicastWriter writes asciicast v2 files.
+type asciicastWriter struct {
+	f *os.File
+	w *bufio.Writer
+	// pending are the bytes of incomplete utf-8 sequences at the end of the last output or input.
+	pending map[string][]byte
+}
+
+func newAsciicastWriter(path string, start time.Time, cols, rows uint32, env map[string]string) (*asciicastWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording %s: %w", path, err)
+	}
+
+	w := &asciicastWriter{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		pending: make(map[string][]byte),
+	}
+
+	header := struct {
+		Version   int               `json:"version"`
+		Width     uint32            `json:"width"`
+		Height    uint32            `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Env       map[string]string `json:"env,omitempty"`
+	}{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: start.Unix(),
+		Env:       env,
+	}
+
+	if err := w.writeLine(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *asciicastWriter) writeLine(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	_, err = w.w.Write(line)
+
+	return err
+}
+
+func (w *asciicastWriter) event(t time.Duration, code string, b []byte) error {
+	data := append(w.pending[code], b...)
+	complete := completeUTF8(data)
+	w.pending[code] = append([]byte(nil), data[complete:]...)
+
+	if complete == 0 {
+		return nil
+	}
+
+	return w.writeLine([]any{t.Seconds(), code, string(data[:complete])})
+}
+
+func (w *asciicastWriter) output(t time.Duration, b []byte) error {
+	return w.event(t, "o", b)
+}
+
+func (w *asciicastWriter) input(t time.Duration, b []byte) error {
+	return w.event(t, "i", b)
+}
+
+func (w *asciicastWriter) resize(t time.Duration, cols, rows uint32) error {
+	return w.writeLine([]any{t.Seconds(), "r", fmt.Sprintf("%dx%d", cols, rows)})
+}
+
+func (w *asciicastWriter) Close() error {
+	return errors.Join(w.w.Flush(), w.f.Close())
+}
+
+// completeUTF8 returns the length of the prefix of b which doesn't end in an incomplete utf-8 sequence.
+func completeUTF8(b []byte) int {
+	// an utf-8 sequence is at most 4 bytes, only the last 3 bytes can be an incomplete sequence.
+	for i := len(b) - 1; i >= 0 && i >= len(b)-3; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+
+		if utf8.FullRune(b[i:]) {
+			return len(b)
+		}
+
+		return i
+	}
+
+	return len(b)
+}
+
+// typescriptWriter writes the output, timing and input files of script(1).
+type typescriptWriter struct {
+	outputFile *os.File
+	timing     *os.File
+	inputFile  *os.File
+	last       time.Duration
+}
+
+func newTypescriptWriter(base string, start time.Time, recordInput bool) (*typescriptWriter, error) {
+	w := &typescriptWriter{}
+
+	create := func(path string) (*os.File, error) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create recording %s: %w", path, err)
+		}
+		return f, nil
+	}
+
+	var err error
+	if w.outputFile, err = create(base + ".typescript"); err != nil {
+		return nil, err
+	}
+
+	if w.timing, err = create(base + ".timing"); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	if recordInput {
+		if w.inputFile, err = create(base + ".input"); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w.outputFile, "Script started on %s\n", start.Format(time.RFC1123Z)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	return w, nil
+}
+
+func (w *typescriptWriter) output(t time.Duration, b []byte) error {
+	if _, err := fmt.Fprintf(w.timing, "%.6f %d\n", (t - w.last).Seconds(), len(b)); err != nil {
+		return err
+	}
+	w.last = t
+
+	_, err := w.outputFile.Write(b)
+
+	return err
+}
+
+func (w *typescriptWriter) input(_ time.Duration, b []byte) error {
+	if w.inputFile == nil {
+		return nil
+	}
+
+	_, err := w.inputFile.Write(b)
+
+	return err
+}
+
+func (w *typescriptWriter) resize(time.Duration, uint32, uint32) error {
+	return nil
+}
+
+func (w *typescriptWriter) Close() error {
+	var errs []error
+	for _, f := range []*os.File{w.outputFile, w.timing, w.inputFile} {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
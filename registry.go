@@ -0,0 +1,198 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ConnStats is the snapshot of an active connection.
+type ConnStats struct {
+	ID         string
+	User       string
+	RemoteAddr net.Addr
+	Start      time.Time
+	Sessions   []SessionStats
+	Forwards   []ForwardStats
+	// Resources are the approximate resources used by the connection.
+	Resources ConnResources
+}
+
+// SessionStats is the snapshot of an open session channel.
+type SessionStats struct {
+	ID string
+	// Type is shell, exec, sftp or scp, and empty if no program is started yet.
+	Type  string
+	State SessionState
+	Start time.Time
+	// BytesIn is the number of bytes received from the client.
+	BytesIn int64
+	// BytesOut is the number of bytes sent to the client.
+	BytesOut int64
+}
+
+// ForwardStats is the snapshot of a forwarded connection.
+type ForwardStats struct {
+	// Type is the channel type, such as direct-tcpip or forwarded-tcpip.
+	Type string
+	// Target is the destination of a connection from the client, or the address a connection to the client is accepted on.
+	Target string
+	// Resolved is the address the server connected to for a connection from the client, empty otherwise.
+	Resolved string
+	// Origin is the address the connection comes from.
+	Origin string
+	Start  time.Time
+	// BytesIn and BytesOut are the numbers of bytes from and to the client.
+	BytesIn  int64
+	BytesOut int64
+	// RateIn and RateOut are the bytes per second from and to the client in the last second.
+	RateIn  float64
+	RateOut float64
+}
+
+// newID generates a random identifier for connections.
+func newID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate random id: %v", err))
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+// ID returns the unique identifier of the connection.
+func (s *ServerConn) ID() string {
+	return s.id
+}
+
+// Stats returns the snapshot of the connection and its sessions.
+func (s *ServerConn) Stats() ConnStats {
+	s.chansMu.Lock()
+	chans := append([]*Channel(nil), s.chans...)
+	s.chansMu.Unlock()
+
+	stats := ConnStats{
+		ID:         s.id,
+		User:       s.sshcon.User(),
+		RemoteAddr: s.sshcon.RemoteAddr(),
+		Start:      s.start,
+		Sessions:   make([]SessionStats, 0, len(chans)),
+		Resources:  s.resources.snapshot(),
+	}
+
+	for _, c := range chans {
+		stats.Sessions = append(stats.Sessions, c.Stats())
+	}
+
+	s.tunnelsMu.Lock()
+	for t := range s.tunnels {
+		stats.Forwards = append(stats.Forwards, t.stats())
+	}
+	s.tunnelsMu.Unlock()
+
+	return stats
+}
+
+// ID returns the unique identifier of the channel.
+func (c *Channel) ID() string {
+	return c.id
+}
+
+// Stats returns the snapshot of the channel.
+func (c *Channel) Stats() SessionStats {
+	return SessionStats{
+		ID:       c.id,
+		Type:     c.SessionType(),
+		State:    c.session.State(),
+		Start:    c.start,
+		BytesIn:  c.metered.bytesIn.Load(),
+		BytesOut: c.metered.bytesOut.Load(),
+	}
+}
+
+// SessionType returns the type of the program running on the channel: shell, exec, sftp or scp,
+// and empty if no program is started yet.
+func (c *Channel) SessionType() string {
+	return c.session.Type()
+}
+
+// Session returns the program of the channel, with its pty, environment, process and exit status.
+func (c *Channel) Session() *Session {
+	return &c.session
+}
+
+// startProgram starts the session with the program of sessiontype and cmdline, and applies the tap of the session.
+// It must be called before the program uses the channel.
+func (c *Channel) startProgram(sessiontype, cmdline string) {
+	c.session.start(sessiontype, cmdline)
+
+	c.applyTap(sessiontype)
+}
+
+// Close terminates the channel and the program running on it.
+func (c *Channel) Close() error {
+	c.baseCancel()
+
+	var err error
+	if pty, _ := c.session.terminal(); pty != nil {
+		err = pty.Close()
+	}
+
+	if closeErr := c.channel.Close(); err == nil {
+		err = closeErr
+	}
+
+	if isClosedErr(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Conns returns the snapshots of all the active connections.
+func (s *Server) Conns() []ConnStats {
+	conns := s.activeConns()
+
+	stats := make([]ConnStats, 0, len(conns))
+	for _, sc := range conns {
+		stats = append(stats, sc.Stats())
+	}
+
+	return stats
+}
+
+// KickConn terminates the connection with the id.
+func (s *Server) KickConn(id string) error {
+	for _, sc := range s.activeConns() {
+		if sc.id == id {
+			s.logger().Info("kicking connection", "conn_id", id)
+			return sc.closeAll()
+		}
+	}
+
+	return fmt.Errorf("connection %s is not found", id)
+}
+
+// KickSession terminates the session channel with the id, the connection is left open.
+func (s *Server) KickSession(id string) error {
+	for _, sc := range s.activeConns() {
+		sc.chansMu.Lock()
+		var found *Channel
+		for _, c := range sc.chans {
+			if c.id == id {
+				found = c
+				break
+			}
+		}
+		sc.chansMu.Unlock()
+
+		if found != nil {
+			s.logger().Info("kicking session", "conn_id", sc.id, "session_id", id)
+			return found.Close()
+		}
+	}
+
+	return fmt.Errorf("session %s is not found", id)
+}
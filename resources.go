@@ -0,0 +1,110 @@
+package sshd
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// channelBufferSize is the window of the channels of the ssh package, which it buffers for each channel.
+const channelBufferSize = 2 << 20
+
+// DefaultMaxConnChannels is the most session and forwarded channels a connection can have open at once,
+// if Channels of [Server.ConnLimits] is zero.
+const DefaultMaxConnChannels = 100
+
+// errResourcesExhausted is returned when a connection reaches the limits of its resources.
+var errResourcesExhausted = errors.New("connection resources exhausted")
+
+// ConnResources are the approximate resources used by a connection, or their limits where zero means no limit
+// except for Channels.
+type ConnResources struct {
+	// Channels are the open session and forwarded channels.
+	// As a limit, zero is [DefaultMaxConnChannels] and a negative value means no limit.
+	Channels int64
+	// FDs are the file descriptors: the socket of the connection, the ptys, the pipes of the commands,
+	// the sockets of the forwarded connections and the listeners of the remote forwardings.
+	FDs int64
+	// Goroutines are the goroutines serving the connection.
+	Goroutines int64
+	// Memory is the number of bytes the connection can buffer, mostly the windows of the channels and the copy buffers.
+	Memory int64
+}
+
+// the approximate resources taken by each part of a connection.
+var (
+	connCost     = ConnResources{FDs: 1, Goroutines: 3}
+	sessionCost  = ConnResources{Channels: 1, Goroutines: 2, Memory: channelBufferSize}
+	ptyCost      = ConnResources{FDs: 2}
+	commandCost  = ConnResources{FDs: 3, Goroutines: 3, Memory: 2 * copyBufferSize}
+	forwardCost  = ConnResources{Channels: 1, FDs: 1, Goroutines: 3, Memory: channelBufferSize + 2*copyBufferSize}
+	listenerCost = ConnResources{FDs: 1, Goroutines: 1}
+)
+
+// sftpCost is the resources of an sftp server in process, with its workers.
+func sftpCost() ConnResources {
+	return ConnResources{Goroutines: int64(1 + sftp.SftpServerWorkerCount)}
+}
+
+func (r ConnResources) add(other ConnResources, sign int64) ConnResources {
+	return ConnResources{
+		Channels:   r.Channels + sign*other.Channels,
+		FDs:        r.FDs + sign*other.FDs,
+		Goroutines: r.Goroutines + sign*other.Goroutines,
+		Memory:     r.Memory + sign*other.Memory,
+	}
+}
+
+// exceeds checks if r is over any of the limits.
+func (r ConnResources) exceeds(limits ConnResources) bool {
+	return (limits.Channels > 0 && r.Channels > limits.Channels) ||
+		(limits.FDs > 0 && r.FDs > limits.FDs) ||
+		(limits.Goroutines > 0 && r.Goroutines > limits.Goroutines) ||
+		(limits.Memory > 0 && r.Memory > limits.Memory)
+}
+
+// connLimits returns the limits of the resources of each connection, with the default channel limit.
+func (s *Server) connLimits() ConnResources {
+	limits := s.ConnLimits
+	if limits.Channels == 0 {
+		limits.Channels = DefaultMaxConnChannels
+	}
+
+	return limits
+}
+
+// connResources accounts the resources of a connection.
+type connResources struct {
+	mu     sync.Mutex
+	used   ConnResources
+	limits ConnResources
+}
+
+// reserve adds cost to the resources, failing if they would exceed the limits.
+func (c *connResources) reserve(cost ConnResources) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	used := c.used.add(cost, 1)
+	if used.exceeds(c.limits) {
+		return false
+	}
+	c.used = used
+
+	return true
+}
+
+func (c *connResources) release(cost ConnResources) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.used = c.used.add(cost, -1)
+}
+
+func (c *connResources) snapshot() ConnResources {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.used
+}
@@ -0,0 +1,453 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures the access to a bucket of an s3 compatible object storage.
+type S3Config struct {
+	// Endpoint is the url of the storage, such as https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Region is the region of the bucket, defaults to us-east-1.
+	Region string
+	Bucket string
+	// Prefix, if set, is prepended to the keys of the objects, such as users/alice/.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the token of temporary credentials.
+	SessionToken string
+
+	// PathStyle addresses the bucket in the path of the urls instead of the host name,
+	// which most self hosted storages require.
+	PathStyle bool
+
+	// PartSize is the size of the parts of multipart uploads, defaults to 16 MiB and at least 5 MiB.
+	// Smaller files are uploaded at once.
+	PartSize int64
+
+	// Client is the http client, defaults to [http.DefaultClient].
+	Client *http.Client
+}
+
+const (
+	defaultS3PartSize = 16 << 20
+	minS3PartSize     = 5 << 20
+)
+
+// s3Client makes the requests of the s3 api signed with aws signature version 4.
+type s3Client struct {
+	cfg      S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+func newS3Client(cfg S3Config) (*s3Client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	cfg.PartSize = max(cfg.PartSize, minS3PartSize)
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	return &s3Client{cfg: cfg, endpoint: endpoint, now: time.Now}, nil
+}
+
+// s3Error is an error response of the storage.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Status == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.Status == http.StatusForbidden
+	}
+
+	return false
+}
+
+// request builds the signed request for the object key, the bucket itself if empty.
+func (c *s3Client) request(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *c.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/" + key
+	if c.cfg.PathStyle {
+		p = strings.TrimSuffix(u.Path, "/") + "/" + c.cfg.Bucket + "/" + key
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+
+	c.sign(req, body)
+
+	return req, nil
+}
+
+// sign signs the request with aws signature version 4.
+func (c *s3Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+
+	// host, range, content-md5 and the x-amz headers are signed.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s like the canonical requests of aws signature version 4, keeping / unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !escapeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+
+	return b.String()
+}
+
+// s3Query encodes the query sorted by key, as required by the signatures.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// do sends the request, and returns the response if it succeeded, or the error of the storage.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := c.request(ctx, method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3err := &s3Error{Status: resp.StatusCode}
+		if data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil && len(data) > 0 {
+			_ = xml.Unmarshal(data, s3err)
+		}
+		if s3err.Code == "" {
+			s3err.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, s3err
+	}
+
+	return resp, nil
+}
+
+// doXML sends the request and decodes the xml response into v.
+func (c *s3Client) doXML(ctx context.Context, method, key string, query url.Values, body []byte, v any) error {
+	resp, err := c.do(ctx, method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode s3 response: %w", err)
+	}
+
+	return nil
+}
+
+// s3Object is the metadata of an object.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+func (c *s3Client) head(ctx context.Context, key string) (*s3Object, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	obj := &s3Object{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.LastModified = t
+	}
+
+	return obj, nil
+}
+
+// getRange reads the object from off into b.
+func (c *s3Client) getRange(ctx context.Context, key string, b []byte, off int64) (int, error) {
+	header := http.Header{"Range": {"bytes=" + strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(off+int64(len(b))-1, 10)}}
+	resp, err := c.do(ctx, http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (c *s3Client) put(ctx context.Context, key string, body []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// copy copies the object at src to dst in the bucket.
+func (c *s3Client) copy(ctx context.Context, src, dst string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(c.cfg.Bucket, false) + "/" + s3Escape(src, false)}}
+	resp, err := c.do(ctx, http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a copy can fail after the status is sent, with the error in the body.
+	var result struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		result.s3Error.Status = http.StatusInternalServerError
+		return &result.s3Error
+	}
+
+	return nil
+}
+
+// s3Listing is a page of the objects and the common prefixes under a prefix.
+type s3Listing struct {
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []string   `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// list lists the objects under prefix, grouped by the delimiter if set, up to limit if positive.
+func (c *s3Client) list(ctx context.Context, prefix, delimiter string, limit int) (*s3Listing, error) {
+	var all s3Listing
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if limit > 0 {
+		query.Set("max-keys", strconv.Itoa(limit))
+	}
+
+	for {
+		var page s3Listing
+		if err := c.doXML(ctx, http.MethodGet, "", query, nil, &page); err != nil {
+			return nil, err
+		}
+		all.Contents = append(all.Contents, page.Contents...)
+		all.CommonPrefixes = append(all.CommonPrefixes, page.CommonPrefixes...)
+
+		if !page.IsTruncated || page.NextContinuationToken == "" || (limit > 0 && len(all.Contents)+len(all.CommonPrefixes) >= limit) {
+			return &all, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// s3Upload is a multipart upload.
+type s3Upload struct {
+	client   *s3Client
+	key      string
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *s3Client) createUpload(ctx context.Context, key string) (*s3Upload, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return nil, err
+	}
+
+	return &s3Upload{client: c, key: key, uploadID: result.UploadID}, nil
+}
+
+func (u *s3Upload) uploadPart(ctx context.Context, body []byte) error {
+	number := len(u.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {u.uploadID}}
+	resp, err := u.client.do(ctx, http.MethodPut, u.key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	u.parts = append(u.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+	return nil
+}
+
+func (u *s3Upload) complete(ctx context.Context) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := u.client.doXML(ctx, http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}}, body, &result); err != nil {
+		return err
+	}
+	// like copies, completing can fail after the status is sent.
+	if result.XMLName.Local == "Error" {
+		result.s3Error.Status = http.StatusInternalServerError
+		return &result.s3Error
+	}
+
+	return nil
+}
+
+func (u *s3Upload) abort(ctx context.Context) error {
+	resp, err := u.client.do(ctx, http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
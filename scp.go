@@ -0,0 +1,494 @@
+package sshd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scpArgs are the arguments of the remote end of scp.
+type scpArgs struct {
+	// sink is set by -t, the client sends files to the server. Otherwise -f, the server sends files.
+	sink bool
+	// recursive is set by -r.
+	recursive bool
+	// preserve is set by -p, the modification and access times are transferred.
+	preserve bool
+	// targetDir is set by -d, the target must be a directory.
+	targetDir bool
+	paths     []string
+}
+
+// parseSCPCommand parses the command run by scp clients on the server, such as scp -t /tmp.
+func parseSCPCommand(command string) (*scpArgs, bool) {
+	words, err := splitShellWords(command)
+	if err != nil || len(words) < 2 || words[0] != "scp" {
+		return nil, false
+	}
+
+	args := &scpArgs{}
+	mode := false
+
+	i := 1
+	for ; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			break
+		}
+
+		for _, flag := range word[1:] {
+			switch flag {
+			case 't':
+				args.sink, mode = true, true
+			case 'f':
+				mode = true
+			case 'r':
+				args.recursive = true
+			case 'p':
+				args.preserve = true
+			case 'd':
+				args.targetDir = true
+			case 'v', 'q', 'E':
+			default:
+				return nil, false
+			}
+		}
+	}
+
+	args.paths = words[i:]
+	if !mode || len(args.paths) == 0 || (args.sink && len(args.paths) != 1) {
+		return nil, false
+	}
+
+	return args, true
+}
+
+// splitShellWords splits command into words like a posix shell, without expansions.
+func splitShellWords(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(command); i++ {
+		ch := command[i]
+		switch {
+		case ch == '\\':
+			i++
+			if i == len(command) {
+				return nil, errors.New("trailing backslash")
+			}
+			word.WriteByte(command[i])
+			inWord = true
+
+		case ch == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case ch == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("\\\"$`", command[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(command[i])
+			}
+			if i == len(command) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// serveSCP runs the scp protocol on the channel in process.
+func (c *Channel) serveSCP(command string, args *scpArgs) {
+	c.startProgram("scp", command)
+
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+		defer c.startSession("scp")()
+
+		s := &scpSession{
+			args: args,
+			r:    bufio.NewReader(c.channel),
+			w:    c.channel,
+			dir:  c.srv.workingDir(&c.user.User),
+		}
+
+		var err error
+		if args.sink {
+			err = s.sink()
+		} else {
+			err = s.source()
+		}
+
+		exitcode := uint32(0)
+		if err != nil || s.failed {
+			c.logger.Info("scp failed", "err", fmt.Sprint(err))
+			exitcode = 1
+		}
+
+		c.finishSession(exitcode, 0)
+	}()
+}
+
+// scpSession is one run of the scp protocol.
+type scpSession struct {
+	args *scpArgs
+	r    *bufio.Reader
+	w    io.Writer
+	// dir is the directory relative paths are resolved against.
+	dir string
+	// failed is set if any file failed, which fails the session without stopping it.
+	failed bool
+}
+
+func (s *scpSession) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(s.dir, p)
+}
+
+func (s *scpSession) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn reports a non fatal error to the client.
+func (s *scpSession) warn(err error) error {
+	s.failed = true
+	_, werr := fmt.Fprintf(s.w, "\x01scp: %s\n", err.Error())
+	return werr
+}
+
+// readAck reads the response of the client, returning the error it reports.
+func (s *scpSession) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if b == 0 {
+		return nil
+	}
+
+	msg, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("client error: %s", strings.TrimSpace(msg))
+}
+
+// sink receives files from the client into the target path.
+func (s *scpSession) sink() error {
+	target := s.path(s.args.paths[0])
+
+	fi, err := os.Stat(target)
+	targetIsDir := err == nil && fi.IsDir()
+	if s.args.targetDir && !targetIsDir {
+		return s.warn(fmt.Errorf("%s: not a directory", target))
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	// dirs is the stack of the directories entered by D, with target at the bottom if it is a directory.
+	var dirs []string
+	if targetIsDir {
+		dirs = append(dirs, target)
+	}
+	var mtime, atime time.Time
+
+	destination := func(name string) string {
+		if len(dirs) == 0 {
+			return target
+		}
+		return filepath.Join(dirs[len(dirs)-1], name)
+	}
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("empty scp command")
+		}
+
+		switch line[0] {
+		case 'T':
+			var mtimeSec, mtimeUsec, atimeSec, atimeUsec int64
+			if _, err := fmt.Sscanf(line[1:], "%d %d %d %d", &mtimeSec, &mtimeUsec, &atimeSec, &atimeUsec); err != nil {
+				return fmt.Errorf("invalid scp times %q: %w", line, err)
+			}
+			mtime, atime = time.Unix(mtimeSec, mtimeUsec*1000), time.Unix(atimeSec, atimeUsec*1000)
+			if err := s.ack(); err != nil {
+				return err
+			}
+
+		case 'C', 'D':
+			mode, size, name, err := parseSCPHeader(line)
+			if err != nil {
+				return err
+			}
+			path := destination(name)
+
+			if line[0] == 'D' {
+				if !s.args.recursive {
+					return s.warn(fmt.Errorf("%s: received directory without -r", name))
+				}
+				if err := os.Mkdir(path, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+					if err := s.warn(err); err != nil {
+						return err
+					}
+					// the client doesn't send the content of the directory after an error.
+					continue
+				}
+				if !mtime.IsZero() {
+					_ = os.Chtimes(path, atime, mtime)
+				}
+				mtime, atime = time.Time{}, time.Time{}
+				dirs = append(dirs, path)
+				if err := s.ack(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := s.ack(); err != nil {
+				return err
+			}
+
+			writeErr := s.receiveFile(path, mode, size)
+			if err := s.readAck(); err != nil {
+				return err
+			}
+			if writeErr == nil && !mtime.IsZero() {
+				writeErr = os.Chtimes(path, atime, mtime)
+			}
+			mtime, atime = time.Time{}, time.Time{}
+
+			if writeErr != nil {
+				if err := s.warn(writeErr); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+
+		case 'E':
+			if len(dirs) == 0 || (targetIsDir && len(dirs) == 1) {
+				return errors.New("unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := s.ack(); err != nil {
+				return err
+			}
+
+		case 1, 2:
+			s.failed = true
+			if line[0] == 2 {
+				return fmt.Errorf("client error: %s", line[1:])
+			}
+
+		default:
+			return fmt.Errorf("unknown scp command %q", line)
+		}
+	}
+}
+
+// receiveFile writes the size bytes of the file sent by the client to path.
+// The content is consumed even if the file cannot be written, to keep the protocol in sync.
+func (s *scpSession) receiveFile(path string, mode fs.FileMode, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		_, _ = io.CopyN(io.Discard, s.r, size)
+		return err
+	}
+
+	if _, err := io.CopyN(f, s.r, size); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// parseSCPHeader parses the C and D lines, such as C0644 1024 name.
+func parseSCPHeader(line string) (fs.FileMode, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid scp header %q", line)
+	}
+
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid mode in scp header %q", line)
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size in scp header %q", line)
+	}
+
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid name in scp header %q", line)
+	}
+
+	return fs.FileMode(mode) & fs.ModePerm, size, name, nil
+}
+
+// source sends the files to the client.
+func (s *scpSession) source() error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	for _, p := range s.args.paths {
+		if err := s.send(s.path(p)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send sends the file or directory at path, the returned errors are fatal for the protocol.
+func (s *scpSession) send(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return s.warn(err)
+	}
+
+	if s.args.preserve {
+		mtime := fi.ModTime()
+		if _, err := fmt.Fprintf(s.w, "T%d %d %d 0\n", mtime.Unix(), mtime.Nanosecond()/1000, mtime.Unix()); err != nil {
+			return err
+		}
+		if err := s.readAck(); err != nil {
+			return err
+		}
+	}
+
+	if fi.IsDir() {
+		if !s.args.recursive {
+			return s.warn(fmt.Errorf("%s: not a regular file", path))
+		}
+		return s.sendDir(path, fi)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return s.warn(fmt.Errorf("%s: not a regular file", path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return s.warn(err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(s.w, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), filepath.Base(path)); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	// the size is announced already, a file shrinking meanwhile is padded to keep the protocol in sync.
+	n, err := io.CopyN(s.w, f, fi.Size())
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n < fi.Size() {
+		if _, err := io.CopyN(s.w, zeroReader{}, fi.Size()-n); err != nil {
+			return err
+		}
+		if err := s.warn(fmt.Errorf("%s: file has shrunk", path)); err != nil {
+			return err
+		}
+	} else if err := s.ack(); err != nil {
+		return err
+	}
+
+	return s.readAck()
+}
+
+func (s *scpSession) sendDir(path string, fi fs.FileInfo) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return s.warn(err)
+	}
+
+	if _, err := fmt.Fprintf(s.w, "D%04o 0 %s\n", fi.Mode().Perm(), filepath.Base(path)); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := s.send(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.WriteString(s.w, "E\n"); err != nil {
+		return err
+	}
+
+	return s.readAck()
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,823 @@
+package sshd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrServerClosed is returned by [Server.Serve] and [Server.ListenAndServe]
+// after a call to [Server.Shutdown] or [Server.Close].
+var ErrServerClosed = errors.New("sshd: server closed")
+
+// DefaultMaxCommandLength is the longest command of exec requests if none is configured,
+// the longest argument of the linux kernel.
+const DefaultMaxCommandLength = 128 << 10
+
+// Server accepts connections on its listeners and serves each of them with a [ServerConn].
+//
+// The zero value is not usable, Config must be set before serving.
+type Server struct {
+	// Config is the ssh server configuration used for the handshake of every accepted connection.
+	Config *ssh.ServerConfig
+
+	// Shell is the shell to run for shell and exec requests, defaults to bash.
+	// It can be any interpreter accepting -c with a command, such as /bin/sh or /usr/bin/rbash.
+	Shell string
+	// ShellFunc, if set, returns the shell of the sessions of u, overriding Shell unless it returns empty.
+	ShellFunc func(u *UserInfo) string
+	// MaxCommandLength is the longest command of exec requests, defaults to [DefaultMaxCommandLength].
+	MaxCommandLength int
+
+	// WorkingDir is the working directory of the sessions, defaults to the home directory of the user.
+	WorkingDir string
+	// WorkingDirFunc, if set, returns the working directory of the sessions of u, overriding WorkingDir.
+	WorkingDirFunc func(u *user.User) string
+
+	// DisableSFTP rejects the sftp subsystem.
+	DisableSFTP bool
+	// ExecHandler, if set, runs the exec requests instead of the shell.
+	ExecHandler ExecHandler
+	// AuditLog, if set, receives every channel open, channel request and global request as a json line of [AuditRecord],
+	// for forensics independent of Logger.
+	AuditLog io.Writer
+	// Honeypot, if set, accepts any credentials and serves a fake shell, see [Honeypot].
+	Honeypot *Honeypot
+
+	// BuiltinSCP serves the scp requests in process instead of running the scp of the system,
+	// unless the sessions run as another user.
+	BuiltinSCP bool
+	// SFTPServer, if set, is the command of an external sftp server, such as /usr/lib/openssh/sftp-server,
+	// run as the user for the sftp subsystem instead of the server in this process.
+	// It is required for sftp if the server runs as root and the users are not.
+	SFTPServer string
+
+	// SFTPHandlers, if set, returns the handlers serving sftp for the authenticated connection in process,
+	// instead of the local filesystem, for example to serve a virtual filesystem or an object store.
+	// Returning an error rejects the sftp subsystem. SFTPServer and SFTPRoot are ignored.
+	// The handlers serve the posix-rename and statvfs extensions if the FileCmd implements
+	// [sftp.PosixRenameFileCmder] and [sftp.StatVFSFileCmder].
+	SFTPHandlers func(info ConnInfo) (sftp.Handlers, error)
+
+	// AcceptEnv are the patterns of the environment variables the clients can set, defaults to [DefaultAcceptEnv].
+	// Patterns can contain * and ?, and be negated with !.
+	AcceptEnv []string
+	// MaxEnvLength is the longest environment variable the clients can set, the name and the value together,
+	// defaults to [DefaultMaxEnvLength].
+	MaxEnvLength int
+	// MaxEnvCount is the most environment variables the clients can set in a session,
+	// defaults to [DefaultMaxEnvCount].
+	MaxEnvCount int
+
+	// Env are the environment variables in the form of key=value set for every session,
+	// which override the ones sent by the clients.
+	Env []string
+	// UserEnv, if set, returns the environment variables added to the sessions of the authenticated connection,
+	// which override Env.
+	UserEnv func(info ConnInfo) []string
+	// EnvironmentFile, if set, is read for the environment variables of every session, see [DefaultEnvironmentFile].
+	EnvironmentFile string
+
+	// Features controls the features available to the sessions.
+	Features Features
+	// UserFeatures, if set, returns the features available to the authenticated connection, replacing Features.
+	UserFeatures func(info ConnInfo) Features
+
+	// VersionFunc, if set, returns the identification string announced to every new connection,
+	// overriding ServerVersion of Config. See [RandomServerVersion].
+	VersionFunc func() string
+
+	// UseDNS resolves the host names of the clients by reverse dns, see [Server.RemoteHost].
+	UseDNS bool
+
+	// Algorithms, if set, restricts the algorithms negotiated with the clients.
+	Algorithms *AlgorithmPolicy
+
+	// TCP are the socket options applied to the accepted tcp connections.
+	TCP TCPOptions
+
+	// SessionIdleTimeout, if positive, closes the sessions without any input or output for the duration.
+	SessionIdleTimeout time.Duration
+	// SessionMaxDuration, if positive, closes the sessions open for longer than the duration.
+	SessionMaxDuration time.Duration
+	// SessionTimeoutWarning is how long before either session timeout the interactive sessions are warned,
+	// defaults to one minute, negative for no warning.
+	SessionTimeoutWarning time.Duration
+
+	// IdleTimeout, if positive, closes the connections that have not received anything for the duration.
+	IdleTimeout time.Duration
+
+	// ClientAliveInterval, if positive, is the interval to probe the client with keepalive requests.
+	ClientAliveInterval time.Duration
+	// ClientAliveCountMax is the number of unanswered probes after which the connection is closed, defaults to 3.
+	ClientAliveCountMax int
+
+	// Logger is used for the logs of the server, defaults to the package logger set by [SetLogger].
+	Logger *slog.Logger
+
+	// Geo, if set, filters the connections by the country of their addresses, see [GeoFilter].
+	Geo *GeoFilter
+
+	// KnockGate, if set, closes the connections from the addresses it hasn't admitted before the server sends anything.
+	// [KnockGate.Serve] must run for addresses to be admitted.
+	KnockGate *KnockGate
+
+	// MaxSessions, if positive, is the maximum number of open session channels per connection.
+	MaxSessions int
+	// MaxForwards, if positive, is the maximum number of concurrent forwarded connections per connection,
+	// in both directions. The local forwardings over the limit are rejected,
+	// and the connections to the remote forwardings wait to be accepted.
+	MaxForwards int
+	// MaxTotalSessions, if positive, is the maximum number of open session channels of all the connections.
+	MaxTotalSessions int
+	// MaxTotalForwards, if positive, is the maximum number of concurrent forwarded connections of all the connections.
+	MaxTotalForwards int
+	// ConnLimits limits the approximate resources of each connection, see [ConnStats.Resources].
+	// The sessions, ptys, commands and forwardings over the limits are rejected.
+	// The open channels are limited to [DefaultMaxConnChannels] unless Channels is set.
+	ConnLimits ConnResources
+
+	// MaxStartups limits the number of concurrent unauthenticated connections.
+	MaxStartups MaxStartups
+
+	// PerSourceMaxStartups, if positive, is the maximum number of concurrent unauthenticated connections
+	// from the same source address.
+	PerSourceMaxStartups int
+
+	// LoginGraceTime, if positive, is the time for a client to finish the handshake and authentication.
+	LoginGraceTime time.Duration
+
+	// TracerProvider provides the tracer for the spans of connections and sessions,
+	// defaults to the global provider of opentelemetry.
+	TracerProvider trace.TracerProvider
+
+	// Cgroup, if set, limits the resources of each session with a cgroup v2.
+	Cgroup *CgroupLimits
+
+	// MOTD, if set, prints the message of the day at the start of shell sessions.
+	MOTD *MOTDOptions
+
+	// ForwardRateLimit, if positive, limits the bytes per second in each direction of each forwarded connection.
+	ForwardRateLimit int64
+	// UserForwardRateLimit, if positive, limits the bytes per second in each direction
+	// of all the forwarded connections of a user together.
+	UserForwardRateLimit int64
+
+	// SFTPRateLimit, if positive, limits the bytes per second uploaded and downloaded by each sftp session.
+	SFTPRateLimit int64
+	// UserSFTPRateLimit, if positive, limits the bytes per second uploaded and downloaded
+	// by all the sftp sessions of a user together.
+	UserSFTPRateLimit int64
+
+	// StreamLocalPolicy, if set, checks the unix socket paths the clients forward connections to,
+	// returning an error rejects the forwarding. See [AllowStreamLocalPaths].
+	StreamLocalPolicy func(info ConnInfo, path string) error
+
+	// GlobalRequestHandlers handle the global requests of the connections by request type,
+	// replacing the builtin handlers of the same type. Other global requests are rejected.
+	GlobalRequestHandlers map[string]GlobalRequestHandler
+
+	// ChannelRequestHandlers handle the requests of the session channels by request type,
+	// replacing the builtin handlers of the same type. Other requests are rejected.
+	// See [DefaultChannelRequestHandler] for the builtin ones.
+	ChannelRequestHandlers map[string]ChannelRequestHandler
+
+	// Users looks up the accounts of the authenticated users, defaults to [OSUsers].
+	Users UserBackend
+
+	// PAMService, if set, is the pam service opening a pam session around each program of the sessions,
+	// such as sshd. It requires building with the pam tag on linux.
+	PAMService string
+
+	// RecordLogins records the interactive sessions in utmp, wtmp and lastlog,
+	// so they are listed by who and last like the ones of openssh.
+	RecordLogins bool
+
+	// Recording, if set, records the interactive sessions.
+	Recording *RecordingOptions
+
+	// Tap, if set, returns the tap wrapping the streams of a session of the given type,
+	// such as shell, exec, sftp or scp, and nil to leave the session untouched.
+	Tap func(info ConnInfo, sessionType string) *IOTap
+
+	// Hooks are called at the stages of the lifecycle of the connections.
+	Hooks Hooks
+
+	// Metrics, if set, collects the metrics of the server.
+	Metrics *Metrics
+
+	// ShutdownMessage, if not empty, is written to the terminals of interactive sessions when the server shuts down.
+	ShutdownMessage string
+
+	mu sync.Mutex
+	// listeners are the listeners created by Listen or passed to ServeListener,
+	// the value indicates if the listener is being served.
+	listeners map[net.Listener]bool
+	// conns are the connections being served.
+	conns map[*ServerConn]struct{}
+
+	// hostKeys, if set, replaces the host keys in Config for new connections.
+	hostKeys atomic.Pointer[[]ssh.Signer]
+	// configHostKeys are the host keys added to Config by the options.
+	configHostKeys []ssh.Signer
+
+	// auditMu serializes the lines of AuditLog.
+	auditMu sync.Mutex
+
+	// startups is the number of connections in handshake or authentication.
+	startups atomic.Int64
+	// sessionCount is the number of open session channels.
+	sessionCount atomic.Int64
+	// forwardCount is the number of forwarded connections.
+	forwardCount atomic.Int64
+	// forwardBuckets are the token buckets limiting the forwardings of the users, protected by mu.
+	forwardBuckets map[string]*[2]*tokenBucket
+	// sftpBuckets are the token buckets limiting the sftp sessions of the users, protected by mu.
+	sftpBuckets map[string]*[2]*tokenBucket
+	// sftpUsages are the storage usages of the users with sftp sessions under quota, protected by mu.
+	sftpUsages map[string]*sftpUsage
+
+	// sourceStartups is the number of connections in handshake or authentication by source address.
+	sourceStartups map[string]int
+
+	// inShutdown is set once Shutdown or Close is called.
+	inShutdown atomic.Bool
+
+	// wg is used to wait for all the connection goroutines
+	wg sync.WaitGroup
+}
+
+// Listen creates a tcp listener on addr for the server to serve on.
+// It can be called multiple times to listen on several addresses.
+func (s *Server) Listen(addr string) error {
+	if addr == "" {
+		addr = ":22"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	return s.addListener(l, false)
+}
+
+// ListenTLS creates a tcp listener on addr terminating tls before the ssh handshake,
+// so the server can be reached on 443 through networks only letting tls out.
+// config selects the certificate by sni with Certificates or GetCertificate,
+// and verifies the certificates of the clients with ClientAuth and ClientCAs.
+// Clients connect through a tls tunnel, such as ProxyCommand running openssl s_client.
+func (s *Server) ListenTLS(addr string, config *tls.Config) error {
+	if addr == "" {
+		addr = ":443"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	return s.addListener(tls.NewListener(l, config), false)
+}
+
+// ListenUnix creates a unix domain socket listener at path with the file permission perm.
+// A stale socket left at path is removed.
+func (s *Server) ListenUnix(path string, perm os.FileMode) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("socket %s is in use", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set permission of %s: %w", path, err)
+	}
+
+	return s.addListener(l, false)
+}
+
+func (s *Server) addListener(l net.Listener, served bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[l] = served
+
+	return nil
+}
+
+// Addrs returns the addresses of all the listeners.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+
+	return addrs
+}
+
+// Serve accepts connections on all the listeners created by [Server.Listen] or [Server.ListenUnix] concurrently.
+// Listeners created after Serve is called are not served.
+// ctx is the parent context of all the accepted connections.
+//
+// It returns after all the listeners stop. If any of them fails, the others are closed too.
+// The returned error is always non-nil, which is [ErrServerClosed] after the server is shut down.
+func (s *Server) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	listeners := make([]net.Listener, 0, len(s.listeners))
+	for l, served := range s.listeners {
+		if !served {
+			listeners = append(listeners, l)
+			s.listeners[l] = true
+		}
+	}
+	s.mu.Unlock()
+
+	if len(listeners) == 0 {
+		return errors.New("server is not listening")
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- s.serve(ctx, l)
+		}()
+	}
+
+	var firstErr error
+	for range listeners {
+		err := <-errs
+		if firstErr != nil {
+			continue
+		}
+
+		firstErr = err
+		if !errors.Is(err, ErrServerClosed) {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// ServeListener accepts connections on l. The server takes the ownership of l.
+// It can be called concurrently for different listeners.
+func (s *Server) ServeListener(ctx context.Context, l net.Listener) error {
+	if err := s.addListener(l, true); err != nil {
+		return err
+	}
+
+	return s.serve(ctx, l)
+}
+
+// ListenAndServe listens on the tcp addresses addrs and then serves the connections.
+func (s *Server) ListenAndServe(addrs ...string) error {
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+
+	for _, addr := range addrs {
+		if err := s.Listen(addr); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+
+	return s.Serve(context.Background())
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener) error {
+	if s.Config == nil {
+		return errors.New("server config is nil")
+	}
+
+	var tempDelay time.Duration
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				tempDelay = min(tempDelay, time.Second)
+
+				s.logger().Info("failed to accept connection, retrying", "err", err.Error(), "delay", tempDelay)
+
+				select {
+				case <-time.After(tempDelay):
+					continue
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		tempDelay = 0
+
+		if !s.admitConn(conn) {
+			continue
+		}
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// admitConn checks the accepted conn against the knock gate, MaxStartups and the shutdown, and closes it if it is dropped.
+// An admitted conn is added to wg, and must be marked done once served.
+// It is counted in startups right away, until serveConn finishes its handshake.
+func (s *Server) admitConn(conn net.Conn) bool {
+	if s.KnockGate != nil && !s.KnockGate.Admitted(conn.RemoteAddr()) {
+		s.logger().Debug("dropping connection not admitted by knock gate", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+
+	s.Metrics.connAccepted()
+
+	if s.MaxStartups.shouldDrop(int(s.startups.Load())) {
+		s.logger().Info("dropping connection because of MaxStartups", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+
+	// the shutdown is set under mu too, so wg is not added to once Shutdown waits for it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		conn.Close()
+		return false
+	}
+	s.wg.Add(1)
+	s.startups.Add(1)
+
+	return true
+}
+
+// startShutdown stops admitting new connections.
+func (s *Server) startShutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inShutdown.Store(true)
+}
+
+// serveConn does the handshake on conn and serves it until it finishes.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	// the login grace time runs from the accept, so the lookups and the hooks before the handshake count too.
+	dconn := &deadlineConn{Conn: conn, idleTimeout: s.IdleTimeout}
+	if s.LoginGraceTime > 0 {
+		dconn.handshakeDeadline.Store(time.Now().Add(s.LoginGraceTime).UnixNano())
+	}
+
+	if !s.acquireSourceStartup(conn.RemoteAddr()) {
+		s.startups.Add(-1)
+		s.logger().Info("dropping connection because of PerSourceMaxStartups", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	endStartup := sync.OnceFunc(func() {
+		s.startups.Add(-1)
+		s.releaseSourceStartup(conn.RemoteAddr())
+	})
+	defer endStartup()
+
+	if err := s.TCP.apply(conn); err != nil {
+		s.logger().Info("failed to set socket options", "err", err.Error(), "remote", conn.RemoteAddr().String())
+	}
+
+	// the name is resolved before the handshake, so it is cached for the authentication callbacks.
+	remoteHost := s.RemoteHost(conn.RemoteAddr())
+
+	country := s.Geo.country(conn.RemoteAddr())
+	if err := s.Geo.check(country); err != nil {
+		s.logger().Info("connection is rejected", "err", err.Error(), "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	if s.Hooks.OnConnect != nil {
+		err := s.Hooks.OnConnect(ConnInfo{RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr(), RemoteHost: remoteHost, Country: country})
+		if err != nil {
+			s.logger().Info("connection is rejected", "err", err.Error(), "remote", conn.RemoteAddr().String())
+			conn.Close()
+			return
+		}
+	}
+
+	ctx, connSpan := s.tracer().Start(ctx, "sshd.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("net.peer.addr", conn.RemoteAddr().String())))
+	defer connSpan.End()
+
+	_, handshakeSpan := s.tracer().Start(ctx, "sshd.handshake")
+
+	sc, err := s.handshake(ctx, dconn)
+	endStartup()
+	dconn.finishHandshake()
+
+	if err != nil {
+		handshakeSpan.RecordError(err)
+		handshakeSpan.SetStatus(codes.Error, "handshake failed")
+		handshakeSpan.End()
+		connSpan.SetStatus(codes.Error, "handshake failed")
+
+		s.logger().Info("failed to establish connection", "err", err.Error(), "remote", conn.RemoteAddr().String())
+		return
+	}
+
+	handshakeSpan.End()
+	connSpan.SetAttributes(attribute.String("ssh.user", sc.sshcon.User()))
+
+	if !s.trackConn(sc, true) {
+		sc.Close()
+		return
+	}
+	defer s.trackConn(sc, false)
+
+	if err := sc.LoopContext(ctx); err != nil {
+		sc.logger.Info("connection ended abnormally", "err", err.Error())
+	}
+
+	if err := sc.Close(); err != nil {
+		sc.logger.Debug("error in closing connection", "err", err.Error())
+	}
+
+	if s.Hooks.OnDisconnect != nil {
+		s.Hooks.OnDisconnect(sc.Info())
+	}
+}
+
+// shell returns the shell of the sessions of u.
+func (s *Server) shell(u *UserInfo) string {
+	if s.ShellFunc != nil {
+		if shell := s.ShellFunc(u); shell != "" {
+			return shell
+		}
+	}
+
+	if s.Shell == "" {
+		return "bash"
+	}
+
+	return s.Shell
+}
+
+// maxCommandLength returns the longest command of exec requests.
+func (s *Server) maxCommandLength() int {
+	if s.MaxCommandLength <= 0 {
+		return DefaultMaxCommandLength
+	}
+
+	return s.MaxCommandLength
+}
+
+// workingDir returns the working directory of the sessions of u.
+func (s *Server) workingDir(u *user.User) string {
+	switch {
+	case s.WorkingDirFunc != nil:
+		return s.WorkingDirFunc(u)
+	case s.WorkingDir != "":
+		return s.WorkingDir
+	default:
+		return u.HomeDir
+	}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return log
+	}
+
+	return s.Logger
+}
+
+// handshake checks the identification of the client, and then does the ssh handshake and authentication.
+func (s *Server) handshake(ctx context.Context, conn net.Conn) (*ServerConn, error) {
+	identconn, err := readClientIdent(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newServerConn(ctx, identconn, s.connConfig(), s)
+}
+
+// connConfig returns the ssh server configuration for a new connection.
+func (s *Server) connConfig() *ssh.ServerConfig {
+	var config *ssh.ServerConfig
+
+	if hostKeys := s.hostKeys.Load(); hostKeys != nil {
+		// host keys are unexported in ssh.ServerConfig, and AddHostKey may overwrite the shared slice of a shallow copy,
+		// so the exported fields are copied one by one.
+		config = &ssh.ServerConfig{
+			Config:                      s.Config.Config,
+			PublicKeyAuthAlgorithms:     s.Config.PublicKeyAuthAlgorithms,
+			NoClientAuth:                s.Config.NoClientAuth,
+			NoClientAuthCallback:        s.Config.NoClientAuthCallback,
+			MaxAuthTries:                s.Config.MaxAuthTries,
+			PasswordCallback:            s.Config.PasswordCallback,
+			PublicKeyCallback:           s.Config.PublicKeyCallback,
+			KeyboardInteractiveCallback: s.Config.KeyboardInteractiveCallback,
+			AuthLogCallback:             s.Config.AuthLogCallback,
+			ServerVersion:               s.Config.ServerVersion,
+			BannerCallback:              s.Config.BannerCallback,
+			GSSAPIWithMICConfig:         s.Config.GSSAPIWithMICConfig,
+		}
+
+		for _, signer := range *hostKeys {
+			config.AddHostKey(signer)
+		}
+	} else {
+		c := *s.Config
+		config = &c
+	}
+
+	if s.Algorithms != nil {
+		s.Algorithms.apply(config)
+	}
+
+	if v := s.serverVersion(); v != "" {
+		config.ServerVersion = v
+	}
+
+	if s.Honeypot != nil {
+		s.Honeypot.configure(config, s.logger())
+	}
+
+	if s.Metrics != nil {
+		authLog := config.AuthLogCallback
+		config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+			// clients always try none first to find out the supported methods.
+			if err != nil && method != "none" {
+				s.Metrics.authFailed(method)
+			}
+			if authLog != nil {
+				authLog(conn, method, err)
+			}
+		}
+	}
+
+	return config
+}
+
+// trackConn adds or removes the connection from the served connections.
+// It returns false if the connection cannot be added because the server is shutting down.
+func (s *Server) trackConn(sc *ServerConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, sc)
+		return true
+	}
+
+	if s.inShutdown.Load() {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[*ServerConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+
+	return true
+}
+
+// closeListeners closes all the listeners so no new connection will be accepted.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make([]error, 0, len(s.listeners))
+	for l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown gracefully shuts the server down.
+// It stops accepting new connections, rejects new channels on the existing connections,
+// writes [Server.ShutdownMessage] to the interactive sessions,
+// and then waits for the sessions to finish or ctx to be done, whichever comes first.
+// Connections still active when ctx is done are forcefully closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.startShutdown()
+
+	errs := []error{s.closeListeners()}
+
+	conns := s.activeConns()
+
+	var errsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, sc := range conns {
+		if s.ShutdownMessage != "" {
+			sc.Notify(s.ShutdownMessage)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sc.Shutdown(ctx)
+
+			errsMu.Lock()
+			defer errsMu.Unlock()
+			errs = append(errs, err)
+		}()
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close immediately closes the listener and all the connections.
+func (s *Server) Close() error {
+	s.startShutdown()
+
+	errs := []error{s.closeListeners()}
+
+	for _, sc := range s.activeConns() {
+		errs = append(errs, sc.closeAll())
+	}
+
+	return errors.Join(errs...)
+}
+
+// activeConns returns a snapshot of the connections being served.
+func (s *Server) activeConns() []*ServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*ServerConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+
+	return conns
+}
@@ -2,13 +2,21 @@ package sshd
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
-	"os/user"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -23,35 +31,132 @@ type ServerConn struct {
 	baseCtx    context.Context
 	baseCancel context.CancelFunc
 
-	chans []*Channel
+	// chansMu protects chans
+	chansMu sync.Mutex
+	chans   []*Channel
 
 	wg sync.WaitGroup
 
-	user *user.User
+	// forwardsMu protects forwards
+	forwardsMu sync.Mutex
+	// forwards are the listeners of the remote forwardings.
+	forwards map[string]net.Listener
+
+	// tunnelsMu protects tunnels
+	tunnelsMu sync.Mutex
+	// tunnels are the active forwarded connections.
+	tunnels map[*tunnel]struct{}
+	// forwardCount is the number of forwarded connections, including the ones not connected yet.
+	forwardCount atomic.Int64
+
+	// draining is set once Shutdown is called, new channels are rejected afterwards.
+	draining atomic.Bool
+
+	user *UserInfo
+
+	// srv holds the settings of the server this connection belongs to.
+	srv *Server
+	// features are the features available to the sessions of this connection.
+	features Features
+	// hostKeys are the host keys announced to the client.
+	hostKeys []ssh.Signer
+	// env are the environment variables set by the server for the sessions of this connection.
+	env []string
+
+	// id uniquely identifies the connection
+	id string
+	// start is the time the connection is established
+	start time.Time
+	// chanSeq is used to generate the ids of the channels
+	chanSeq atomic.Uint64
+
+	// resources accounts the resources used by the connection.
+	resources connResources
+
+	// tlsState is the state of the tls connection for the connections accepted by [Server.ListenTLS], nil otherwise.
+	tlsState *tls.ConnectionState
+
+	// logger is the logger of this connection, with the id, user and remote address attached.
+	logger *slog.Logger
+}
+
+// SetLogger sets the logger of the connection.
+// Channels opened afterwards derive their loggers from it.
+func (s *ServerConn) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// Logger returns the logger of the connection.
+func (s *ServerConn) Logger() *slog.Logger {
+	return s.logger
 }
 
 func NewFromConn(ctx context.Context, conn net.Conn, config *ssh.ServerConfig) (*ServerConn, error) {
+	return newServerConn(ctx, conn, config, &Server{Config: config})
+}
+
+func newServerConn(ctx context.Context, conn net.Conn, config *ssh.ServerConfig, srv *Server) (*ServerConn, error) {
+	authMethod := srv.Hooks.recordAuth(config)
+
 	sshconn, newchanchan, request, err := ssh.NewServerConn(conn, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a new connection: %w", err)
 	}
 
-	user, err := user.Lookup(sshconn.User())
+	user, err := srv.lookupUser(sshconn.User())
 	if err != nil {
 		sshconn.Close()
 		return nil, fmt.Errorf("cannot find user %s: %w", sshconn.User(), err)
 	}
 
-	go ssh.DiscardRequests(request)
-
 	baseCtx, baseCancel := context.WithCancel(ctx)
 
+	id := newID()
 	s := &ServerConn{
 		sshcon:      sshconn,
 		newchanchan: newchanchan,
 		baseCtx:     baseCtx,
 		baseCancel:  baseCancel,
 		user:        user,
+		srv:         srv,
+		id:          id,
+		start:       time.Now(),
+		tlsState:    connTLSState(conn),
+		logger: srv.logger().With(
+			"conn_id", id,
+			"user", sshconn.User(),
+			"remote", sshconn.RemoteAddr().String()),
+	}
+
+	s.resources.limits = srv.connLimits()
+	s.resources.used = connCost
+
+	if srv.UseDNS {
+		s.logger = s.logger.With("remote_host", srv.RemoteHost(sshconn.RemoteAddr()))
+	}
+	if country := srv.Geo.country(sshconn.RemoteAddr()); country != "" {
+		s.logger = s.logger.With("country", country)
+	}
+
+	if srv.Hooks.OnAuth != nil {
+		if err := srv.Hooks.OnAuth(s.Info(), authMethod()); err != nil {
+			baseCancel()
+			sshconn.Close()
+			return nil, fmt.Errorf("authentication of %s is rejected: %w", sshconn.User(), err)
+		}
+	}
+
+	s.hostKeys = srv.announcedHostKeys()
+
+	// the handlers of the global requests read the features and the environment.
+	s.features = srv.features(s.Info())
+	s.env = srv.sessionEnv(s.Info())
+
+	go s.handleGlobalRequests(request)
+	go s.announceHostKeys()
+
+	if srv.ClientAliveInterval > 0 {
+		go s.clientAlive(srv.ClientAliveInterval, srv.ClientAliveCountMax)
 	}
 
 	return s, nil
@@ -66,16 +171,84 @@ func (s *ServerConn) Wait() {
 func (s *ServerConn) Close() error {
 	s.Wait()
 
+	return s.closeAll()
+}
+
+// Shutdown gracefully tears the connection down.
+// New channels are rejected, and the existing sessions are given until ctx is done to finish,
+// after which the connection is forcefully closed.
+func (s *ServerConn) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Wait()
+	}()
+
+	var ctxErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	}
+
+	return errors.Join(ctxErr, s.closeAll())
+}
+
+// Notify writes msg to the terminals of all the interactive sessions, for example to warn about a shutdown.
+func (s *ServerConn) Notify(msg string) {
+	s.chansMu.Lock()
+	defer s.chansMu.Unlock()
+
+	for _, channel := range s.chans {
+		if !channel.session.HasPTY() {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(channel.channel, "\r\n%s\r\n", msg); err != nil {
+			s.logger.Debug("failed to notify session", "err", err.Error())
+		}
+	}
+}
+
+func (s *ServerConn) numChans() int {
+	s.chansMu.Lock()
+	defer s.chansMu.Unlock()
+
+	return len(s.chans)
+}
+
+// removeChan removes the finished channel and releases its pty.
+func (s *ServerConn) removeChan(c *Channel) {
+	s.chansMu.Lock()
+	s.chans = slices.DeleteFunc(s.chans, func(v *Channel) bool { return v == c })
+	s.chansMu.Unlock()
+
+	if pty, _ := c.session.terminal(); pty != nil {
+		if err := pty.Close(); err != nil && !isClosedErr(err) {
+			s.logger.Debug("error in closing pty", "err", err.Error())
+		}
+		s.resources.release(ptyCost)
+	}
+}
+
+// closeAll closes all the channels and the underlying connection without waiting.
+func (s *ServerConn) closeAll() error {
+	s.chansMu.Lock()
+	defer s.chansMu.Unlock()
+
 	errs := make([]error, 0, len(s.chans)*3)
 
 	for _, channel := range s.chans {
 		channel.baseCancel()
 
-		if channel.pty != nil {
-			errs = append(errs, channel.pty.Close())
+		pty, tty := channel.session.terminal()
+		if pty != nil {
+			errs = append(errs, pty.Close())
 		}
-		if channel.tty != nil {
-			errs = append(errs, channel.tty.Close())
+		if tty != nil {
+			errs = append(errs, tty.Close())
 		}
 		if channel.channel != nil {
 			errs = append(errs, channel.channel.Close())
@@ -84,14 +257,58 @@ func (s *ServerConn) Close() error {
 
 	s.baseCancel()
 
-	errs = append(errs, s.sshcon.Close())
+	errs = append(errs, s.closeForwards(), s.sshcon.Close())
+
+	for i, err := range errs {
+		if isClosedErr(err) {
+			errs[i] = nil
+		}
+	}
 
 	return errors.Join(errs...)
 }
 
+// connTLSState returns the state of the tls connection under conn, nil if it is not over tls.
+func connTLSState(conn net.Conn) *tls.ConnectionState {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return &state
+		case *replayConn:
+			conn = c.Conn
+		case *deadlineConn:
+			conn = c.Conn
+		case *wsConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// isClosedErr checks if the error is caused by closing something already closed.
+func isClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed)
+}
+
+// isClientDisconnect checks if err is the disconnect message of a client closing the connection normally.
+// The ssh package doesn't export the message, so it is recognized by its text.
+func isClientDisconnect(err error) bool {
+	return strings.HasPrefix(err.Error(), "ssh: disconnect, reason 11:")
+}
+
+// Loop accepts the channels of the connection until it is closed.
+//
+// Deprecated: use [ServerConn.LoopContext], which reports how the connection ended.
 func (s *ServerConn) Loop() {
-	defer s.sshcon.Wait()
+	s.LoopContext(context.Background())
+}
 
+// LoopContext accepts the channels of the connection until the client disconnects, the connection is closed,
+// or ctx is done, in which case the connection is torn down and the error of ctx is returned.
+// It returns nil if the client disconnects or the connection is closed, and the error of the connection otherwise.
+func (s *ServerConn) LoopContext(ctx context.Context) error {
 serverloop:
 	for {
 		select {
@@ -102,47 +319,146 @@ serverloop:
 
 			s.procesNewChan(newchan)
 
+		case <-ctx.Done():
+			break serverloop
 		case <-s.baseCtx.Done():
 			break serverloop
 		}
 	}
+
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		if err := s.closeAll(); err != nil {
+			s.logger.Debug("error in closing connection", "err", err.Error())
+		}
+	}
+
+	// nothing can be forwarded to the client once it is gone.
+	if err := s.closeForwards(); err != nil {
+		s.logger.Info("failed to close remote forwardings", "err", err.Error())
+	}
+
+	if err := s.sshcon.Wait(); ctxErr == nil && err != nil && !isClosedErr(err) && !isClientDisconnect(err) {
+		return fmt.Errorf("connection failed: %w", err)
+	}
+
+	return ctxErr
 }
 
 func (s *ServerConn) procesNewChan(newchannel ssh.NewChannel) {
 	channeltype := newchannel.ChannelType()
 
-	if channeltype != "session" {
+	s.auditChannelOpen(newchannel)
+
+	if s.srv.Hooks.OnChannelOpen != nil {
+		if err := s.srv.Hooks.OnChannelOpen(s.Info(), channeltype, newchannel.ExtraData()); err != nil {
+			s.logger.Info("channel is rejected", "err", err.Error(), "channel_type", channeltype)
+			newchannel.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+	}
+
+	if s.draining.Load() {
+		newchannel.Reject(ssh.ResourceShortage, "server is shutting down")
+		return
+	}
+
+	switch channeltype {
+	case "session":
+	case directTCPIPChannel:
+		s.goForward(newchannel, s.directTCPIP)
+		return
+	case directStreamLocalChannel:
+		s.goForward(newchannel, s.directStreamLocal)
+		return
+	default:
 		newchannel.Reject(ssh.UnknownChannelType, channeltype)
 		return
 	}
 
-	channel, requests, err := newchannel.Accept()
+	if s.srv.MaxSessions > 0 && s.numChans() >= s.srv.MaxSessions {
+		newchannel.Reject(ssh.ResourceShortage, "too many sessions")
+		return
+	}
+	if !s.srv.acquireSession() {
+		newchannel.Reject(ssh.ResourceShortage, "too many sessions on the server")
+		return
+	}
+	if !s.resources.reserve(sessionCost) {
+		s.srv.releaseSession()
+		newchannel.Reject(ssh.ResourceShortage, errResourcesExhausted.Error())
+		return
+	}
+
+	channel, requests, err := s.acceptChannel(newchannel)
 	if err != nil {
-		slog.Info("failed to accept channel", "err", err.Error())
+		s.resources.release(sessionCost)
+		s.srv.releaseSession()
+		return
 	}
 
-	basectx, basecancel := context.WithCancel(s.baseCtx)
+	spanctx, span := s.srv.tracer().Start(s.baseCtx, "sshd.channel",
+		trace.WithAttributes(attribute.String("ssh.channel_type", channeltype)))
+
+	basectx, basecancel := context.WithCancel(spanctx)
+
+	metered := newMeteredChannel(channel, s.srv.Metrics)
+
+	id := fmt.Sprintf("%s-%d", s.id, s.chanSeq.Add(1))
 
 	c := &Channel{
-		channel:    channel,
+		channel:    metered,
+		metered:    metered,
 		requests:   requests,
-		env:        nil,
-		tty:        nil,
-		pty:        nil,
 		baseCtx:    basectx,
 		baseCancel: basecancel,
 		wg:         &s.wg,
 		user:       s.user,
+		srv:        s.srv,
+		conn:       s,
+		logger:     s.logger.With("session_id", id, "channel_type", channeltype),
+		id:         id,
+		start:      time.Now(),
 	}
 
+	s.chansMu.Lock()
 	s.chans = append(s.chans, c)
+	s.chansMu.Unlock()
 
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-
-		c.Loop()
+		defer s.srv.releaseSession()
+		defer s.resources.release(sessionCost)
+		defer span.End()
+		defer s.removeChan(c)
+		// stops enforceTimeouts once the channel is done.
+		defer c.baseCancel()
+
+		// the error only tells the connection is torn down.
+		_ = c.LoopContext(s.baseCtx)
 	}()
 
+	go c.enforceTimeouts()
+
 	return
 }
+
+// acceptChannel accepts newchannel, and reports the failure to the metrics and the hooks.
+// A channel cannot be accepted again, accepting only fails if the connection is gone.
+func (s *ServerConn) acceptChannel(newchannel ssh.NewChannel) (ssh.Channel, <-chan *ssh.Request, error) {
+	channeltype := newchannel.ChannelType()
+
+	channel, requests, err := newchannel.Accept()
+	s.srv.Metrics.channelAccepted(channeltype, err == nil)
+	if err != nil {
+		err = fmt.Errorf("failed to accept %s channel: %w", channeltype, err)
+		s.logger.Info("failed to accept channel", "channel_type", channeltype, "err", err.Error())
+		if s.srv.Hooks.OnChannelError != nil {
+			s.srv.Hooks.OnChannelError(s.Info(), channeltype, err)
+		}
+		return nil, nil, err
+	}
+
+	return channel, requests, nil
+}
@@ -0,0 +1,198 @@
+package sshd
+
+import (
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionState is the stage of the lifecycle of a session.
+type SessionState int
+
+const (
+	// SessionPending is a session being set up by the requests of the client, such as pty-req and env.
+	SessionPending SessionState = iota
+	// SessionRunning is a session running its shell, command or subsystem.
+	SessionRunning
+	// SessionExited is a session whose program ended.
+	SessionExited
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionPending:
+		return "pending"
+	case SessionRunning:
+		return "running"
+	case SessionExited:
+		return "exited"
+	default:
+		return "unknown"
+	}
+}
+
+// Session is the program of a session channel, with its pty, environment, process and exit status.
+// A session runs a single program, it is pending until the program starts, and exited once it ends.
+type Session struct {
+	// mu protects state, sessionType, cmdline, exitStatus, exitSignal and the environment and pty below,
+	// which are read by other goroutines, such as Notify of the connection, while the requests set them.
+	mu    sync.Mutex
+	state SessionState
+	// sessionType is the type of the program, shell, exec, sftp or scp.
+	sessionType string
+	// cmdline is the command line of an exec or scp session.
+	cmdline string
+	// exitStatus and exitSignal are how the program ended.
+	exitStatus uint32
+	exitSignal string
+
+	// environment variables by env requests
+	env []string
+
+	// term is the terminal type from pty-req
+	term string
+	// window size of the pty in characters
+	cols, rows uint32
+	// tty for shell
+	tty *os.File
+	// pty for other end of shell
+	pty *os.File
+
+	// process is the running shell or command, which leads its process group.
+	process atomic.Pointer[os.Process]
+}
+
+// State returns the stage of the lifecycle of the session.
+func (s *Session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// Type returns the type of the program of the session: shell, exec, sftp or scp,
+// and empty if no program is started yet.
+func (s *Session) Type() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessionType
+}
+
+// Command returns the command line of an exec or scp session, which is the forced command if there is one.
+func (s *Session) Command() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cmdline
+}
+
+// ExitStatus returns the exit status sent to the client, or the name of the signal that killed the program.
+// Both are zero until the session exits.
+func (s *Session) ExitStatus() (status uint32, signal string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exitStatus, s.exitSignal
+}
+
+// Env returns the environment variables requested by the client, in the form of key=value.
+func (s *Session) Env() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.env)
+}
+
+// Term returns the terminal type of the pty, empty if no pty is requested.
+func (s *Session) Term() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.term
+}
+
+// WindowSize returns the size of the pty in characters.
+func (s *Session) WindowSize() (cols, rows uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cols, s.rows
+}
+
+// HasPTY reports if the session has a pty.
+func (s *Session) HasPTY() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pty != nil
+}
+
+// terminal returns the pty and the tty of the session, both nil if no pty is requested.
+func (s *Session) terminal() (pty, tty *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pty, s.tty
+}
+
+// setTerminal sets the pty of the session, requested with term and the window size.
+func (s *Session) setTerminal(pty, tty *os.File, term string, cols, rows uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pty, s.tty = pty, tty
+	s.term = term
+	s.cols, s.rows = cols, rows
+}
+
+// resize sets the window size of the pty.
+func (s *Session) resize(cols, rows uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cols, s.rows = cols, rows
+}
+
+// addEnv adds the environment variable in the form of key=value,
+// unless there are maxCount variables already, no limit if not positive.
+func (s *Session) addEnv(env string, maxCount int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if maxCount > 0 && len(s.env) >= maxCount {
+		return false
+	}
+	s.env = append(s.env, env)
+
+	return true
+}
+
+// Pid returns the process id of the running program, 0 if there is none.
+func (s *Session) Pid() int {
+	if process := s.process.Load(); process != nil {
+		return process.Pid
+	}
+
+	return 0
+}
+
+// start moves the pending session to running with the program of sessiontype and cmdline.
+func (s *Session) start(sessiontype, cmdline string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = SessionRunning
+	s.sessionType = sessiontype
+	s.cmdline = cmdline
+}
+
+// exit moves the session to exited with the exit status or the name of the signal.
+func (s *Session) exit(status uint32, signal string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = SessionExited
+	s.exitStatus, s.exitSignal = status, signal
+}
@@ -0,0 +1,89 @@
+package sshd
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultSessionTimeoutWarning is how long before a timeout the interactive sessions are warned by default.
+const defaultSessionTimeoutWarning = time.Minute
+
+// enforceTimeouts closes the channel once it has been idle for SessionIdleTimeout
+// or open for SessionMaxDuration, warning interactive sessions beforehand.
+// It returns when the channel is done.
+func (c *Channel) enforceTimeouts() {
+	idleTimeout, maxDuration := c.srv.SessionIdleTimeout, c.srv.SessionMaxDuration
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	warning := c.srv.SessionTimeoutWarning
+	if warning == 0 {
+		warning = defaultSessionTimeoutWarning
+	}
+	// the warning would otherwise follow every activity for short timeouts.
+	for _, limit := range []time.Duration{idleTimeout, maxDuration} {
+		if limit > 0 && warning > limit/2 {
+			warning = limit / 2
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastActivity := c.start
+	lastBytes := int64(0)
+	warned := false
+
+	for {
+		select {
+		case <-c.baseCtx.Done():
+			return
+		case now := <-ticker.C:
+			if bytes := c.metered.bytesIn.Load() + c.metered.bytesOut.Load(); bytes != lastBytes {
+				lastBytes = bytes
+				lastActivity = now
+				warned = false
+			}
+
+			var deadline time.Time
+			var reason string
+			if idleTimeout > 0 {
+				deadline, reason = lastActivity.Add(idleTimeout), "idle timeout"
+			}
+			if maxDuration > 0 {
+				if end := c.start.Add(maxDuration); deadline.IsZero() || end.Before(deadline) {
+					deadline, reason = end, "maximum session duration"
+				}
+			}
+
+			if !now.Before(deadline) {
+				c.logger.Info("closing session", "reason", reason)
+				c.notifyTerminal(fmt.Sprintf("session closed: %s", reason))
+				// the process may ignore the closed terminal, hang up its process group too.
+				_ = c.signal("HUP")
+				if err := c.Close(); err != nil {
+					c.logger.Debug("error in closing session", "err", err.Error())
+				}
+				return
+			}
+
+			if warning > 0 && !warned && now.Add(warning).After(deadline) {
+				warned = true
+				c.notifyTerminal(fmt.Sprintf("session will be closed in %s: %s", deadline.Sub(now).Round(time.Second), reason))
+			}
+		}
+	}
+}
+
+// notifyTerminal writes msg to the terminal of an interactive session.
+// The message is written to the underlying channel, so it doesn't count as activity of the session.
+func (c *Channel) notifyTerminal(msg string) {
+	if !c.session.HasPTY() {
+		return
+	}
+
+	if _, err := fmt.Fprintf(c.metered.Channel, "\r\n%s\r\n", msg); err != nil {
+		c.logger.Debug("failed to notify session", "err", err.Error())
+	}
+}
@@ -0,0 +1,217 @@
+package sshd
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPEvent is a file operation of an sftp session.
+type SFTPEvent struct {
+	// Op is open, read or write for the files, where read and write are reported when the file is closed,
+	// or the lower cased sftp command, such as rename, remove, mkdir, rmdir, setstat, symlink or link.
+	Op   string
+	Path string
+	// Target is the new path of rename and link, and the link created by symlink, which points to Path.
+	Target string
+	// Bytes is the number of bytes read or written.
+	Bytes int64
+	// Err is the error of the operation, nil if it succeeded.
+	Err error
+}
+
+// auditSFTP wraps the handlers to report the file operations to emit.
+func auditSFTP(h sftp.Handlers, emit func(SFTPEvent)) sftp.Handlers {
+	a := &sftpAudit{handlers: h, emit: emit}
+
+	return sftp.Handlers{FileGet: a, FilePut: a, FileCmd: a, FileList: h.FileList}
+}
+
+// sftpAudit reports the operations going through the handlers.
+type sftpAudit struct {
+	handlers sftp.Handlers
+	emit     func(SFTPEvent)
+}
+
+func (a *sftpAudit) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	reader, err := a.handlers.FileGet.Fileread(r)
+	a.emit(SFTPEvent{Op: "open", Path: r.Filepath, Err: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.track(r.Filepath, reader, nil), nil
+}
+
+func (a *sftpAudit) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	writer, err := a.handlers.FilePut.Filewrite(r)
+	a.emit(SFTPEvent{Op: "open", Path: r.Filepath, Err: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.track(r.Filepath, nil, writer), nil
+}
+
+func (a *sftpAudit) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	rw, err := openReadWrite(a.handlers.FilePut, r)
+	a.emit(SFTPEvent{Op: "open", Path: r.Filepath, Err: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.track(r.Filepath, rw, rw), nil
+}
+
+func (a *sftpAudit) Filecmd(r *sftp.Request) error {
+	err := a.handlers.FileCmd.Filecmd(r)
+	a.emitCmd(r, err)
+
+	return err
+}
+
+func (a *sftpAudit) PosixRename(r *sftp.Request) error {
+	var err error
+	if renamer, ok := a.handlers.FileCmd.(sftp.PosixRenameFileCmder); ok {
+		err = renamer.PosixRename(r)
+	} else {
+		r.Method = "Rename"
+		err = a.handlers.FileCmd.Filecmd(r)
+	}
+	a.emitCmd(r, err)
+
+	return err
+}
+
+func (a *sftpAudit) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	if statter, ok := a.handlers.FileCmd.(sftp.StatVFSFileCmder); ok {
+		return statter.StatVFS(r)
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (a *sftpAudit) emitCmd(r *sftp.Request, err error) {
+	event := SFTPEvent{Op: strings.ToLower(r.Method), Path: r.Filepath, Err: err}
+	if r.Method != "Setstat" && r.Method != "Remove" && r.Method != "Mkdir" && r.Method != "Rmdir" {
+		event.Target = r.Target
+	}
+
+	a.emit(event)
+}
+
+// track counts the bytes read from r and written to w, reported when the file is closed.
+// For the files opened for both, only the directions with bytes are reported.
+func (a *sftpAudit) track(path string, r io.ReaderAt, w io.WriterAt) *auditedFile {
+	f := &auditedFile{r: r, w: w}
+	f.done = func(err error) {
+		read, written := f.read.Load(), f.written.Load()
+		if r != nil && (w == nil || read > 0) {
+			a.emit(SFTPEvent{Op: "read", Path: path, Bytes: read, Err: err})
+		}
+		if w != nil && (r == nil || written > 0) {
+			a.emit(SFTPEvent{Op: "write", Path: path, Bytes: written, Err: err})
+		}
+	}
+
+	return f
+}
+
+// auditedFile counts the bytes of an open file.
+type auditedFile struct {
+	r io.ReaderAt
+	w io.WriterAt
+
+	read    atomic.Int64
+	written atomic.Int64
+
+	// transferErr is the error interrupting the transfer.
+	transferErr error
+	done        func(err error)
+	once        sync.Once
+}
+
+func (f *auditedFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.r.ReadAt(b, off)
+	f.read.Add(int64(n))
+
+	return n, err
+}
+
+func (f *auditedFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.w.WriteAt(b, off)
+	f.written.Add(int64(n))
+
+	return n, err
+}
+
+func (f *auditedFile) TransferError(err error) {
+	f.transferErr = err
+	for _, v := range []any{f.r, f.w} {
+		if t, ok := v.(sftp.TransferError); ok {
+			t.TransferError(err)
+			return
+		}
+	}
+}
+
+func (f *auditedFile) Close() error {
+	var err error
+	for _, v := range []any{f.r, f.w} {
+		if c, ok := v.(io.Closer); ok {
+			err = c.Close()
+			break
+		}
+	}
+
+	f.once.Do(func() {
+		if f.transferErr != nil {
+			f.done(f.transferErr)
+		} else {
+			f.done(err)
+		}
+	})
+
+	return err
+}
+
+// openReadWrite opens the file of r for reading and writing with put,
+// or only for writing like the request server does if put cannot.
+func openReadWrite(put sftp.FileWriter, r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if opener, ok := put.(sftp.OpenFileWriter); ok {
+		return opener.OpenFile(r)
+	}
+
+	w, err := put.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeOnly{WriterAt: w}, nil
+}
+
+// writeOnly is a file only opened for writing.
+type writeOnly struct {
+	io.WriterAt
+}
+
+func (writeOnly) ReadAt([]byte, int64) (int, error) {
+	return 0, sftp.ErrSSHFxOpUnsupported
+}
+
+func (w writeOnly) Close() error {
+	if c, ok := w.WriterAt.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (w writeOnly) TransferError(err error) {
+	if t, ok := w.WriterAt.(sftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
@@ -0,0 +1,419 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// bucketReadBlock is the most bytes read from an object at once, cached for the following reads.
+	bucketReadBlock = 1 << 20
+	// maxBucketPending is the most bytes written ahead of the uploaded data, waiting for the writes before them.
+	maxBucketPending = 64 << 20
+)
+
+var (
+	errBucketRewrite    = errors.New("objects can only be written sequentially")
+	errBucketIncomplete = errors.New("the object is written with gaps")
+	errBucketNotEmpty   = errors.New("directory is not empty")
+)
+
+// SFTPBucket returns the sftp handlers serving the objects of an s3 compatible bucket,
+// for example to run an sftp gateway to an object storage.
+// The directories are the prefixes of the keys ending with /, created by mkdir as empty objects.
+// Files are uploaded as they are written, in parts for the large ones, and the clients must write them in order.
+// Links are not supported, and the attributes set by the clients are ignored.
+func SFTPBucket(cfg S3Config) (sftp.Handlers, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return sftp.Handlers{}, err
+	}
+
+	b := &bucketFS{client: client}
+
+	return sftp.Handlers{FileGet: b, FilePut: b, FileCmd: b, FileList: b}, nil
+}
+
+// bucketFS serves a bucket over sftp.
+type bucketFS struct {
+	client *s3Client
+}
+
+// key returns the key of the object at the sftp path p.
+func (b *bucketFS) key(p string) string {
+	return b.client.cfg.Prefix + strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// dirPrefix returns the prefix of the keys in the directory at the sftp path p.
+func (b *bucketFS) dirPrefix(p string) string {
+	k := b.key(p)
+	if k != "" && !strings.HasSuffix(k, "/") {
+		k += "/"
+	}
+
+	return k
+}
+
+// pathError converts the errors of the storage to the ones the sftp server reports with the matching status.
+func (b *bucketFS) pathError(op, p string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return &os.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	case errors.Is(err, fs.ErrPermission):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	return err
+}
+
+func (b *bucketFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	key := b.key(r.Filepath)
+
+	obj, err := b.client.head(r.Context(), key)
+	if err != nil {
+		return nil, b.pathError("open", r.Filepath, err)
+	}
+
+	return &bucketReader{client: b.client, key: key, size: obj.Size}, nil
+}
+
+func (b *bucketFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return &bucketWriter{client: b.client, key: b.key(r.Filepath), pending: make(map[int64][]byte)}, nil
+}
+
+func (b *bucketFS) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+
+	switch r.Method {
+	case "Setstat":
+		// objects have no modes, owners or times to set.
+		return nil
+	case "Rename", "PosixRename":
+		return b.rename(ctx, r.Filepath, r.Target, r.Method == "PosixRename")
+	case "Remove":
+		key := b.key(r.Filepath)
+		if _, err := b.client.head(ctx, key); err != nil {
+			return b.pathError("remove", r.Filepath, err)
+		}
+		return b.pathError("remove", r.Filepath, b.client.delete(ctx, key))
+	case "Mkdir":
+		return b.pathError("mkdir", r.Filepath, b.client.put(ctx, b.dirPrefix(r.Filepath), nil))
+	case "Rmdir":
+		prefix := b.dirPrefix(r.Filepath)
+		listing, err := b.client.list(ctx, prefix, "", 2)
+		if err != nil {
+			return b.pathError("rmdir", r.Filepath, err)
+		}
+		switch {
+		case len(listing.Contents) == 0:
+			return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: fs.ErrNotExist}
+		case len(listing.Contents) > 1 || listing.Contents[0].Key != prefix:
+			return errBucketNotEmpty
+		}
+		return b.pathError("rmdir", r.Filepath, b.client.delete(ctx, prefix))
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (b *bucketFS) PosixRename(r *sftp.Request) error {
+	return b.rename(r.Context(), r.Filepath, r.Target, true)
+}
+
+// rename copies the object or the objects of the directory at from to to, and deletes them.
+// The target is only replaced if overwrite is set, like the posix rename.
+func (b *bucketFS) rename(ctx context.Context, from, to string, overwrite bool) error {
+	src, dst := b.key(from), b.key(to)
+
+	if _, err := b.client.head(ctx, src); err == nil {
+		if !overwrite {
+			if _, err := b.client.head(ctx, dst); err == nil {
+				return &os.PathError{Op: "rename", Path: to, Err: fs.ErrExist}
+			}
+		}
+		if err := b.client.copy(ctx, src, dst); err != nil {
+			return b.pathError("rename", from, err)
+		}
+		return b.pathError("rename", from, b.client.delete(ctx, src))
+	}
+
+	srcPrefix, dstPrefix := b.dirPrefix(from), b.dirPrefix(to)
+	listing, err := b.client.list(ctx, srcPrefix, "", 0)
+	if err != nil {
+		return b.pathError("rename", from, err)
+	}
+	if len(listing.Contents) == 0 {
+		return &os.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+
+	for _, obj := range listing.Contents {
+		if err := b.client.copy(ctx, obj.Key, dstPrefix+strings.TrimPrefix(obj.Key, srcPrefix)); err != nil {
+			return b.pathError("rename", from, err)
+		}
+	}
+	for _, obj := range listing.Contents {
+		if err := b.client.delete(ctx, obj.Key); err != nil {
+			return b.pathError("rename", from, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *bucketFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return b.list(r.Context(), r.Filepath)
+	case "Stat":
+		fi, err := b.stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfos{fi}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (b *bucketFS) list(ctx context.Context, p string) (sftp.ListerAt, error) {
+	prefix := b.dirPrefix(p)
+
+	listing, err := b.client.list(ctx, prefix, "/", 0)
+	if err != nil {
+		return nil, b.pathError("readdir", p, err)
+	}
+
+	var infos []os.FileInfo
+	exists := prefix == b.client.cfg.Prefix
+	for _, dir := range listing.CommonPrefixes {
+		exists = true
+		infos = append(infos, &bucketFileInfo{name: path.Base(strings.TrimSuffix(dir, "/")), dir: true})
+	}
+	for _, obj := range listing.Contents {
+		exists = true
+		// the object of the directory itself.
+		if obj.Key == prefix {
+			continue
+		}
+		infos = append(infos, &bucketFileInfo{name: strings.TrimPrefix(obj.Key, prefix), size: obj.Size, modTime: obj.LastModified})
+	}
+
+	if !exists {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: fs.ErrNotExist}
+	}
+
+	return fileInfos(infos), nil
+}
+
+func (b *bucketFS) stat(ctx context.Context, p string) (os.FileInfo, error) {
+	name := path.Base(path.Clean("/" + p))
+	if b.key(p) == b.client.cfg.Prefix {
+		return &bucketFileInfo{name: name, dir: true}, nil
+	}
+
+	obj, err := b.client.head(ctx, b.key(p))
+	if err == nil {
+		return &bucketFileInfo{name: name, size: obj.Size, modTime: obj.LastModified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, b.pathError("stat", p, err)
+	}
+
+	listing, err := b.client.list(ctx, b.dirPrefix(p), "", 1)
+	if err != nil {
+		return nil, b.pathError("stat", p, err)
+	}
+	if len(listing.Contents) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+	}
+
+	return &bucketFileInfo{name: name, dir: true}, nil
+}
+
+// bucketFileInfo describes an object or a directory of a bucket.
+type bucketFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *bucketFileInfo) Name() string       { return fi.name }
+func (fi *bucketFileInfo) Size() int64        { return fi.size }
+func (fi *bucketFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *bucketFileInfo) IsDir() bool        { return fi.dir }
+func (fi *bucketFileInfo) Sys() any           { return nil }
+
+func (fi *bucketFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o755
+	}
+
+	return 0o644
+}
+
+// bucketReader reads an object with ranged requests, caching the last block read.
+type bucketReader struct {
+	client *s3Client
+	key    string
+	size   int64
+
+	mu         sync.Mutex
+	block      []byte
+	blockStart int64
+}
+
+func (r *bucketReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off < r.blockStart || off+int64(len(p)) > r.blockStart+int64(len(r.block)) {
+		block := make([]byte, min(max(int64(len(p)), bucketReadBlock), r.size-off))
+		n, err := r.client.getRange(context.Background(), r.key, block, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		r.block, r.blockStart = block[:n], off
+	}
+
+	n := copy(p, r.block[off-r.blockStart:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// bucketWriter uploads an object as it is written, in parts once it is larger than a part.
+// The writes ahead of the uploaded data wait in memory for the ones before them.
+type bucketWriter struct {
+	client *s3Client
+	key    string
+
+	mu sync.Mutex
+	// written is the size of the data received without gaps.
+	written int64
+	// buf is the data not uploaded yet.
+	buf []byte
+	// pending are the writes ahead of written by their offsets.
+	pending      map[int64][]byte
+	pendingBytes int64
+	upload       *s3Upload
+	err          error
+}
+
+func (w *bucketWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	switch {
+	case off < w.written:
+		return 0, errBucketRewrite
+	case off > w.written:
+		if w.pendingBytes+int64(len(p)) > maxBucketPending {
+			return 0, errBucketRewrite
+		}
+		w.pending[off] = append([]byte(nil), p...)
+		w.pendingBytes += int64(len(p))
+		return len(p), nil
+	}
+
+	w.buf = append(w.buf, p...)
+	w.written += int64(len(p))
+	for {
+		next, ok := w.pending[w.written]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.written)
+		w.pendingBytes -= int64(len(next))
+		w.buf = append(w.buf, next...)
+		w.written += int64(len(next))
+	}
+
+	for partSize := w.client.cfg.PartSize; int64(len(w.buf)) >= partSize; {
+		if err := w.uploadPart(w.buf[:partSize]); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.buf = append([]byte(nil), w.buf[partSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (w *bucketWriter) uploadPart(part []byte) error {
+	if w.upload == nil {
+		upload, err := w.client.createUpload(context.Background(), w.key)
+		if err != nil {
+			return err
+		}
+		w.upload = upload
+	}
+
+	return w.upload.uploadPart(context.Background(), part)
+}
+
+// TransferError records the error interrupting the transfer, so the object is not stored on close.
+func (w *bucketWriter) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *bucketWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ctx := context.Background()
+
+	err := w.err
+	if err == nil && len(w.pending) > 0 {
+		err = errBucketIncomplete
+	}
+
+	switch {
+	case err != nil:
+		if w.upload != nil {
+			_ = w.upload.abort(ctx)
+		}
+		return err
+	case w.upload == nil:
+		return w.client.put(ctx, w.key, w.buf)
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.upload.uploadPart(ctx, w.buf); err != nil {
+			_ = w.upload.abort(ctx)
+			return err
+		}
+	}
+	if err := w.upload.complete(ctx); err != nil {
+		_ = w.upload.abort(ctx)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// errPathEscape is returned for the sftp paths resolving outside of the root.
+var errPathEscape = sftp.ErrSSHFxPermissionDenied
+
+// SFTPDir returns the sftp handlers serving the local directory root as /.
+// Paths escaping root, including through symbolic links, are rejected.
+func SFTPDir(root string) sftp.Handlers {
+	return sftpDir(root, nil)
+}
+
+// sftpDir returns the handlers of SFTPDir, with the permission policy if not nil.
+func sftpDir(root string, perms *SFTPPermissions) sftp.Handlers {
+	d := &dirFS{root: filepath.Clean(root), perms: perms}
+
+	return sftp.Handlers{FileGet: d, FilePut: d, FileCmd: d, FileList: d}
+}
+
+// dirFS serves a local directory over sftp.
+type dirFS struct {
+	root  string
+	perms *SFTPPermissions
+}
+
+// resolve maps the sftp path p to a local path under the root, resolving the symbolic links of its directories,
+// and of the file itself if follow is set.
+func (d *dirFS) resolve(p string, follow bool) (string, error) {
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return "", err
+	}
+
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return root, nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(path.Dir(p))))
+	if err != nil {
+		return "", d.pathError(err, p)
+	}
+	if !withinDir(root, dir) {
+		return "", errPathEscape
+	}
+
+	local := filepath.Join(dir, path.Base(p))
+	if !follow {
+		return local, nil
+	}
+
+	fi, err := os.Lstat(local)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return local, nil
+	}
+
+	// a dangling link is rejected too, since creating the file would follow it.
+	target, err := filepath.EvalSymlinks(local)
+	if err != nil || !withinDir(root, target) {
+		return "", errPathEscape
+	}
+
+	return target, nil
+}
+
+// withinDir checks if the cleaned path p is dir or under it.
+func withinDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// pathError replaces the local path of a path error with the sftp path p, not to reveal the root to the client.
+func (d *dirFS) pathError(err error, p string) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return &os.PathError{Op: pathErr.Op, Path: p, Err: pathErr.Err}
+	}
+
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return &os.PathError{Op: linkErr.Op, Path: p, Err: linkErr.Err}
+	}
+
+	return err
+}
+
+func (d *dirFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	local, err := d.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return nil, d.pathError(err, r.Filepath)
+	}
+
+	return f, nil
+}
+
+func (d *dirFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return d.openFile(r, os.O_WRONLY)
+}
+
+func (d *dirFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return d.openFile(r, os.O_RDWR)
+}
+
+func (d *dirFS) openFile(r *sftp.Request, flag int) (*os.File, error) {
+	local, err := d.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// append is ignored, the clients write at the offsets they want.
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	_, statErr := os.Lstat(local)
+	created := pflags.Creat && errors.Is(statErr, fs.ErrNotExist)
+
+	f, err := os.OpenFile(local, flag, 0o666)
+	if err != nil {
+		return nil, d.pathError(err, r.Filepath)
+	}
+
+	if created && d.perms != nil {
+		if err := d.perms.apply(local, 0o666); err != nil {
+			f.Close()
+			return nil, d.pathError(err, r.Filepath)
+		}
+	}
+
+	return f, nil
+}
+
+func (d *dirFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return d.setstat(r)
+	case "Rename":
+		return d.rename(r)
+	case "Rmdir", "Remove":
+		local, err := d.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(local)
+		if err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+		if fi.IsDir() != (r.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+		return d.pathError(os.Remove(local), r.Filepath)
+	case "Mkdir":
+		local, err := d.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(local, 0o777); err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+		if d.perms != nil {
+			return d.pathError(d.perms.apply(local, 0o777), r.Filepath)
+		}
+		return nil
+	case "Link":
+		oldpath, err := d.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		newpath, err := d.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return d.pathError(os.Link(oldpath, newpath), r.Target)
+	case "Symlink":
+		// the link is r.Target, pointing to r.Filepath, which is kept relative or mapped under the root.
+		linkpath, err := d.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		target := r.Filepath
+		if path.IsAbs(target) {
+			target = filepath.Join(d.root, filepath.FromSlash(path.Clean(target)))
+		}
+		return d.pathError(os.Symlink(target, linkpath), r.Target)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (d *dirFS) PosixRename(r *sftp.Request) error {
+	return d.rename(r)
+}
+
+func (d *dirFS) rename(r *sftp.Request) error {
+	oldpath, err := d.resolve(r.Filepath, false)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.resolve(r.Target, false)
+	if err != nil {
+		return err
+	}
+
+	return d.pathError(os.Rename(oldpath, newpath), r.Filepath)
+}
+
+func (d *dirFS) setstat(r *sftp.Request) error {
+	local, err := d.resolve(r.Filepath, true)
+	if err != nil {
+		return err
+	}
+
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.UidGid && d.perms != nil && d.perms.forcesOwner() {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	if flags.Size {
+		if err := os.Truncate(local, int64(attrs.Size)); err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+	}
+
+	if flags.Permissions {
+		mode := attrs.FileMode().Perm()
+		if d.perms != nil {
+			mode = d.perms.limit(mode)
+		}
+		if err := os.Chmod(local, mode); err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(local, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(local, int(attrs.UID), int(attrs.GID)); err != nil {
+			return d.pathError(err, r.Filepath)
+		}
+	}
+
+	return nil
+}
+
+func (d *dirFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		local, err := d.resolve(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			return nil, d.pathError(err, r.Filepath)
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			// entries removed since the listing are skipped.
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return fileInfos(infos), nil
+	case "Stat":
+		return d.stat(r.Filepath, true)
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (d *dirFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	return d.stat(r.Filepath, false)
+}
+
+func (d *dirFS) stat(p string, follow bool) (sftp.ListerAt, error) {
+	local, err := d.resolve(p, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(local)
+	if err != nil {
+		return nil, d.pathError(err, p)
+	}
+
+	return fileInfos{fi}, nil
+}
+
+func (d *dirFS) Readlink(p string) (string, error) {
+	local, err := d.resolve(p, false)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(local)
+	if err != nil {
+		return "", d.pathError(err, p)
+	}
+
+	// absolute targets under the root are shown as the sftp paths.
+	if root := filepath.Clean(d.root); filepath.IsAbs(target) && withinDir(root, target) {
+		target = "/" + filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(target, root), string(filepath.Separator)))
+	}
+
+	return target, nil
+}
+
+// fileInfos lists the file infos for sftp.
+type fileInfos []os.FileInfo
+
+func (f fileInfos) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(f)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, f[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,27 @@
+package sshd
+
+import (
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// InMemorySFTP returns a function for [Server.SFTPHandlers] serving each user a filesystem in memory,
+// which starts empty and lasts as long as the server, for tests and throwaway servers.
+func InMemorySFTP() func(info ConnInfo) (sftp.Handlers, error) {
+	var mu sync.Mutex
+	filesystems := make(map[string]sftp.Handlers)
+
+	return func(info ConnInfo) (sftp.Handlers, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		h, ok := filesystems[info.User]
+		if !ok {
+			h = sftp.InMemHandler()
+			filesystems[info.User] = h
+		}
+
+		return h, nil
+	}
+}
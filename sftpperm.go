@@ -0,0 +1,100 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// SFTPPermissions controls the modes and the owners of the files created over sftp in process,
+// so the uploads land the same regardless of the clients.
+type SFTPPermissions struct {
+	// Umask, if not zero, is cleared from the modes of the created files and directories,
+	// which are 0666 and 0777 before, instead of the umask of the process.
+	Umask os.FileMode
+	// MaxMode, if not zero, is the most permissions the files and directories can get,
+	// also when the clients change them.
+	MaxMode os.FileMode
+	// Owner and Group, if set, are the user and group names or ids the created files are given to.
+	// The clients cannot change the owners.
+	Owner string
+	Group string
+}
+
+// mode returns the mode of a new file or directory with the permissions perm before the umask.
+func (p *SFTPPermissions) mode(perm os.FileMode) os.FileMode {
+	return p.limit(perm &^ p.Umask)
+}
+
+// limit restricts the permissions perm to MaxMode.
+func (p *SFTPPermissions) limit(perm os.FileMode) os.FileMode {
+	if p.MaxMode != 0 {
+		perm &= p.MaxMode
+	}
+
+	return perm
+}
+
+// forcesOwner checks if the owners of the files are forced.
+func (p *SFTPPermissions) forcesOwner() bool {
+	return p.Owner != "" || p.Group != ""
+}
+
+// apply sets the mode of the new file or directory at path, created with perm before the umask,
+// and gives it to the forced owners.
+func (p *SFTPPermissions) apply(path string, perm os.FileMode) error {
+	if p.Umask != 0 || p.MaxMode != 0 {
+		if err := os.Chmod(path, p.mode(perm)); err != nil {
+			return err
+		}
+	}
+
+	if !p.forcesOwner() {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if p.Owner != "" {
+		id, err := lookupID(p.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look up sftp owner %s: %w", p.Owner, err)
+		}
+		uid = id
+	}
+	if p.Group != "" {
+		id, err := lookupID(p.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look up sftp group %s: %w", p.Group, err)
+		}
+		gid = id
+	}
+
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupID returns the numeric id, or looks up the id of the name.
+func lookupID(nameOrID string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
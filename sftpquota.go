@@ -0,0 +1,396 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPQuota limits the storage of the sftp sessions of a user, zero for no limit.
+type SFTPQuota struct {
+	// Bytes limits the total size of the regular files.
+	Bytes int64
+	// Files limits the number of files, including directories and links.
+	Files int64
+}
+
+// SFTPUsage is the storage used by the sftp sessions of a user under quota.
+type SFTPUsage struct {
+	Bytes int64
+	Files int64
+	Quota SFTPQuota
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// sftpUsage tracks the storage of a user, shared by the sftp sessions of the user.
+type sftpUsage struct {
+	mu    sync.Mutex
+	bytes int64
+	files int64
+	quota SFTPQuota
+
+	// sessions is the number of sftp sessions using it.
+	sessions int
+}
+
+// reserve adds the bytes and files to the usage, failing if the growth exceeds the quota.
+func (u *sftpUsage) reserve(bytes, files int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if bytes > 0 && u.quota.Bytes > 0 && u.bytes+bytes > u.quota.Bytes {
+		return errQuotaExceeded
+	}
+	if files > 0 && u.quota.Files > 0 && u.files+files > u.quota.Files {
+		return errQuotaExceeded
+	}
+
+	u.bytes += bytes
+	u.files += files
+
+	return nil
+}
+
+// release removes the bytes and files from the usage.
+func (u *sftpUsage) release(bytes, files int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.bytes = max(0, u.bytes-bytes)
+	u.files = max(0, u.files-files)
+}
+
+func (u *sftpUsage) snapshot() SFTPUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return SFTPUsage{Bytes: u.bytes, Files: u.files, Quota: u.quota}
+}
+
+// SFTPUsage returns the storage used by the users with active sftp sessions under quota.
+func (s *Server) SFTPUsage() map[string]SFTPUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usages := make(map[string]SFTPUsage, len(s.sftpUsages))
+	for user, usage := range s.sftpUsages {
+		usages[user] = usage.snapshot()
+	}
+
+	return usages
+}
+
+// acquireSFTPUsage returns the usage of the user, measuring the files served by h if no session of the user has,
+// and the function to call when the session ends.
+func (s *Server) acquireSFTPUsage(user string, quota SFTPQuota, h sftp.Handlers) (*sftpUsage, func(), error) {
+	release := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if usage := s.sftpUsages[user]; usage != nil {
+			usage.sessions--
+			if usage.sessions <= 0 {
+				delete(s.sftpUsages, user)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	if usage := s.sftpUsages[user]; usage != nil {
+		usage.sessions++
+		usage.mu.Lock()
+		usage.quota = quota
+		usage.mu.Unlock()
+		s.mu.Unlock()
+		return usage, release, nil
+	}
+	s.mu.Unlock()
+
+	// the files are measured without the lock, another session may measure them at the same time.
+	bytes, files, err := sftpTreeUsage(h, "/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to measure sftp usage: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sftpUsages == nil {
+		s.sftpUsages = make(map[string]*sftpUsage)
+	}
+	usage := s.sftpUsages[user]
+	if usage == nil {
+		usage = &sftpUsage{bytes: bytes, files: files, quota: quota}
+		s.sftpUsages[user] = usage
+	}
+	usage.sessions++
+
+	return usage, release, nil
+}
+
+// sftpTreeUsage sums up the sizes of the regular files and the number of files under dir.
+func sftpTreeUsage(h sftp.Handlers, dir string) (int64, int64, error) {
+	lister, err := h.FileList.Filelist(sftp.NewRequest("List", dir))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var bytes, files int64
+	infos := make([]os.FileInfo, 128)
+	for offset := int64(0); ; {
+		n, err := lister.ListAt(infos, offset)
+		for _, fi := range infos[:n] {
+			if fi.Name() == "." || fi.Name() == ".." {
+				continue
+			}
+			files++
+			switch {
+			case fi.Mode().IsRegular():
+				bytes += fi.Size()
+			case fi.IsDir():
+				subBytes, subFiles, err := sftpTreeUsage(h, path.Join(dir, fi.Name()))
+				if err != nil {
+					return 0, 0, err
+				}
+				bytes += subBytes
+				files += subFiles
+			}
+		}
+		offset += int64(n)
+
+		if errors.Is(err, io.EOF) {
+			return bytes, files, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// quotaSFTP wraps the handlers to account the storage in usage, rejecting the operations exceeding the quota.
+func quotaSFTP(h sftp.Handlers, usage *sftpUsage) sftp.Handlers {
+	q := &sftpQuota{handlers: h, usage: usage}
+
+	return sftp.Handlers{FileGet: h.FileGet, FilePut: q, FileCmd: q, FileList: h.FileList}
+}
+
+// sftpQuota accounts the storage of the operations going through the handlers.
+type sftpQuota struct {
+	handlers sftp.Handlers
+	usage    *sftpUsage
+}
+
+// stat returns the info of the file at p, without following the link if lstat is set and supported.
+func (q *sftpQuota) stat(p string, lstat bool) (os.FileInfo, error) {
+	var lister sftp.ListerAt
+	var err error
+	if l, ok := q.handlers.FileList.(sftp.LstatFileLister); ok && lstat {
+		lister, err = l.Lstat(sftp.NewRequest("Lstat", p))
+	} else {
+		lister, err = q.handlers.FileList.Filelist(sftp.NewRequest("Stat", p))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 1)
+	n, err := lister.ListAt(infos, 0)
+	if n == 0 {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+
+	return infos[0], nil
+}
+
+// sftpFileSize returns the bytes counted for the file.
+func sftpFileSize(fi os.FileInfo) int64 {
+	if fi == nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+func (q *sftpQuota) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return q.open(r, func() (sftp.WriterAtReaderAt, error) {
+		w, err := q.handlers.FilePut.Filewrite(r)
+		if err != nil {
+			return nil, err
+		}
+		return writeOnly{WriterAt: w}, nil
+	})
+}
+
+func (q *sftpQuota) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return q.open(r, func() (sftp.WriterAtReaderAt, error) {
+		return openReadWrite(q.handlers.FilePut, r)
+	})
+}
+
+// open opens the file of r with open, counting the file if created, and tracking its size for the writes.
+func (q *sftpQuota) open(r *sftp.Request, open func() (sftp.WriterAtReaderAt, error)) (sftp.WriterAtReaderAt, error) {
+	pflags := r.Pflags()
+
+	fi, statErr := q.stat(r.Filepath, false)
+	created := statErr != nil && pflags.Creat
+	if created {
+		if err := q.usage.reserve(0, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	rw, err := open()
+	if err != nil {
+		if created {
+			q.usage.release(0, 1)
+		}
+		return nil, err
+	}
+
+	f := &quotaFile{WriterAtReaderAt: rw, usage: q.usage, size: sftpFileSize(fi)}
+	if pflags.Trunc {
+		q.usage.release(f.size, 0)
+		f.size = 0
+	}
+
+	return f, nil
+}
+
+func (q *sftpQuota) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Remove", "Rmdir":
+		fi, statErr := q.stat(r.Filepath, true)
+		if err := q.handlers.FileCmd.Filecmd(r); err != nil {
+			return err
+		}
+		if statErr == nil {
+			q.usage.release(sftpFileSize(fi), 1)
+		}
+		return nil
+	case "Mkdir", "Symlink":
+		return q.reserved(0, 1, func() error { return q.handlers.FileCmd.Filecmd(r) })
+	case "Link":
+		fi, err := q.stat(r.Filepath, true)
+		if err != nil {
+			return q.handlers.FileCmd.Filecmd(r)
+		}
+		return q.reserved(sftpFileSize(fi), 1, func() error { return q.handlers.FileCmd.Filecmd(r) })
+	case "Rename":
+		return q.rename(r, func() error { return q.handlers.FileCmd.Filecmd(r) })
+	case "Setstat":
+		if !r.AttrFlags().Size {
+			return q.handlers.FileCmd.Filecmd(r)
+		}
+		fi, err := q.stat(r.Filepath, false)
+		if err != nil {
+			return q.handlers.FileCmd.Filecmd(r)
+		}
+		grow := int64(r.Attributes().Size) - sftpFileSize(fi)
+		if grow <= 0 {
+			if err := q.handlers.FileCmd.Filecmd(r); err != nil {
+				return err
+			}
+			q.usage.release(-grow, 0)
+			return nil
+		}
+		return q.reserved(grow, 0, func() error { return q.handlers.FileCmd.Filecmd(r) })
+	default:
+		return q.handlers.FileCmd.Filecmd(r)
+	}
+}
+
+func (q *sftpQuota) PosixRename(r *sftp.Request) error {
+	return q.rename(r, func() error {
+		if renamer, ok := q.handlers.FileCmd.(sftp.PosixRenameFileCmder); ok {
+			return renamer.PosixRename(r)
+		}
+		r.Method = "Rename"
+		return q.handlers.FileCmd.Filecmd(r)
+	})
+}
+
+func (q *sftpQuota) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	if statter, ok := q.handlers.FileCmd.(sftp.StatVFSFileCmder); ok {
+		return statter.StatVFS(r)
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// rename releases the file replaced by the rename.
+func (q *sftpQuota) rename(r *sftp.Request, rename func() error) error {
+	replaced, statErr := q.stat(r.Target, true)
+	if err := rename(); err != nil {
+		return err
+	}
+	if statErr == nil {
+		q.usage.release(sftpFileSize(replaced), 1)
+	}
+
+	return nil
+}
+
+// reserved runs f with the bytes and files reserved, which are released if f fails.
+func (q *sftpQuota) reserved(bytes, files int64, f func() error) error {
+	if err := q.usage.reserve(bytes, files); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		q.usage.release(bytes, files)
+		return err
+	}
+
+	return nil
+}
+
+// quotaFile reserves the growth of the file before each write.
+type quotaFile struct {
+	sftp.WriterAtReaderAt
+	usage *sftpUsage
+
+	mu   sync.Mutex
+	size int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	grow := max(0, off+int64(len(b))-f.size)
+	if err := f.usage.reserve(grow, 0); err != nil {
+		return 0, err
+	}
+
+	n, err := f.WriterAtReaderAt.WriteAt(b, off)
+	if end := off + int64(n); end > f.size {
+		f.usage.release(grow-(end-f.size), 0)
+		f.size = end
+	} else {
+		f.usage.release(grow, 0)
+	}
+
+	return n, err
+}
+
+func (f *quotaFile) Close() error {
+	if c, ok := f.WriterAtReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (f *quotaFile) TransferError(err error) {
+	if t, ok := f.WriterAtReaderAt.(sftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
@@ -0,0 +1,35 @@
+package sshd
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+// StatVFS reports the file system of the directory, for the statvfs@openssh.com extension.
+func (d *dirFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	local, err := d.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(local, &stat); err != nil {
+		return nil, d.pathError(&os.PathError{Op: "statvfs", Path: local, Err: err}, r.Filepath)
+	}
+
+	return &sftp.StatVFS{
+		Bsize:   uint64(stat.Bsize),
+		Frsize:  uint64(stat.Frsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree,
+		Fsid:    uint64(uint32(stat.Fsid.X__val[0]))<<32 | uint64(uint32(stat.Fsid.X__val[1])),
+		Flag:    uint64(stat.Flags),
+		Namemax: uint64(stat.Namelen),
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sshd
+
+import "github.com/pkg/sftp"
+
+// StatVFS reports the file system of the directory, which is only supported on linux.
+func (d *dirFS) StatVFS(*sftp.Request) (*sftp.StatVFS, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
@@ -0,0 +1,77 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/fardream/sshd/wire"
+)
+
+// sshSignalName returns the name of sig in ssh requests, which is the name without the SIG prefix.
+func sshSignalName(sig syscall.Signal) string {
+	name := unix.SignalName(sig)
+	if name == "" {
+		return ""
+	}
+
+	return strings.TrimPrefix(name, "SIG")
+}
+
+// exitSignal returns the payload of the exit-signal request if the process of status was killed by a signal.
+func exitSignal(status syscall.WaitStatus) ([]byte, bool) {
+	if !status.Signaled() {
+		return nil, false
+	}
+
+	sig := status.Signal()
+	name := sshSignalName(sig)
+	if name == "" {
+		return nil, false
+	}
+
+	return wire.MarshalExitSignal(name, status.CoreDump(), sig.String(), ""), true
+}
+
+// signal sends the signal named by the ssh signal request to the process group of the running process.
+func (c *Channel) signal(name string) error {
+	sig := unix.SignalNum("SIG" + name)
+	if sig == 0 {
+		return fmt.Errorf("unknown signal %s", name)
+	}
+
+	process := c.session.process.Load()
+	if process == nil {
+		return errors.New("no running process")
+	}
+
+	if err := unix.Kill(-process.Pid, sig); err != nil {
+		return fmt.Errorf("failed to send %s to process group %d: %w", name, process.Pid, err)
+	}
+
+	return nil
+}
+
+// sendBreak sends a break to the terminal of the session.
+// The pty driver ignores breaks, so SIGINT is sent to the foreground process group instead,
+// which is what the line discipline does on a break with BRKINT set.
+func (c *Channel) sendBreak() error {
+	pty, _ := c.session.terminal()
+	if pty == nil {
+		return errors.New("break requires a pty")
+	}
+
+	pgrp, err := unix.IoctlGetInt(int(pty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return fmt.Errorf("failed to get foreground process group: %w", err)
+	}
+
+	if err := unix.Kill(-pgrp, unix.SIGINT); err != nil {
+		return fmt.Errorf("failed to interrupt process group %d: %w", pgrp, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package sshd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPOptions are the socket options applied to the accepted tcp connections.
+type TCPOptions struct {
+	// KeepAlivePeriod is the tcp keepalive period, zero uses the go default, negative disables keepalive.
+	KeepAlivePeriod time.Duration
+	// DisableNoDelay enables Nagle's algorithm, which is disabled by default.
+	DisableNoDelay bool
+	// ReadBuffer, if positive, sets the size of the receive buffer.
+	ReadBuffer int
+	// WriteBuffer, if positive, sets the size of the send buffer.
+	WriteBuffer int
+}
+
+// apply sets the options on conn, conns that are not tcp are left untouched.
+func (o *TCPOptions) apply(conn net.Conn) error {
+	if wsconn, ok := conn.(*wsConn); ok {
+		conn = wsconn.Conn
+	}
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		conn = tlsconn.NetConn()
+	}
+
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.KeepAlivePeriod < 0 {
+		if err := tcpconn.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("failed to disable tcp keepalive: %w", err)
+		}
+	} else if o.KeepAlivePeriod > 0 {
+		if err := tcpconn.SetKeepAlive(true); err != nil {
+			return fmt.Errorf("failed to enable tcp keepalive: %w", err)
+		}
+		if err := tcpconn.SetKeepAlivePeriod(o.KeepAlivePeriod); err != nil {
+			return fmt.Errorf("failed to set tcp keepalive period: %w", err)
+		}
+	}
+
+	if err := tcpconn.SetNoDelay(!o.DisableNoDelay); err != nil {
+		return fmt.Errorf("failed to set tcp nodelay: %w", err)
+	}
+
+	if o.ReadBuffer > 0 {
+		if err := tcpconn.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("failed to set read buffer: %w", err)
+		}
+	}
+
+	if o.WriteBuffer > 0 {
+		if err := tcpconn.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("failed to set write buffer: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1216 @@
+package sshd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHDConfig is a subset of the openssh sshd_config.
+type SSHDConfig struct {
+	// Port are the ports to listen on, defaults to 22.
+	Port []int
+	// ListenAddress are the addresses to listen on, which may contain a port.
+	ListenAddress []string
+	// HostKey are the paths of the host keys.
+	HostKey []string
+
+	// PermitRootLogin is one of yes, no, prohibit-password (or without-password) and forced-commands-only.
+	PermitRootLogin string
+	// PasswordAuthentication enables password authentication.
+	PasswordAuthentication bool
+	// PubkeyAuthentication enables public key authentication.
+	PubkeyAuthentication bool
+	// KbdInteractiveAuthentication enables keyboard interactive authentication.
+	KbdInteractiveAuthentication bool
+	// MaxAuthTries is the maximum number of authentication attempts per connection.
+	MaxAuthTries int
+	// Banner is the path of the file sent to the client before authentication, none disables it.
+	Banner string
+
+	// AllowTcpForwarding is one of yes, no, all, local and remote.
+	AllowTcpForwarding string
+	// PermitOpen are the destinations of local forwardings, any by default.
+	PermitOpen []string
+	// PermitListen are the addresses of remote forwardings, any by default.
+	PermitListen []string
+	// ForceCommand is the command run instead of the one requested by the client, none for nothing.
+	ForceCommand string
+	// PermitTTY allows pty allocation.
+	PermitTTY bool
+	// DisableForwarding disables all forwarding, overriding AllowTcpForwarding.
+	DisableForwarding bool
+	// AcceptEnv are the patterns of the environment variables the clients can set.
+	AcceptEnv []string
+	// SetEnv are the environment variables in the form of key=value set for the sessions.
+	SetEnv []string
+	// Subsystem maps subsystem names to their commands.
+	Subsystem map[string]string
+
+	// MaxSessions is the maximum number of open sessions per connection.
+	MaxSessions int
+	// MaxStartups limits the concurrent unauthenticated connections.
+	MaxStartups MaxStartups
+
+	// PerSourceMaxStartups limits the concurrent unauthenticated connections from the same address, 0 means no limit.
+	PerSourceMaxStartups int
+	// UseDNS resolves the host names of the clients, which are then matched by Match Host.
+	UseDNS bool
+
+	// UsePAM opens a pam session of the sshd service around each program of the sessions.
+	UsePAM bool
+
+	// PrintMotd prints /etc/motd at the start of shell sessions.
+	PrintMotd bool
+
+	// VersionAddendum is appended to the identification string of the server, none for nothing.
+	VersionAddendum string
+
+	// RekeyLimit is the number of bytes after which the session keys are renegotiated, 0 means the default of x/crypto.
+	// x/crypto can't renegotiate on a timer, so the time limit of RekeyLimit can only be none.
+	RekeyLimit uint64
+
+	// LoginGraceTime is the time for clients to authenticate, 0 means no limit.
+	LoginGraceTime time.Duration
+
+	// TCPKeepAlive enables tcp keepalive.
+	TCPKeepAlive bool
+	// SessionTimeout is the idle timeout of session channels set by ChannelTimeout, 0 means no limit.
+	SessionTimeout time.Duration
+
+	// ClientAliveInterval is the interval to send keepalive probes, 0 disables probing.
+	ClientAliveInterval time.Duration
+	// ClientAliveCountMax is the number of unanswered probes before disconnecting.
+	ClientAliveCountMax int
+
+	// Algorithms are the algorithms set by KexAlgorithms, Ciphers, MACs and PubkeyAcceptedAlgorithms,
+	// nil if none of them is set.
+	Algorithms *AlgorithmPolicy
+
+	// Match are the conditional blocks, in the order they appear.
+	Match []*SSHDConfigMatch
+
+	// Unsupported are the directives that are not understood.
+	Unsupported []*SSHDConfigDirective
+
+	// seen records the keywords already set, since the first obtained value is used.
+	seen map[string]bool
+}
+
+// SSHDConfigDirective is a single keyword with its arguments.
+type SSHDConfigDirective struct {
+	Keyword string
+	Args    []string
+	// Line is the line number in the config file.
+	Line int
+}
+
+// matchKeywords are the keywords applied per connection in the Match blocks,
+// the other keywords are rejected there instead of being ignored.
+var matchKeywords = map[string]bool{
+	"permitrootlogin":                 true,
+	"passwordauthentication":          true,
+	"pubkeyauthentication":            true,
+	"kbdinteractiveauthentication":    true,
+	"challengeresponseauthentication": true,
+	"allowtcpforwarding":              true,
+	"permitopen":                      true,
+	"permitlisten":                    true,
+	"forcecommand":                    true,
+	"permittty":                       true,
+	"disableforwarding":               true,
+	"setenv":                          true,
+}
+
+// SSHDConfigMatch is a Match block.
+type SSHDConfigMatch struct {
+	// Criteria are the criteria keywords (lower-cased) and patterns, all of which must match.
+	Criteria []SSHDConfigDirective
+	// Directives are the directives applied when the criteria match, limited to the authentication,
+	// forwarding, pty, ForceCommand and SetEnv directives.
+	Directives []*SSHDConfigDirective
+}
+
+// NewSSHDConfig creates the config with the openssh defaults.
+func NewSSHDConfig() *SSHDConfig {
+	return &SSHDConfig{
+		PermitRootLogin:              "prohibit-password",
+		PasswordAuthentication:       true,
+		PubkeyAuthentication:         true,
+		KbdInteractiveAuthentication: true,
+		MaxAuthTries:                 6,
+		Banner:                       "none",
+		AllowTcpForwarding:           "yes",
+		MaxSessions:                  10,
+		ClientAliveCountMax:          3,
+		TCPKeepAlive:                 true,
+		LoginGraceTime:               2 * time.Minute,
+		VersionAddendum:              "none",
+		PrintMotd:                    true,
+		PermitTTY:                    true,
+		MaxStartups:                  MaxStartups{Start: 10, Rate: 30, Full: 100},
+		Subsystem:                    make(map[string]string),
+		seen:                         make(map[string]bool),
+	}
+}
+
+// LoadSSHDConfig reads and parses the sshd_config file at path.
+func LoadSSHDConfig(path string) (*SSHDConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sshd config %s: %w", path, err)
+	}
+	defer f.Close()
+
+	c, err := ParseSSHDConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sshd config %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// ParseSSHDConfig parses sshd_config from r.
+func ParseSSHDConfig(r io.Reader) (*SSHDConfig, error) {
+	c := NewSSHDConfig()
+
+	var match *SSHDConfigMatch
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+
+		d, err := parseSSHDConfigLine(scanner.Text(), lineno)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			continue
+		}
+
+		if d.Keyword == "match" {
+			match, err = parseSSHDConfigMatch(d)
+			if err != nil {
+				return nil, err
+			}
+			c.Match = append(c.Match, match)
+			continue
+		}
+
+		if match != nil {
+			if !matchKeywords[d.Keyword] {
+				return nil, fmt.Errorf("line %d: %s is not supported in Match", d.Line, d.Keyword)
+			}
+			// validate the directive early, the result is discarded.
+			if err := NewSSHDConfig().apply(d, true); err != nil {
+				return nil, err
+			}
+			match.Directives = append(match.Directives, d)
+			continue
+		}
+
+		if err := c.apply(d, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sshd config: %w", err)
+	}
+
+	if len(c.Port) == 0 {
+		c.Port = []int{22}
+	}
+
+	return c, nil
+}
+
+// Addrs returns the addresses to listen on.
+func (c *SSHDConfig) Addrs() []string {
+	if len(c.ListenAddress) == 0 {
+		addrs := make([]string, 0, len(c.Port))
+		for _, port := range c.Port {
+			addrs = append(addrs, net.JoinHostPort("", strconv.Itoa(port)))
+		}
+		return addrs
+	}
+
+	addrs := make([]string, 0, len(c.ListenAddress)*len(c.Port))
+	for _, addr := range c.ListenAddress {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			addrs = append(addrs, addr)
+			continue
+		}
+
+		for _, port := range c.Port {
+			addrs = append(addrs, net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(port)))
+		}
+	}
+
+	return addrs
+}
+
+// ForConn returns the effective config for the user connecting from remoteAddr to localAddr,
+// with the directives of all the matching Match blocks applied.
+// If UseDNS is set, Match Host also matches the host name of remoteAddr.
+// Match Group looks up the groups of the user with os/user.
+func (c *SSHDConfig) ForConn(username string, remoteAddr, localAddr net.Addr) (*SSHDConfig, error) {
+	return c.forConn(username, nil, remoteAddr, localAddr)
+}
+
+// forConn is ForConn with the account of the user from the user backend of the server,
+// which is looked up with os/user if it is nil.
+func (c *SSHDConfig) forConn(username string, account *UserInfo, remoteAddr, localAddr net.Addr) (*SSHDConfig, error) {
+	result := c.clone()
+
+	for _, match := range c.Match {
+		matched, err := match.matches(username, account, remoteAddr, localAddr, c.UseDNS)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+
+		for _, d := range match.Directives {
+			if err := result.apply(d, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Apply configures the server with the global directives:
+// host keys are loaded and set, and the authentication callbacks of the server config are
+// disabled or restricted according to the authentication directives and PermitRootLogin.
+// The authentication, the features available to the sessions and SetEnv are decided per connection,
+// with the Match blocks applied.
+func (c *SSHDConfig) Apply(s *Server) error {
+	if len(c.HostKey) > 0 {
+		signers := make([]ssh.Signer, 0, len(c.HostKey))
+		for _, keypath := range c.HostKey {
+			keybytes, err := os.ReadFile(keypath)
+			if err != nil {
+				return fmt.Errorf("failed to read host key %s: %w", keypath, err)
+			}
+
+			signer, err := ssh.ParsePrivateKey(keybytes)
+			if err != nil {
+				return fmt.Errorf("failed to parse host key %s: %w", keypath, err)
+			}
+
+			signers = append(signers, signer)
+		}
+
+		if err := s.SetHostKeys(signers...); err != nil {
+			return err
+		}
+	}
+
+	if s.Config == nil {
+		s.Config = &ssh.ServerConfig{}
+	}
+
+	s.MaxSessions = c.MaxSessions
+	if c.Algorithms != nil {
+		s.Algorithms = c.Algorithms
+	}
+	s.ClientAliveInterval = c.ClientAliveInterval
+	s.SessionIdleTimeout = c.SessionTimeout
+	if !c.TCPKeepAlive {
+		s.TCP.KeepAlivePeriod = -1
+	}
+	s.ClientAliveCountMax = c.ClientAliveCountMax
+	s.MaxStartups = c.MaxStartups
+	s.PerSourceMaxStartups = c.PerSourceMaxStartups
+	s.LoginGraceTime = c.LoginGraceTime
+	s.UseDNS = c.UseDNS
+
+	// like openssh, sftp is only served if the subsystem is configured.
+	switch sftpServer, ok := c.Subsystem["sftp"]; {
+	case !ok:
+		s.DisableSFTP = true
+	case sftpServer == InternalSFTP:
+		s.SFTPServer = ""
+	default:
+		s.SFTPServer = sftpServer
+	}
+	s.Env = c.SetEnv
+	if c.UsePAM {
+		s.PAMService = "sshd"
+	}
+	// openssh accepts nothing without AcceptEnv.
+	s.AcceptEnv = c.AcceptEnv
+	if s.AcceptEnv == nil {
+		s.AcceptEnv = []string{}
+	}
+
+	s.Features = c.features()
+	if len(c.Match) > 0 {
+		s.UserFeatures = func(info ConnInfo) Features {
+			effective, err := c.forConn(info.User, info.Account, info.RemoteAddr, info.LocalAddr)
+			if err != nil {
+				s.logger().Warn("failed to match sshd config for connection", "user", info.User, "err", err.Error())
+				return c.features()
+			}
+			return effective.features()
+		}
+		s.UserEnv = func(info ConnInfo) []string {
+			effective, err := c.forConn(info.User, info.Account, info.RemoteAddr, info.LocalAddr)
+			if err != nil {
+				return nil
+			}
+			return effective.SetEnv
+		}
+	}
+	if !c.PrintMotd {
+		s.MOTD = nil
+	} else if s.MOTD == nil {
+		s.MOTD = &MOTDOptions{}
+	}
+
+	config := s.Config
+	config.MaxAuthTries = c.MaxAuthTries
+	config.RekeyThreshold = c.RekeyLimit
+
+	if c.VersionAddendum != "none" && c.VersionAddendum != "" {
+		base := config.ServerVersion
+		if base == "" {
+			base = defaultServerVersion
+		}
+		v := base + " " + c.VersionAddendum
+		if err := ValidateServerVersion(v); err != nil {
+			return fmt.Errorf("invalid VersionAddendum: %w", err)
+		}
+		config.ServerVersion = v
+	}
+
+	if c.Banner != "none" && c.Banner != "" {
+		banner, err := os.ReadFile(c.Banner)
+		if err != nil {
+			return fmt.Errorf("failed to read banner %s: %w", c.Banner, err)
+		}
+
+		config.BannerCallback = func(ssh.ConnMetadata) string {
+			return string(banner)
+		}
+	}
+
+	c.applyAuthentication(s, config)
+
+	for _, d := range c.Unsupported {
+		s.logger().Info("unsupported sshd config directive", "keyword", d.Keyword, "line", d.Line)
+	}
+
+	return nil
+}
+
+// applyAuthentication disables or restricts the authentication callbacks of config
+// according to the authentication directives and PermitRootLogin, with the Match blocks of the connection applied.
+// Unless PermitRootLogin is yes, root can only login with public keys,
+// and with forced-commands-only, only if a command is forced by the permissions of the key or ForceCommand.
+func (c *SSHDConfig) applyAuthentication(s *Server, config *ssh.ServerConfig) {
+	errRootLogin := errors.New("root login is not permitted")
+
+	if cb := config.PasswordCallback; cb != nil && c.mayEnable(c.PasswordAuthentication, "passwordauthentication") {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			effective, err := c.forAuth(s, conn)
+			if err != nil {
+				return nil, err
+			}
+			if !effective.PasswordAuthentication {
+				return nil, errors.New("password authentication is disabled")
+			}
+			if conn.User() == "root" && effective.PermitRootLogin != "yes" {
+				return nil, errRootLogin
+			}
+			return cb(conn, password)
+		}
+	} else {
+		config.PasswordCallback = nil
+	}
+
+	if cb := config.KeyboardInteractiveCallback; cb != nil &&
+		c.mayEnable(c.KbdInteractiveAuthentication, "kbdinteractiveauthentication", "challengeresponseauthentication") {
+		config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			effective, err := c.forAuth(s, conn)
+			if err != nil {
+				return nil, err
+			}
+			if !effective.KbdInteractiveAuthentication {
+				return nil, errors.New("keyboard interactive authentication is disabled")
+			}
+			if conn.User() == "root" && effective.PermitRootLogin != "yes" {
+				return nil, errRootLogin
+			}
+			return cb(conn, client)
+		}
+	} else {
+		config.KeyboardInteractiveCallback = nil
+	}
+
+	if cb := config.PublicKeyCallback; cb != nil && c.mayEnable(c.PubkeyAuthentication, "pubkeyauthentication") {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			effective, err := c.forAuth(s, conn)
+			if err != nil {
+				return nil, err
+			}
+			if !effective.PubkeyAuthentication {
+				return nil, errors.New("public key authentication is disabled")
+			}
+			if conn.User() != "root" {
+				return cb(conn, key)
+			}
+
+			switch effective.PermitRootLogin {
+			case "no":
+				return nil, errRootLogin
+			case "forced-commands-only":
+				perms, err := cb(conn, key)
+				if err != nil {
+					return nil, err
+				}
+				forced := effective.features().ForceCommand != ""
+				if perms != nil {
+					if _, ok := perms.CriticalOptions["force-command"]; ok {
+						forced = true
+					}
+				}
+				if !forced {
+					return nil, errRootLogin
+				}
+				return perms, nil
+			default:
+				return cb(conn, key)
+			}
+		}
+	} else {
+		config.PublicKeyCallback = nil
+	}
+}
+
+// mayEnable checks if an authentication method is enabled globally, or may be by one of the Match blocks
+// with one of the keywords.
+func (c *SSHDConfig) mayEnable(enabled bool, keywords ...string) bool {
+	if enabled {
+		return true
+	}
+
+	for _, match := range c.Match {
+		for _, d := range match.Directives {
+			if slices.Contains(keywords, d.Keyword) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// forAuth returns the effective config for the connection being authenticated,
+// with the account of the user from the user backend of s.
+func (c *SSHDConfig) forAuth(s *Server, conn ssh.ConnMetadata) (*SSHDConfig, error) {
+	if len(c.Match) == 0 {
+		return c, nil
+	}
+
+	// the account is only needed for Match Group, which then falls back to os/user.
+	account, err := s.lookupUser(conn.User())
+	if err != nil {
+		account = nil
+	}
+
+	effective, err := c.forConn(conn.User(), account, conn.RemoteAddr(), conn.LocalAddr())
+	if err != nil {
+		return nil, fmt.Errorf("failed to match sshd config: %w", err)
+	}
+
+	return effective, nil
+}
+
+// apply sets the directive on the config.
+// Unless override is set, the directive is ignored if the keyword is already set.
+func (c *SSHDConfig) apply(d *SSHDConfigDirective, override bool) error {
+	single := func() (string, error) {
+		if len(d.Args) != 1 {
+			return "", fmt.Errorf("line %d: %s requires exactly one argument", d.Line, d.Keyword)
+		}
+		return d.Args[0], nil
+	}
+
+	oneOf := func(choices ...string) (string, error) {
+		v, err := single()
+		if err != nil {
+			return "", err
+		}
+		v = strings.ToLower(v)
+		if !slices.Contains(choices, v) {
+			return "", fmt.Errorf("line %d: unsupported value for %s: %s", d.Line, d.Keyword, v)
+		}
+		return v, nil
+	}
+
+	yesno := func() (bool, error) {
+		v, err := oneOf("yes", "no")
+		return v == "yes", err
+	}
+
+	if !override && c.seen[d.Keyword] {
+		switch d.Keyword {
+		case "port", "listenaddress", "hostkey", "subsystem", "acceptenv":
+			// those can be specified multiple times.
+		default:
+			return nil
+		}
+	}
+	c.seen[d.Keyword] = true
+
+	var err error
+
+	switch d.Keyword {
+	case "port":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		port, e := strconv.Atoi(v)
+		if e != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("line %d: invalid port: %s", d.Line, v)
+		}
+		c.Port = append(c.Port, port)
+
+	case "listenaddress":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: ListenAddress requires an address", d.Line)
+		}
+		c.ListenAddress = append(c.ListenAddress, d.Args[0])
+
+	case "hostkey":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.HostKey = append(c.HostKey, v)
+
+	case "permitrootlogin":
+		c.PermitRootLogin, err = oneOf("yes", "no", "prohibit-password", "without-password", "forced-commands-only")
+		if c.PermitRootLogin == "without-password" {
+			c.PermitRootLogin = "prohibit-password"
+		}
+
+	case "passwordauthentication":
+		c.PasswordAuthentication, err = yesno()
+
+	case "pubkeyauthentication":
+		c.PubkeyAuthentication, err = yesno()
+
+	case "kbdinteractiveauthentication", "challengeresponseauthentication":
+		c.KbdInteractiveAuthentication, err = yesno()
+
+	case "maxauthtries":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.MaxAuthTries, err = strconv.Atoi(v)
+		if err != nil || c.MaxAuthTries < 0 {
+			return fmt.Errorf("line %d: invalid MaxAuthTries: %s", d.Line, v)
+		}
+
+	case "maxsessions":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.MaxSessions, err = strconv.Atoi(v)
+		if err != nil || c.MaxSessions < 0 {
+			return fmt.Errorf("line %d: invalid MaxSessions: %s", d.Line, v)
+		}
+
+	case "maxstartups":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.MaxStartups, err = ParseMaxStartups(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", d.Line, err)
+		}
+
+	case "persourcemaxstartups":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		if strings.ToLower(v) == "none" {
+			c.PerSourceMaxStartups = 0
+			break
+		}
+		c.PerSourceMaxStartups, err = strconv.Atoi(v)
+		if err != nil || c.PerSourceMaxStartups < 0 {
+			return fmt.Errorf("line %d: invalid PerSourceMaxStartups: %s", d.Line, v)
+		}
+
+	case "usedns":
+		c.UseDNS, err = yesno()
+
+	case "printmotd":
+		c.PrintMotd, err = yesno()
+
+	case "versionaddendum":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: VersionAddendum requires an argument", d.Line)
+		}
+		c.VersionAddendum = strings.Join(d.Args, " ")
+
+	case "rekeylimit":
+		if len(d.Args) < 1 || len(d.Args) > 2 {
+			return fmt.Errorf("line %d: RekeyLimit requires one or two arguments", d.Line)
+		}
+		c.RekeyLimit, err = parseRekeyData(d.Args[0])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid RekeyLimit: %w", d.Line, err)
+		}
+		if len(d.Args) == 2 && d.Args[1] != "none" && d.Args[1] != "default" {
+			interval, e := parseSSHDConfigTime(d.Args[1])
+			if e != nil {
+				return fmt.Errorf("line %d: invalid RekeyLimit: %w", d.Line, e)
+			}
+			if interval > 0 {
+				return fmt.Errorf("line %d: time based RekeyLimit is not supported: %s", d.Line, d.Args[1])
+			}
+		}
+
+	case "logingracetime":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.LoginGraceTime, err = parseSSHDConfigTime(v)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid LoginGraceTime: %w", d.Line, err)
+		}
+
+	case "tcpkeepalive":
+		c.TCPKeepAlive, err = yesno()
+
+	case "channeltimeout":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: ChannelTimeout requires an argument", d.Line)
+		}
+		for _, arg := range d.Args {
+			if arg == "none" {
+				c.SessionTimeout = 0
+				continue
+			}
+
+			channelType, interval, found := strings.Cut(arg, "=")
+			if !found {
+				return fmt.Errorf("line %d: invalid ChannelTimeout: %s", d.Line, arg)
+			}
+
+			timeout, err := parseSSHDConfigTime(interval)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid ChannelTimeout: %w", d.Line, err)
+			}
+
+			// only session channels are supported.
+			if matchWildcard(channelType, "session") {
+				c.SessionTimeout = timeout
+			}
+		}
+
+	case "clientaliveinterval":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.ClientAliveInterval, err = parseSSHDConfigTime(v)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid ClientAliveInterval: %w", d.Line, err)
+		}
+
+	case "clientalivecountmax":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		c.ClientAliveCountMax, err = strconv.Atoi(v)
+		if err != nil || c.ClientAliveCountMax < 0 {
+			return fmt.Errorf("line %d: invalid ClientAliveCountMax: %s", d.Line, v)
+		}
+
+	case "kexalgorithms", "ciphers", "macs", "pubkeyacceptedalgorithms", "pubkeyacceptedkeytypes":
+		v, e := single()
+		if e != nil {
+			return e
+		}
+		if c.Algorithms == nil {
+			c.Algorithms = &AlgorithmPolicy{}
+		}
+		switch d.Keyword {
+		case "kexalgorithms":
+			c.Algorithms.KeyExchanges = parseAlgorithmList(v, DefaultAlgorithms.KeyExchanges)
+		case "ciphers":
+			c.Algorithms.Ciphers = parseAlgorithmList(v, DefaultAlgorithms.Ciphers)
+		case "macs":
+			c.Algorithms.MACs = parseAlgorithmList(v, DefaultAlgorithms.MACs)
+		default:
+			c.Algorithms.PublicKeyAuthAlgorithms = parseAlgorithmList(v, DefaultAlgorithms.PublicKeyAuthAlgorithms)
+		}
+
+	case "banner":
+		c.Banner, err = single()
+
+	case "allowtcpforwarding":
+		c.AllowTcpForwarding, err = oneOf("yes", "no", "all", "local", "remote")
+
+	case "forcecommand":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: ForceCommand requires an argument", d.Line)
+		}
+		c.ForceCommand = strings.Join(d.Args, " ")
+
+	case "usepam":
+		c.UsePAM, err = yesno()
+
+	case "permitopen", "permitlisten":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: %s requires an argument", d.Line, d.Keyword)
+		}
+		if d.Keyword == "permitopen" {
+			c.PermitOpen = slices.Clone(d.Args)
+		} else {
+			c.PermitListen = slices.Clone(d.Args)
+		}
+
+	case "permittty":
+		c.PermitTTY, err = yesno()
+
+	case "disableforwarding":
+		c.DisableForwarding, err = yesno()
+
+	case "acceptenv":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: AcceptEnv requires an argument", d.Line)
+		}
+		c.AcceptEnv = append(c.AcceptEnv, d.Args...)
+
+	case "setenv":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("line %d: SetEnv requires an argument", d.Line)
+		}
+		for _, kv := range d.Args {
+			if name, _, ok := strings.Cut(kv, "="); !ok || name == "" {
+				return fmt.Errorf("line %d: invalid environment variable for SetEnv: %s", d.Line, kv)
+			}
+		}
+		c.SetEnv = slices.Clone(d.Args)
+
+	case "subsystem":
+		if len(d.Args) < 2 {
+			return fmt.Errorf("line %d: Subsystem requires a name and a command", d.Line)
+		}
+		if _, ok := c.Subsystem[d.Args[0]]; ok && !override {
+			return fmt.Errorf("line %d: subsystem %s is defined multiple times", d.Line, d.Args[0])
+		}
+		c.Subsystem[d.Args[0]] = strings.Join(d.Args[1:], " ")
+
+	default:
+		c.Unsupported = append(c.Unsupported, d)
+	}
+
+	return err
+}
+
+func (c *SSHDConfig) clone() *SSHDConfig {
+	result := *c
+	result.Port = slices.Clone(c.Port)
+	result.ListenAddress = slices.Clone(c.ListenAddress)
+	result.HostKey = slices.Clone(c.HostKey)
+	result.AcceptEnv = slices.Clone(c.AcceptEnv)
+	result.SetEnv = slices.Clone(c.SetEnv)
+	result.PermitOpen = slices.Clone(c.PermitOpen)
+	result.PermitListen = slices.Clone(c.PermitListen)
+	result.Unsupported = slices.Clone(c.Unsupported)
+	if c.Algorithms != nil {
+		algorithms := *c.Algorithms
+		result.Algorithms = &algorithms
+	}
+	result.Subsystem = make(map[string]string, len(c.Subsystem))
+	for k, v := range c.Subsystem {
+		result.Subsystem[k] = v
+	}
+	result.seen = make(map[string]bool, len(c.seen))
+	for k, v := range c.seen {
+		result.seen[k] = v
+	}
+
+	return &result
+}
+
+// features returns the features allowed by the directives.
+func (c *SSHDConfig) features() Features {
+	forceCommand := c.ForceCommand
+	if forceCommand == "none" {
+		forceCommand = ""
+	}
+
+	return Features{
+		DisablePTY:              !c.PermitTTY,
+		ForceCommand:            forceCommand,
+		DisableLocalForwarding:  c.DisableForwarding || c.AllowTcpForwarding == "no" || c.AllowTcpForwarding == "remote",
+		DisableRemoteForwarding: c.DisableForwarding || c.AllowTcpForwarding == "no" || c.AllowTcpForwarding == "local",
+		PermitOpen:              c.PermitOpen,
+		PermitListen:            c.PermitListen,
+	}
+}
+
+// parseRekeyData parses the data limit of RekeyLimit, which is a number of bytes with an optional K, M or G suffix,
+// or default or none.
+func parseRekeyData(s string) (uint64, error) {
+	switch s {
+	case "default":
+		return 0, nil
+	case "none":
+		return math.MaxUint64, nil
+	}
+
+	if s == "" {
+		return 0, errors.New("empty data size")
+	}
+
+	multiplier := uint64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		multiplier = 1 << 10
+	case 'M', 'm':
+		multiplier = 1 << 20
+	case 'G', 'g':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("invalid data size: %s", s)
+	}
+
+	return v * multiplier, nil
+}
+
+// parseSSHDConfigTime parses the time format of sshd_config, such as 30, 10m or 1h30m, where no unit means seconds.
+func parseSSHDConfigTime(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("empty time")
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second, 'S': time.Second,
+		'm': time.Minute, 'M': time.Minute,
+		'h': time.Hour, 'H': time.Hour,
+		'd': 24 * time.Hour, 'D': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour, 'W': 7 * 24 * time.Hour,
+	}
+
+	var total time.Duration
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			continue
+		}
+
+		unit, ok := units[c]
+		if !ok || i == start {
+			return 0, fmt.Errorf("invalid time: %s", s)
+		}
+
+		v, err := strconv.Atoi(s[start:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid time: %s", s)
+		}
+
+		total += time.Duration(v) * unit
+		start = i + 1
+	}
+
+	if start < len(s) {
+		v, err := strconv.Atoi(s[start:])
+		if err != nil {
+			return 0, fmt.Errorf("invalid time: %s", s)
+		}
+		total += time.Duration(v) * time.Second
+	}
+
+	return total, nil
+}
+
+// parseSSHDConfigLine parses a line into a directive, nil is returned for empty lines and comments.
+func parseSSHDConfigLine(line string, lineno int) (*SSHDConfigDirective, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	// the keyword is separated from the arguments by white spaces, and an optional =.
+	keyword, rest := line, ""
+	if i := strings.IndexAny(line, " \t="); i >= 0 {
+		keyword, rest = line[:i], strings.TrimSpace(line[i:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+	}
+
+	args, err := splitSSHDConfigArgs(rest)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineno, err)
+	}
+
+	return &SSHDConfigDirective{
+		Keyword: strings.ToLower(keyword),
+		Args:    args,
+		Line:    lineno,
+	}, nil
+}
+
+// splitSSHDConfigArgs splits the arguments by white spaces, honoring double quotes.
+func splitSSHDConfigArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuote := false
+	hasArg := false
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case !inQuote && (r == ' ' || r == '\t'):
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		case !inQuote && r == '#' && !hasArg:
+			// trailing comment
+			return args, nil
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+
+	if hasArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+func parseSSHDConfigMatch(d *SSHDConfigDirective) (*SSHDConfigMatch, error) {
+	match := &SSHDConfigMatch{}
+
+	args := d.Args
+	for len(args) > 0 {
+		criterion := strings.ToLower(args[0])
+		if criterion == "all" {
+			match.Criteria = append(match.Criteria, SSHDConfigDirective{Keyword: criterion, Line: d.Line})
+			args = args[1:]
+			continue
+		}
+
+		if len(args) < 2 {
+			return nil, fmt.Errorf("line %d: Match %s requires a pattern", d.Line, args[0])
+		}
+
+		switch criterion {
+		case "user", "group", "host", "address", "localaddress", "localport":
+		default:
+			return nil, fmt.Errorf("line %d: unsupported Match criterion: %s", d.Line, args[0])
+		}
+
+		match.Criteria = append(match.Criteria, SSHDConfigDirective{
+			Keyword: criterion,
+			Args:    strings.Split(args[1], ","),
+			Line:    d.Line,
+		})
+		args = args[2:]
+	}
+
+	if len(match.Criteria) == 0 {
+		return nil, fmt.Errorf("line %d: Match requires criteria", d.Line)
+	}
+
+	return match, nil
+}
+
+func (m *SSHDConfigMatch) matches(username string, account *UserInfo, remoteAddr, localAddr net.Addr, useDNS bool) (bool, error) {
+	remoteHost := addrHost(remoteAddr)
+	remoteName := remoteHost
+	if useDNS && net.ParseIP(remoteHost) != nil {
+		remoteName = remoteHosts.lookup(remoteHost)
+	}
+	localHost, localPort := addrHost(localAddr), addrPort(localAddr)
+
+	for _, criterion := range m.Criteria {
+		var matched bool
+		switch criterion.Keyword {
+		case "all":
+			matched = true
+		case "user":
+			matched = matchPatternList(criterion.Args, username)
+		case "host":
+			matched = matchAddrPatternList(criterion.Args, remoteHost) ||
+				(remoteName != remoteHost && matchPatternList(criterion.Args, remoteName))
+		case "address":
+			matched = matchAddrPatternList(criterion.Args, remoteHost)
+		case "localaddress":
+			matched = matchAddrPatternList(criterion.Args, localHost)
+		case "localport":
+			matched = matchPatternList(criterion.Args, localPort)
+		case "group":
+			groups, err := userGroupNames(username, account)
+			if err != nil {
+				return false, err
+			}
+			for _, group := range groups {
+				if matchPatternList(criterion.Args, group) {
+					matched = true
+					break
+				}
+			}
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// matchPatternList checks s against the openssh pattern list,
+// where patterns can contain * and ?, and negated patterns prefixed with ! reject the match.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if !matchWildcard(pattern, s) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// matchAddrPatternList is like matchPatternList, but also supports CIDR notations.
+func matchAddrPatternList(patterns []string, addr string) bool {
+	ip := net.ParseIP(addr)
+
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var hit bool
+		if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+			hit = ip != nil && ipnet.Contains(ip)
+		} else {
+			hit = matchWildcard(pattern, addr)
+		}
+
+		if !hit {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// matchWildcard matches s against pattern with * matching any sequence and ? matching a single character.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchWildcard(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func addrHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+func addrPort(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+
+	return port
+}
@@ -0,0 +1,304 @@
+package sshd
+
+import (
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHDConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+		wantErr bool
+	}{
+		{line: "", keyword: ""},
+		{line: "   # comment", keyword: ""},
+		{line: "Port 2222", keyword: "port", args: []string{"2222"}},
+		{line: "Port\t2222", keyword: "port", args: []string{"2222"}},
+		{line: "PermitTTY\tno", keyword: "permittty", args: []string{"no"}},
+		{line: "  DisableForwarding \t yes  ", keyword: "disableforwarding", args: []string{"yes"}},
+		{line: "Port=2222", keyword: "port", args: []string{"2222"}},
+		{line: "Port = 2222", keyword: "port", args: []string{"2222"}},
+		{line: "Port\t=\t2222", keyword: "port", args: []string{"2222"}},
+		{line: "AcceptEnv LANG\tLC_* # locale", keyword: "acceptenv", args: []string{"LANG", "LC_*"}},
+		{line: `Banner "/etc/my banner"`, keyword: "banner", args: []string{"/etc/my banner"}},
+		{line: `RekeyLimit ""`, keyword: "rekeylimit", args: []string{""}},
+		{line: "UsePAM", keyword: "usepam"},
+		{line: `Banner "/etc/banner`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			d, err := parseSSHDConfigLine(tt.line, 1)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+
+			if tt.keyword == "" {
+				if d != nil {
+					t.Fatalf("expected no directive, got %+v", d)
+				}
+				return
+			}
+			if d == nil {
+				t.Fatal("expected a directive, got nil")
+			}
+			if d.Keyword != tt.keyword || !slices.Equal(d.Args, tt.args) {
+				t.Errorf("got %q %q, want %q %q", d.Keyword, d.Args, tt.keyword, tt.args)
+			}
+		})
+	}
+}
+
+func TestParseSSHDConfigTabs(t *testing.T) {
+	c, err := ParseSSHDConfig(strings.NewReader("Port\t2222\nPermitTTY\tno\nDisableForwarding\tyes\n"))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if !slices.Equal(c.Port, []int{2222}) {
+		t.Errorf("Port is %v, want [2222]", c.Port)
+	}
+	if c.PermitTTY {
+		t.Error("PermitTTY is not disabled")
+	}
+	if !c.DisableForwarding {
+		t.Error("DisableForwarding is not enabled")
+	}
+}
+
+func TestParseRekeyData(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint64
+		wantErr bool
+	}{
+		{s: "default", want: 0},
+		{s: "none", want: math.MaxUint64},
+		{s: "1024", want: 1024},
+		{s: "1K", want: 1 << 10},
+		{s: "2m", want: 2 << 20},
+		{s: "1G", want: 1 << 30},
+		{s: "", wantErr: true},
+		{s: "K", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "1T", wantErr: true},
+		{s: "18446744073709551615G", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseRekeyData(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchGroupUsesAccount(t *testing.T) {
+	c, err := ParseSSHDConfig(strings.NewReader("PermitTTY yes\nMatch Group automation\n\tPermitTTY no\n"))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	s := &Server{}
+	if err := c.Apply(s); err != nil {
+		t.Fatalf("failed to apply config: %v", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	info := ConnInfo{User: "bot", RemoteAddr: addr, LocalAddr: addr, Account: &UserInfo{Groups: []string{"automation"}}}
+	if !s.UserFeatures(info).DisablePTY {
+		t.Error("pty is allowed for a member of the group from the user backend")
+	}
+
+	info.Account = &UserInfo{Groups: []string{"staff-from-directory"}}
+	if s.UserFeatures(info).DisablePTY {
+		t.Error("pty is denied for a user outside of the group")
+	}
+}
+
+func TestDenyPTYForUsesAccount(t *testing.T) {
+	features := DenyPTYFor(Features{}, nil, []string{"automation"})
+
+	if !features(ConnInfo{User: "bot", Account: &UserInfo{Groups: []string{"automation"}}}).DisablePTY {
+		t.Error("pty is allowed for a member of the group from the user backend")
+	}
+	if features(ConnInfo{User: "alice", Account: &UserInfo{Groups: []string{}}}).DisablePTY {
+		t.Error("pty is denied for a user without groups")
+	}
+}
+
+func TestMatchUnsupportedKeyword(t *testing.T) {
+	for _, config := range []string{
+		"Match User bob\n\tMaxSessions 2\n",
+		"Match User bob\n\tBanner /etc/banner\n",
+		"Match User bob\n\tNoSuchKeyword yes\n",
+	} {
+		if _, err := ParseSSHDConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("directive not applied in Match is accepted: %q", config)
+		}
+	}
+}
+
+// testConnMetadata is the metadata of a connection being authenticated.
+type testConnMetadata struct {
+	user   string
+	remote net.Addr
+}
+
+func (m testConnMetadata) User() string          { return m.user }
+func (m testConnMetadata) SessionID() []byte     { return nil }
+func (m testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (m testConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-test") }
+func (m testConnMetadata) RemoteAddr() net.Addr  { return m.remote }
+func (m testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
+
+func TestMatchAuthentication(t *testing.T) {
+	c, err := ParseSSHDConfig(strings.NewReader("PubkeyAuthentication no\n" +
+		"Match Address 10.0.0.0/8\n\tPasswordAuthentication no\n" +
+		"Match User deploy\n\tPubkeyAuthentication yes\n"))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	s := &Server{
+		Config: &ssh.ServerConfig{
+			PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+				return &ssh.Permissions{}, nil
+			},
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				return &ssh.Permissions{}, nil
+			},
+		},
+		Users: StaticUsers{"alice": {}, "deploy": {}},
+	}
+	if err := c.Apply(s); err != nil {
+		t.Fatalf("failed to apply config: %v", err)
+	}
+
+	inside := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 50000}
+	outside := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 50000}
+
+	if _, err := s.Config.PasswordCallback(testConnMetadata{user: "alice", remote: inside}, nil); err == nil {
+		t.Error("password is accepted with PasswordAuthentication no in the matching block")
+	}
+	if _, err := s.Config.PasswordCallback(testConnMetadata{user: "alice", remote: outside}, nil); err != nil {
+		t.Errorf("password is rejected outside of the matching block: %v", err)
+	}
+
+	if s.Config.PublicKeyCallback == nil {
+		t.Fatal("public key authentication enabled by a Match block is removed")
+	}
+	if _, err := s.Config.PublicKeyCallback(testConnMetadata{user: "alice", remote: outside}, nil); err == nil {
+		t.Error("public key is accepted with PubkeyAuthentication no")
+	}
+	if _, err := s.Config.PublicKeyCallback(testConnMetadata{user: "deploy", remote: outside}, nil); err != nil {
+		t.Errorf("public key is rejected with PubkeyAuthentication yes in the matching block: %v", err)
+	}
+}
+
+func TestPermitRootLoginForcedCommandsOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		perms  *ssh.Permissions
+		wantOK bool
+	}{
+		{name: "no forced command", config: "PermitRootLogin forced-commands-only\n", perms: &ssh.Permissions{}},
+		{name: "no permissions", config: "PermitRootLogin forced-commands-only\n", perms: nil},
+		{
+			name:   "forced by key",
+			config: "PermitRootLogin forced-commands-only\n",
+			perms:  &ssh.Permissions{CriticalOptions: map[string]string{"force-command": "/usr/bin/backup"}},
+			wantOK: true,
+		},
+		{name: "forced by config", config: "PermitRootLogin forced-commands-only\nForceCommand /usr/bin/backup\n", wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseSSHDConfig(strings.NewReader(tt.config))
+			if err != nil {
+				t.Fatalf("failed to parse config: %v", err)
+			}
+
+			s := &Server{
+				Config: &ssh.ServerConfig{
+					PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+						return tt.perms, nil
+					},
+				},
+			}
+			if err := c.Apply(s); err != nil {
+				t.Fatalf("failed to apply config: %v", err)
+			}
+
+			remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+			_, err = s.Config.PublicKeyCallback(testConnMetadata{user: "root", remote: remote}, nil)
+			if tt.wantOK && err != nil {
+				t.Errorf("root is rejected with a forced command: %v", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Error("root is accepted without a forced command")
+			}
+		})
+	}
+}
+
+func TestRekeyLimitTime(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    uint64
+		wantErr bool
+	}{
+		{line: "RekeyLimit 1G", want: 1 << 30},
+		{line: "RekeyLimit 1G none", want: 1 << 30},
+		{line: "RekeyLimit default none", want: 0},
+		{line: "RekeyLimit 1G 0", want: 1 << 30},
+		{line: "RekeyLimit 1G 1h", wantErr: true},
+		{line: "RekeyLimit 1G soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			c, err := ParseSSHDConfig(strings.NewReader(tt.line))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if c.RekeyLimit != tt.want {
+				t.Errorf("got %d, want %d", c.RekeyLimit, tt.want)
+			}
+		})
+	}
+}
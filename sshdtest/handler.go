@@ -0,0 +1,72 @@
+package sshdtest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fardream/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// Request is a channel request received by a [RequestHandler].
+type Request struct {
+	// Channel is the id of the session channel.
+	Channel   string
+	Type      string
+	Payload   []byte
+	WantReply bool
+}
+
+// RequestHandler is a mock [sshd.ChannelRequestHandler] which records the requests it receives.
+type RequestHandler struct {
+	// Err, if set, rejects the requests.
+	Err error
+	// Next, if set, serves the accepted requests, such as [sshd.DefaultChannelRequestHandler].
+	Next sshd.ChannelRequestHandler
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+func (h *RequestHandler) ServeRequest(c *sshd.Channel, req *ssh.Request) error {
+	h.mu.Lock()
+	h.requests = append(h.requests, Request{
+		Channel:   c.ID(),
+		Type:      req.Type,
+		Payload:   append([]byte(nil), req.Payload...),
+		WantReply: req.WantReply,
+	})
+	h.mu.Unlock()
+
+	if h.Err != nil {
+		return h.Err
+	}
+	if h.Next != nil {
+		return h.Next.ServeRequest(c, req)
+	}
+
+	return nil
+}
+
+// Requests returns the requests received so far.
+func (h *RequestHandler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Request(nil), h.requests...)
+}
+
+// Channel connects to the server as the user and opens a session channel,
+// to send requests to the handlers directly. The channel is closed at the end of the test.
+func (s *Server) Channel(tb testing.TB, user string, auth ...ssh.AuthMethod) ssh.Channel {
+	tb.Helper()
+
+	channel, requests, err := s.Client(tb, user, auth...).OpenChannel("session", nil)
+	if err != nil {
+		tb.Fatalf("failed to open session: %v", err)
+	}
+	go ssh.DiscardRequests(requests)
+	tb.Cleanup(func() { channel.Close() })
+
+	return channel
+}
@@ -0,0 +1,54 @@
+package sshdtest_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fardream/sshd"
+	"github.com/fardream/sshd/sshdtest"
+	"github.com/fardream/sshd/wire"
+)
+
+func TestRequestHandler(t *testing.T) {
+	custom := &sshdtest.RequestHandler{}
+	rejected := &sshdtest.RequestHandler{Err: errors.New("no breaks")}
+	env := &sshdtest.RequestHandler{Next: sshd.DefaultChannelRequestHandler("env")}
+
+	s := sshdtest.NewServer(t,
+		sshd.WithChannelRequestHandler("custom@example.com", custom),
+		sshd.WithChannelRequestHandler("break", rejected),
+		sshd.WithChannelRequestHandler("env", env),
+		sshd.WithAcceptEnv("LANG"),
+	)
+	channel := s.Channel(t, "alice")
+
+	if ok, err := channel.SendRequest("custom@example.com", true, []byte("payload")); err != nil || !ok {
+		t.Errorf("custom request failed: %v %v", ok, err)
+	}
+	if ok, err := channel.SendRequest("break", true, wire.MarshalExitStatus(0)); err != nil || ok {
+		t.Errorf("break is not rejected: %v %v", ok, err)
+	}
+
+	envPayload := wire.MarshalString(wire.MarshalString(nil, "LANG"), "C")
+	if ok, err := channel.SendRequest("env", true, envPayload); err != nil || !ok {
+		t.Errorf("accepted env failed: %v %v", ok, err)
+	}
+	if ok, err := channel.SendRequest("env", true, wire.MarshalString(wire.MarshalString(nil, "SECRET"), "x")); err != nil || ok {
+		t.Errorf("env declined by the default handler is accepted: %v %v", ok, err)
+	}
+
+	requests := custom.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("custom handler received %d requests, want 1", len(requests))
+	}
+	if r := requests[0]; r.Type != "custom@example.com" || string(r.Payload) != "payload" || !r.WantReply || r.Channel == "" {
+		t.Errorf("unexpected request %+v", r)
+	}
+
+	if n := len(rejected.Requests()); n != 1 {
+		t.Errorf("rejecting handler received %d requests, want 1", n)
+	}
+	if n := len(env.Requests()); n != 2 {
+		t.Errorf("env handler received %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,108 @@
+// Package sshdtest runs [sshd.Server] on loopback listeners for tests, and connects ready ssh clients to them.
+package sshdtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os/user"
+	"testing"
+
+	"github.com/fardream/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is a server running for a test.
+type Server struct {
+	*sshd.Server
+
+	// Addr is the loopback address the server listens on.
+	Addr string
+	// HostKey is the public host key of the server.
+	HostKey ssh.PublicKey
+}
+
+// NewServer starts a server on a loopback listener with a generated ed25519 host key,
+// no client authentication and the users of [Users] with a temporary home directory.
+// opts are applied after these defaults, and the server is closed at the end of the test.
+func NewServer(tb testing.TB, opts ...sshd.Option) *Server {
+	tb.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		tb.Fatalf("failed to create host key signer: %v", err)
+	}
+
+	defaults := []sshd.Option{
+		sshd.WithConfig(&ssh.ServerConfig{NoClientAuth: true}),
+		sshd.WithHostKey(signer),
+		sshd.WithUserBackend(Users(tb.TempDir())),
+	}
+	srv, err := sshd.NewServer(append(defaults, opts...)...)
+	if err != nil {
+		tb.Fatalf("failed to create server: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.ServeListener(ctx, l); err != nil && !errors.Is(err, sshd.ErrServerClosed) {
+			tb.Logf("server stopped: %v", err)
+		}
+	}()
+
+	tb.Cleanup(func() {
+		cancel()
+		srv.Close()
+		<-done
+	})
+
+	return &Server{Server: srv, Addr: l.Addr().String(), HostKey: signer.PublicKey()}
+}
+
+// Client connects to the server as the user, checking the host key,
+// and returns the client which is closed at the end of the test.
+func (s *Server) Client(tb testing.TB, user string, auth ...ssh.AuthMethod) *ssh.Client {
+	tb.Helper()
+
+	client, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey),
+	})
+	if err != nil {
+		tb.Fatalf("failed to connect as %s: %v", user, err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// Users returns a user backend which knows every user name as the user running the process with the home directory,
+// so the sessions run without switching users.
+func Users(home string) sshd.UserBackend {
+	return sshd.UserBackendFunc(func(name string) (*sshd.UserInfo, error) {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+
+		u := *current
+		u.Username = name
+		u.HomeDir = home
+
+		return &sshd.UserInfo{User: u, Groups: []string{}}, nil
+	})
+}
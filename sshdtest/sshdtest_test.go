@@ -0,0 +1,307 @@
+package sshdtest_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fardream/sshd"
+	"github.com/fardream/sshd/sshdtest"
+	"github.com/fardream/sshd/wire"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExec(t *testing.T) {
+	s := sshdtest.NewServer(t)
+
+	session, err := s.Client(t, "alice").NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	out, err := session.Output("echo $USER; pwd")
+	if err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+
+	lines := strings.Fields(string(out))
+	if len(lines) != 2 || lines[0] != "alice" || lines[1] == "" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestExecExitStatus(t *testing.T) {
+	s := sshdtest.NewServer(t)
+
+	session, err := s.Client(t, "alice").NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	var exitErr *ssh.ExitError
+	if err := session.Run("exit 3"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	s := sshdtest.NewServer(t)
+
+	client, err := sftp.NewClient(s.Client(t, "alice"))
+	if err != nil {
+		t.Fatalf("failed to start sftp: %v", err)
+	}
+	defer client.Close()
+
+	f, err := client.Create("hello.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file: %v", err)
+	}
+
+	f, err = client.Open("hello.txt")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read %q, want hello", b)
+	}
+}
+
+// a session whose sftp setup fails can still run another program.
+func TestSFTPSetupFailure(t *testing.T) {
+	s := sshdtest.NewServer(t, sshd.WithFeatures(sshd.Features{SFTPRoot: "/nonexistent"}))
+	channel := s.Channel(t, "alice")
+
+	if ok, err := channel.SendRequest("subsystem", true, wire.MarshalString(nil, "sftp")); err != nil || ok {
+		t.Fatalf("sftp without its root is not rejected: %v %v", ok, err)
+	}
+	if ok, err := channel.SendRequest("exec", true, wire.MarshalString(nil, "true")); err != nil || !ok {
+		t.Errorf("exec after the failed sftp is rejected: %v %v", ok, err)
+	}
+}
+
+func TestChannelLimit(t *testing.T) {
+	s := sshdtest.NewServer(t, sshd.WithConnLimits(sshd.ConnResources{Channels: 2}))
+	client := s.Client(t, "alice")
+
+	var channels []ssh.Channel
+	for range 2 {
+		channel, requests, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatalf("failed to open channel: %v", err)
+		}
+		go ssh.DiscardRequests(requests)
+		channels = append(channels, channel)
+	}
+
+	_, _, err := client.OpenChannel("session", nil)
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ResourceShortage {
+		t.Fatalf("channel over the limit is not rejected: %v", err)
+	}
+
+	// the closed channels are released once the server is done with them.
+	channels[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		channel, requests, err := client.OpenChannel("session", nil)
+		if err == nil {
+			go ssh.DiscardRequests(requests)
+			channel.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channel is not released after close: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionRace(t *testing.T) {
+	sessions := make(chan *sshd.Session, 1)
+	s := sshdtest.NewServer(t,
+		sshd.WithShutdownMessage("maintenance"),
+		sshd.WithChannelRequestHandler("session@capture", sshd.ChannelRequestHandlerFunc(func(c *sshd.Channel, req *ssh.Request) error {
+			sessions <- c.Session()
+			return nil
+		})),
+	)
+	channel := s.Channel(t, "alice")
+	go io.Copy(io.Discard, channel)
+
+	ptyReq := append(wire.MarshalString(nil, "xterm"), wire.MarshalWindowChange(80, 24, 0, 0)...)
+	if ok, err := channel.SendRequest("pty-req", true, ptyReq); err != nil || !ok {
+		t.Fatalf("pty-req failed: %v %v", ok, err)
+	}
+	if ok, err := channel.SendRequest("session@capture", true, nil); err != nil || !ok {
+		t.Fatalf("failed to capture session: %v %v", ok, err)
+	}
+	session := <-sessions
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			session.Env()
+			session.Term()
+			session.WindowSize()
+			session.HasPTY()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	for i := range 100 {
+		if _, err := channel.SendRequest("window-change", false, wire.MarshalWindowChange(uint32(80+i), 24, 0, 0)); err != nil {
+			break
+		}
+		channel.SendRequest("env", false, wire.MarshalString(wire.MarshalString(nil, "LANG"), "C"))
+	}
+
+	<-shutdown
+}
+
+// unprovenSigner offers a public key but fails to sign with it, like a client without the private key.
+type unprovenSigner struct {
+	ssh.Signer
+}
+
+func (unprovenSigner) Sign(io.Reader, []byte) (*ssh.Signature, error) {
+	return nil, errors.New("no private key")
+}
+
+func TestOnAuth(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods := make(chan string, 4)
+	s := sshdtest.NewServer(t,
+		sshd.WithConfig(&ssh.ServerConfig{
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				return &ssh.Permissions{}, nil
+			},
+			PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+				return &ssh.Permissions{}, nil
+			},
+		}),
+		sshd.WithHooks(sshd.Hooks{
+			OnAuth: func(info sshd.ConnInfo, method string) error {
+				methods <- method
+				return nil
+			},
+		}),
+	)
+
+	// the key is accepted by the query, but the client never proves it holds it.
+	client := s.Client(t, "alice", ssh.PublicKeys(unprovenSigner{signer}), ssh.Password("secret"))
+
+	// the channels are served after OnAuth.
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	session.Close()
+
+	close(methods)
+	var called []string
+	for method := range methods {
+		called = append(called, method)
+	}
+	if len(called) != 1 || called[0] != "password" {
+		t.Errorf("OnAuth is called for %v, want only password", called)
+	}
+}
+
+func TestOnAuthReject(t *testing.T) {
+	s := sshdtest.NewServer(t, sshd.WithHooks(sshd.Hooks{
+		OnAuth: func(sshd.ConnInfo, string) error {
+			return errors.New("rejected")
+		},
+	}))
+
+	client, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{User: "alice", HostKeyCallback: ssh.FixedHostKey(s.HostKey)})
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if session, err := client.NewSession(); err == nil {
+		session.Close()
+		t.Error("session is opened on a connection rejected by OnAuth")
+	}
+}
+
+func TestMaxStartupsCountsBeforeHooks(t *testing.T) {
+	var calls atomic.Int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s := sshdtest.NewServer(t,
+		sshd.WithMaxStartups(sshd.MaxStartups{Start: 1, Rate: 100, Full: 1}),
+		sshd.WithHooks(sshd.Hooks{
+			OnConnect: func(sshd.ConnInfo) error {
+				if calls.Add(1) == 1 {
+					close(entered)
+					<-release
+				}
+				return nil
+			},
+		}),
+	)
+	defer close(release)
+
+	first, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	<-entered
+
+	second, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := second.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("connection over MaxStartups is served while the first one is in OnConnect: %d bytes, %v", n, err)
+	}
+}
@@ -0,0 +1,228 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// directStreamLocalChannel is the channel type forwarding connections from the client to unix sockets (ssh -L with a socket path).
+const directStreamLocalChannel = "direct-streamlocal@openssh.com"
+
+// streamLocalBindMode is the mode of the sockets of remote forwardings, like the default StreamLocalBindMask of openssh.
+const streamLocalBindMode = 0o600
+
+// directStreamLocalMsg is the extra data of direct-streamlocal channels.
+type directStreamLocalMsg struct {
+	Path      string
+	Reserved0 string
+	Reserved1 uint32
+}
+
+// streamLocalForwardMsg is the payload of streamlocal-forward and cancel-streamlocal-forward requests.
+type streamLocalForwardMsg struct {
+	Path string
+}
+
+// forwardedStreamLocalMsg is the extra data of forwarded-streamlocal channels.
+type forwardedStreamLocalMsg struct {
+	Path     string
+	Reserved string
+}
+
+// AllowStreamLocalPaths returns a policy for [Server.StreamLocalPolicy] allowing the socket paths matching patterns,
+// which can contain * and ?, and be negated with !.
+func AllowStreamLocalPaths(patterns ...string) func(info ConnInfo, path string) error {
+	return func(info ConnInfo, path string) error {
+		if !matchPatternList(patterns, path) {
+			return fmt.Errorf("forwarding to %s is not allowed", path)
+		}
+		return nil
+	}
+}
+
+// directStreamLocal connects the channel to the unix socket requested by the client.
+func (s *ServerConn) directStreamLocal(newchannel ssh.NewChannel) {
+	if s.features.DisableLocalForwarding {
+		newchannel.Reject(ssh.Prohibited, "forwarding is not allowed")
+		return
+	}
+
+	var msg directStreamLocalMsg
+	if err := ssh.Unmarshal(newchannel.ExtraData(), &msg); err != nil {
+		newchannel.Reject(ssh.ConnectionFailed, "invalid direct-streamlocal request")
+		return
+	}
+
+	if err := s.checkStreamLocalPath(msg.Path); err != nil {
+		// the details stay in the log, so the client cannot probe the file system.
+		s.logger.Info("unix socket forwarding is rejected", "path", msg.Path, "err", err.Error())
+		newchannel.Reject(ssh.Prohibited, "forwarding is not allowed")
+		return
+	}
+
+	conn, err := net.Dial("unix", msg.Path)
+	if err != nil {
+		s.logger.Info("failed to connect to unix socket", "path", msg.Path, "err", err.Error())
+		newchannel.Reject(ssh.ConnectionFailed, "failed to connect to unix socket")
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := s.acceptChannel(newchannel)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	s.logger.Info("unix socket forwarding started", "path", msg.Path)
+
+	if err := s.forward(channel, conn, directStreamLocalChannel, msg.Path, s.sshcon.RemoteAddr().String()); err != nil {
+		s.logger.Debug("error in forwarding connection", "err", err.Error())
+	}
+}
+
+// remoteStreamLocalForward listens on the unix socket requested by the client,
+// and forwards the accepted connections to the client (ssh -R with a socket path).
+func remoteStreamLocalForward(s *ServerConn, req *ssh.Request) (bool, []byte) {
+	if s.features.DisableRemoteForwarding {
+		s.logger.Info("remote forwarding is not allowed")
+		return false, nil
+	}
+
+	var msg streamLocalForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		s.logger.Info("invalid streamlocal-forward request", "err", err.Error())
+		return false, nil
+	}
+
+	if !s.resources.reserve(listenerCost) {
+		s.logger.Info("failed to listen for unix socket forwarding", "path", msg.Path, "err", errResourcesExhausted.Error())
+		return false, nil
+	}
+
+	l, err := s.listenStreamLocal(msg.Path)
+	if err != nil {
+		s.resources.release(listenerCost)
+		s.logger.Info("failed to listen for unix socket forwarding", "path", msg.Path, "err", err.Error())
+		return false, nil
+	}
+
+	if !s.addForward(streamLocalForwardKey(msg.Path), l) {
+		s.resources.release(listenerCost)
+		l.Close()
+		s.logger.Info("unix socket forwarding already exists", "path", msg.Path)
+		return false, nil
+	}
+
+	s.logger.Info("unix socket remote forwarding started", "path", msg.Path)
+
+	go s.acceptForwarded(l, func(conn net.Conn) {
+		s.openForwarded(conn, "forwarded-streamlocal@openssh.com", ssh.Marshal(&forwardedStreamLocalMsg{Path: msg.Path}))
+	})
+
+	return true, nil
+}
+
+// cancelRemoteStreamLocalForward stops the unix socket remote forwarding of the path in the request.
+func cancelRemoteStreamLocalForward(s *ServerConn, req *ssh.Request) (bool, []byte) {
+	var msg streamLocalForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		s.logger.Info("invalid cancel-streamlocal-forward request", "err", err.Error())
+		return false, nil
+	}
+
+	l := s.removeForward(streamLocalForwardKey(msg.Path))
+	if l == nil {
+		s.logger.Info("no unix socket forwarding to cancel", "path", msg.Path)
+		return false, nil
+	}
+
+	// the socket file is removed by closing the listener.
+	if err := l.Close(); err != nil {
+		s.logger.Info("failed to close forwarding listener", "err", err.Error())
+	}
+	s.logger.Info("unix socket remote forwarding canceled", "path", msg.Path)
+
+	return true, nil
+}
+
+// streamLocalForwardKey identifies a unix socket remote forwarding among the remote forwardings.
+func streamLocalForwardKey(path string) string {
+	return "unix:" + path
+}
+
+// listenStreamLocal listens on the unix socket at path for the user.
+// Like openssh, an existing file is not replaced.
+func (s *ServerConn) listenStreamLocal(path string) (net.Listener, error) {
+	if !filepath.IsAbs(path) {
+		return nil, errors.New("socket path must be absolute")
+	}
+
+	if s.srv.StreamLocalPolicy != nil {
+		if err := s.srv.StreamLocalPolicy(s.Info(), path); err != nil {
+			return nil, err
+		}
+	}
+
+	cred, err := sessionCredential(s.user)
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil {
+		// creating the socket needs write and search permissions on the directory.
+		if err := checkAccess(filepath.Dir(path), cred, 3); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, streamLocalBindMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+
+	if cred != nil {
+		if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to give %s to user: %w", path, err)
+		}
+	}
+
+	return l, nil
+}
+
+// checkStreamLocalPath checks the socket path against the policy of the server,
+// and that the user could connect to it if the server acts as another user.
+func (s *ServerConn) checkStreamLocalPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return errors.New("socket path must be absolute")
+	}
+
+	if s.srv.StreamLocalPolicy != nil {
+		if err := s.srv.StreamLocalPolicy(s.Info(), path); err != nil {
+			return err
+		}
+	}
+
+	cred, err := sessionCredential(s.user)
+	if err != nil {
+		return err
+	}
+	if cred != nil {
+		// connecting needs write permission on the socket.
+		if err := checkAccess(path, cred, 2); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
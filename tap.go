@@ -0,0 +1,79 @@
+package sshd
+
+import (
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// IOTap wraps the streams of a session, for example to log keystrokes, filter the output,
+// or inject messages to the client.
+type IOTap struct {
+	// Input, if set, wraps the data received from the client.
+	Input func(r io.Reader) io.Reader
+	// Output, if set, wraps the data sent to the client, and is applied to stdout and stderr separately.
+	Output func(w io.Writer) io.Writer
+}
+
+// tappedChannel is a channel with its data passing through the tap.
+type tappedChannel struct {
+	ssh.Channel
+	r      io.Reader
+	w      io.Writer
+	stderr io.ReadWriter
+}
+
+func newTappedChannel(channel ssh.Channel, tap *IOTap) *tappedChannel {
+	t := &tappedChannel{
+		Channel: channel,
+		r:       channel,
+		w:       channel,
+		stderr:  channel.Stderr(),
+	}
+
+	if tap.Input != nil {
+		t.r = tap.Input(channel)
+	}
+
+	if tap.Output != nil {
+		t.w = tap.Output(channel)
+		t.stderr = struct {
+			io.Reader
+			io.Writer
+		}{
+			Reader: channel.Stderr(),
+			Writer: tap.Output(channel.Stderr()),
+		}
+	}
+
+	return t
+}
+
+func (t *tappedChannel) Read(b []byte) (int, error) {
+	return t.r.Read(b)
+}
+
+func (t *tappedChannel) Write(b []byte) (int, error) {
+	return t.w.Write(b)
+}
+
+func (t *tappedChannel) Stderr() io.ReadWriter {
+	return t.stderr
+}
+
+// applyTap routes the data of the channel through the tap chosen for the session, if any.
+func (c *Channel) applyTap(sessiontype string) {
+	if c.srv.Tap == nil {
+		return
+	}
+
+	tap := c.srv.Tap(c.conn.Info(), sessiontype)
+	if tap == nil {
+		return
+	}
+
+	// Notify and closeAll read the channel under chansMu.
+	c.conn.chansMu.Lock()
+	c.channel = newTappedChannel(c.channel, tap)
+	c.conn.chansMu.Unlock()
+}
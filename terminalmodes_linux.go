@@ -0,0 +1,142 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// terminalChars maps the opcodes of control characters to their index in termios.Cc.
+var terminalChars = map[uint8]int{
+	ssh.VINTR:    unix.VINTR,
+	ssh.VQUIT:    unix.VQUIT,
+	ssh.VERASE:   unix.VERASE,
+	ssh.VKILL:    unix.VKILL,
+	ssh.VEOF:     unix.VEOF,
+	ssh.VEOL:     unix.VEOL,
+	ssh.VEOL2:    unix.VEOL2,
+	ssh.VSTART:   unix.VSTART,
+	ssh.VSTOP:    unix.VSTOP,
+	ssh.VSUSP:    unix.VSUSP,
+	ssh.VREPRINT: unix.VREPRINT,
+	ssh.VWERASE:  unix.VWERASE,
+	ssh.VLNEXT:   unix.VLNEXT,
+	ssh.VDISCARD: unix.VDISCARD,
+}
+
+// terminalFlag is a flag of termios set by an opcode.
+type terminalFlag struct {
+	field func(t *unix.Termios) *uint32
+	flag  uint32
+}
+
+var (
+	iflag = func(t *unix.Termios) *uint32 { return &t.Iflag }
+	oflag = func(t *unix.Termios) *uint32 { return &t.Oflag }
+	cflag = func(t *unix.Termios) *uint32 { return &t.Cflag }
+	lflag = func(t *unix.Termios) *uint32 { return &t.Lflag }
+)
+
+// terminalFlags maps the opcodes of flags to the termios flags.
+var terminalFlags = map[uint8]terminalFlag{
+	ssh.IGNPAR:  {iflag, unix.IGNPAR},
+	ssh.PARMRK:  {iflag, unix.PARMRK},
+	ssh.INPCK:   {iflag, unix.INPCK},
+	ssh.ISTRIP:  {iflag, unix.ISTRIP},
+	ssh.INLCR:   {iflag, unix.INLCR},
+	ssh.IGNCR:   {iflag, unix.IGNCR},
+	ssh.ICRNL:   {iflag, unix.ICRNL},
+	ssh.IUCLC:   {iflag, unix.IUCLC},
+	ssh.IXON:    {iflag, unix.IXON},
+	ssh.IXANY:   {iflag, unix.IXANY},
+	ssh.IXOFF:   {iflag, unix.IXOFF},
+	ssh.IMAXBEL: {iflag, unix.IMAXBEL},
+	ssh.IUTF8:   {iflag, unix.IUTF8},
+	ssh.ISIG:    {lflag, unix.ISIG},
+	ssh.ICANON:  {lflag, unix.ICANON},
+	ssh.XCASE:   {lflag, unix.XCASE},
+	ssh.ECHO:    {lflag, unix.ECHO},
+	ssh.ECHOE:   {lflag, unix.ECHOE},
+	ssh.ECHOK:   {lflag, unix.ECHOK},
+	ssh.ECHONL:  {lflag, unix.ECHONL},
+	ssh.NOFLSH:  {lflag, unix.NOFLSH},
+	ssh.TOSTOP:  {lflag, unix.TOSTOP},
+	ssh.IEXTEN:  {lflag, unix.IEXTEN},
+	ssh.ECHOCTL: {lflag, unix.ECHOCTL},
+	ssh.ECHOKE:  {lflag, unix.ECHOKE},
+	ssh.PENDIN:  {lflag, unix.PENDIN},
+	ssh.OPOST:   {oflag, unix.OPOST},
+	ssh.OLCUC:   {oflag, unix.OLCUC},
+	ssh.ONLCR:   {oflag, unix.ONLCR},
+	ssh.OCRNL:   {oflag, unix.OCRNL},
+	ssh.ONOCR:   {oflag, unix.ONOCR},
+	ssh.ONLRET:  {oflag, unix.ONLRET},
+	ssh.PARENB:  {cflag, unix.PARENB},
+	ssh.PARODD:  {cflag, unix.PARODD},
+}
+
+// terminalSpeeds maps the baud rates to the speed constants of termios.
+var terminalSpeeds = map[uint32]uint32{
+	0: unix.B0, 50: unix.B50, 75: unix.B75, 110: unix.B110, 134: unix.B134, 150: unix.B150,
+	200: unix.B200, 300: unix.B300, 600: unix.B600, 1200: unix.B1200, 1800: unix.B1800,
+	2400: unix.B2400, 4800: unix.B4800, 9600: unix.B9600, 19200: unix.B19200, 38400: unix.B38400,
+	57600: unix.B57600, 115200: unix.B115200, 230400: unix.B230400, 460800: unix.B460800,
+}
+
+// applyTerminalModes sets the terminal modes requested by the client on tty.
+func applyTerminalModes(tty *os.File, modes ssh.TerminalModes) error {
+	if len(modes) == 0 {
+		return nil
+	}
+
+	fd := int(tty.Fd())
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("failed to get terminal attributes: %w", err)
+	}
+
+	for opcode, value := range modes {
+		if index, ok := terminalChars[opcode]; ok {
+			termios.Cc[index] = uint8(value)
+			continue
+		}
+
+		if f, ok := terminalFlags[opcode]; ok {
+			field := f.field(termios)
+			if value != 0 {
+				*field |= f.flag
+			} else {
+				*field &^= f.flag
+			}
+			continue
+		}
+
+		speed, ok := terminalSpeeds[value]
+		if !ok {
+			continue
+		}
+		switch opcode {
+		case ssh.TTY_OP_ISPEED:
+			termios.Ispeed = speed
+		case ssh.TTY_OP_OSPEED:
+			termios.Ospeed = speed
+			termios.Cflag = termios.Cflag&^unix.CBAUD | speed
+		}
+	}
+
+	// CS7 and CS8 are values of the CSIZE bits rather than flags.
+	if modes[ssh.CS8] != 0 {
+		termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS8
+	} else if modes[ssh.CS7] != 0 {
+		termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS7
+	}
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return fmt.Errorf("failed to set terminal attributes: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sshd
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// applyTerminalModes is not supported outside linux, the terminal keeps the default modes.
+func applyTerminalModes(*os.File, ssh.TerminalModes) error {
+	return nil
+}
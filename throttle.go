@@ -0,0 +1,228 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleChunk is the most bytes read at once by a throttled reader, so the waits stay short.
+const throttleChunk = 32 << 10
+
+// tokenBucket limits the bytes per second, allowing bursts of up to one second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, and waits until the debt is paid off or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateMeter counts bytes and measures their rate over windows of a second.
+type rateMeter struct {
+	total atomic.Int64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes int64
+	rate        float64
+}
+
+func (m *rateMeter) add(n int) {
+	m.total.Add(int64(n))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(time.Now())
+	m.windowBytes += int64(n)
+}
+
+// snapshot returns the total bytes and the bytes per second of the last window.
+func (m *rateMeter) snapshot() (int64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(time.Now())
+
+	return m.total.Load(), m.rate
+}
+
+func (m *rateMeter) roll(now time.Time) {
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+		return
+	}
+
+	elapsed := now.Sub(m.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+
+	m.rate = float64(m.windowBytes) / elapsed.Seconds()
+	m.windowStart = now
+	m.windowBytes = 0
+}
+
+// throttledReader meters the bytes read from r if meter is set, and waits on the buckets after each read.
+type throttledReader struct {
+	r       io.Reader
+	ctx     context.Context
+	meter   *rateMeter
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(t.buckets) > 0 && len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if t.meter != nil {
+			t.meter.add(n)
+		}
+		if waitErr := waitBuckets(t.ctx, t.buckets, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
+
+// throttledWriter writes to w in chunks, and waits on the buckets after each chunk.
+type throttledWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), throttleChunk)]
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := waitBuckets(t.ctx, t.buckets, n); err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// waitBuckets takes n tokens from each bucket.
+func waitBuckets(ctx context.Context, buckets []*tokenBucket, n int) error {
+	for _, bucket := range buckets {
+		if err := bucket.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forwardBuckets returns the token buckets limiting the forwarded bytes of the connection in one direction,
+// the one of each forwarded connection and the one shared by all the connections of the user.
+func (s *ServerConn) forwardBuckets(user *[2]*tokenBucket, direction int) []*tokenBucket {
+	var buckets []*tokenBucket
+	if s.srv.ForwardRateLimit > 0 {
+		buckets = append(buckets, newTokenBucket(s.srv.ForwardRateLimit))
+	}
+	if user != nil {
+		buckets = append(buckets, user[direction])
+	}
+
+	return buckets
+}
+
+// userForwardBuckets returns the token buckets of the user in both directions,
+// nil if the forwardings of users are not limited.
+func (s *Server) userForwardBuckets(user string) *[2]*tokenBucket {
+	return s.userBuckets(&s.forwardBuckets, user, s.UserForwardRateLimit)
+}
+
+// userBuckets returns the token buckets of the user in both directions from buckets, created with the rate,
+// nil if the rate is not positive.
+func (s *Server) userBuckets(buckets *map[string]*[2]*tokenBucket, user string, rate int64) *[2]*tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if *buckets == nil {
+		*buckets = make(map[string]*[2]*tokenBucket)
+	}
+
+	userBuckets, ok := (*buckets)[user]
+	if !ok {
+		userBuckets = &[2]*tokenBucket{newTokenBucket(rate), newTokenBucket(rate)}
+		(*buckets)[user] = userBuckets
+	}
+
+	return userBuckets
+}
+
+const (
+	sftpUpload = iota
+	sftpDownload
+)
+
+// throttleSFTP limits the bytes per second the sftp session reads from r, the uploads,
+// and writes to w, the downloads, with the limits of the session and of the user.
+func (c *Channel) throttleSFTP(r io.Reader, w io.Writer) (io.Reader, io.Writer) {
+	user := c.srv.userBuckets(&c.srv.sftpBuckets, c.user.Username, c.srv.UserSFTPRateLimit)
+	if c.srv.SFTPRateLimit <= 0 && user == nil {
+		return r, w
+	}
+
+	buckets := func(direction int) []*tokenBucket {
+		var buckets []*tokenBucket
+		if c.srv.SFTPRateLimit > 0 {
+			buckets = append(buckets, newTokenBucket(c.srv.SFTPRateLimit))
+		}
+		if user != nil {
+			buckets = append(buckets, user[direction])
+		}
+		return buckets
+	}
+
+	return &throttledReader{r: r, ctx: c.baseCtx, buckets: buckets(sftpUpload)},
+		&throttledWriter{w: w, ctx: c.baseCtx, buckets: buckets(sftpDownload)}
+}
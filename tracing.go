@@ -0,0 +1,45 @@
+package sshd
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/fardream/sshd"
+
+func (s *Server) tracer() trace.Tracer {
+	tp := s.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+// startSession records the start of a shell, exec or sftp session in the metrics and the traces and calls the hooks,
+// and returns the function to call when the session ends.
+func (c *Channel) startSession(sessiontype string, attrs ...attribute.KeyValue) func() {
+	endMetrics := c.srv.Metrics.sessionStarted(sessiontype)
+
+	_, span := c.srv.tracer().Start(c.baseCtx, "sshd.session."+sessiontype, trace.WithAttributes(attrs...))
+
+	session := SessionInfo{ID: c.id, Type: sessiontype, Command: c.session.Command(), Start: time.Now()}
+	if c.srv.Hooks.OnSessionStart != nil {
+		c.srv.Hooks.OnSessionStart(c.conn.Info(), session)
+	}
+
+	return func() {
+		span.End()
+		endMetrics()
+
+		if c.srv.Hooks.OnSessionEnd != nil {
+			session.End = time.Now()
+			session.ExitStatus, session.ExitSignal = c.session.ExitStatus()
+			session.BytesIn, session.BytesOut = c.metered.bytesIn.Load(), c.metered.bytesOut.Load()
+			c.srv.Hooks.OnSessionEnd(c.conn.Info(), session)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ListenFDsEnv is the environment variable telling a new process how many listeners are inherited,
+// starting from file descriptor 3.
+const ListenFDsEnv = "SSHD_LISTEN_FDS"
+
+// ListenInherited adopts the listeners handed over by [Server.Upgrade] from the parent process,
+// or passed by systemd socket activation. It returns the number of listeners adopted,
+// which are served by [Server.Serve] afterwards.
+func (s *Server) ListenInherited() (int, error) {
+	nstr := os.Getenv(ListenFDsEnv)
+	if nstr == "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		nstr = os.Getenv("LISTEN_FDS")
+	}
+
+	if nstr == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(nstr)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of inherited listeners: %s", nstr)
+	}
+
+	for _, env := range []string{ListenFDsEnv, "LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("listener-%d", i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return i, fmt.Errorf("failed to adopt inherited listener %d: %w", i, err)
+		}
+
+		if err := s.addListener(l, false); err != nil {
+			return i, err
+		}
+
+		s.logger().Info("adopted inherited listener", "addr", l.Addr().String())
+	}
+
+	return n, nil
+}
+
+// Upgrade starts a new process of the same executable and arguments, hands the listeners over to it,
+// and then gracefully shuts this server down with [Server.Shutdown].
+// The new process should call [Server.ListenInherited] before serving.
+//
+// The listeners keep accepting connections throughout, so no connection is refused during the upgrade.
+func (s *Server) Upgrade(ctx context.Context) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the executable: %w", err)
+	}
+
+	files, err := s.listenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", ListenFDsEnv, len(files)))
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	s.logger().Info("handed listeners over to new process", "pid", cmd.Process.Pid, "count", len(files))
+
+	// the socket files now belong to the new process as well.
+	s.mu.Lock()
+	for l := range s.listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.mu.Unlock()
+
+	return cmd.Process, s.Shutdown(ctx)
+}
+
+// listenerFiles duplicates the file descriptors of the listeners.
+func (s *Server) listenerFiles() (files []*os.File, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}()
+
+	for l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, fmt.Errorf("listener %s cannot be handed over", l.Addr())
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return files, fmt.Errorf("failed to get the file of listener %s: %w", l.Addr(), err)
+		}
+
+		files = append(files, f)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("server has no listener to hand over")
+	}
+
+	return files, nil
+}
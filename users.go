@@ -0,0 +1,122 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+)
+
+// UserInfo is the account of a user.
+type UserInfo struct {
+	user.User
+	// Groups are the ids of the supplementary groups of the user, nil to look them up with os/user.
+	// Match Group of [SSHDConfig] and [DenyPTYFor] match the ids unknown to the system as the group names.
+	Groups []string
+}
+
+// groupIds returns the ids of the supplementary groups of u.
+func (u *UserInfo) groupIds() ([]string, error) {
+	if u.Groups != nil {
+		return u.Groups, nil
+	}
+
+	return u.User.GroupIds()
+}
+
+// UserBackend looks up the accounts of the users.
+type UserBackend interface {
+	// Lookup returns the account of the user name, or a [user.UnknownUserError] if there is no such user.
+	Lookup(name string) (*UserInfo, error)
+}
+
+// UserBackendFunc is a function implementing [UserBackend], such as a lookup in an external directory.
+type UserBackendFunc func(name string) (*UserInfo, error)
+
+func (f UserBackendFunc) Lookup(name string) (*UserInfo, error) {
+	return f(name)
+}
+
+// OSUsers looks up the users of the system with os/user.
+type OSUsers struct{}
+
+func (OSUsers) Lookup(name string) (*UserInfo, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{User: *u}, nil
+}
+
+// StaticUsers are the accounts of the users by name, such as users from a config file or for testing.
+type StaticUsers map[string]*UserInfo
+
+func (s StaticUsers) Lookup(name string) (*UserInfo, error) {
+	u, ok := s[name]
+	if !ok {
+		return nil, user.UnknownUserError(name)
+	}
+
+	found := *u
+	return &found, nil
+}
+
+// ChainUsers looks up the users in the backends in order, until one of them knows the user.
+type ChainUsers []UserBackend
+
+func (c ChainUsers) Lookup(name string) (*UserInfo, error) {
+	for _, backend := range c {
+		u, err := backend.Lookup(name)
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			continue
+		}
+
+		return u, err
+	}
+
+	return nil, user.UnknownUserError(name)
+}
+
+// lookupUser finds the user name with the user backend of the server, defaults to [OSUsers].
+// Every name is made up in honeypot mode.
+func (s *Server) lookupUser(name string) (*UserInfo, error) {
+	if s.Honeypot != nil {
+		return honeypotUser(name), nil
+	}
+
+	if s.Users != nil {
+		return s.Users.Lookup(name)
+	}
+
+	return OSUsers{}.Lookup(name)
+}
+
+// userGroupNames returns the names of the groups of the user, whose account is looked up with os/user if it is nil.
+// The group ids unknown to the system are returned as they are.
+func userGroupNames(username string, account *UserInfo) ([]string, error) {
+	if account == nil {
+		u, err := OSUsers{}.Lookup(username)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find user %s: %w", username, err)
+		}
+		account = u
+	}
+
+	gids, err := account.groupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups of user %s: %w", username, err)
+	}
+
+	names := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			names = append(names, gid)
+			continue
+		}
+		names = append(names, g.Name)
+	}
+
+	return names, nil
+}
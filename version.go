@@ -0,0 +1,76 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// defaultServerVersion is the identification string of x/crypto when none is set.
+const defaultServerVersion = "SSH-2.0-Go"
+
+// CommonServerVersions are identification strings of widely deployed openssh releases,
+// used by [RandomServerVersion] to mask the server among them.
+var CommonServerVersions = []string{
+	"SSH-2.0-OpenSSH_7.4",
+	"SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.11",
+	"SSH-2.0-OpenSSH_8.4p1 Debian-5+deb11u3",
+	"SSH-2.0-OpenSSH_8.7",
+	"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.10",
+	"SSH-2.0-OpenSSH_9.2p1 Debian-2+deb12u3",
+	"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5",
+}
+
+// ValidateServerVersion checks that v is a valid identification string as specified by RFC 4253 section 4.2:
+// it starts with SSH-2.0-, has only printable ascii characters and is at most 253 characters long,
+// leaving room for the terminating CR LF.
+func ValidateServerVersion(v string) error {
+	if !strings.HasPrefix(v, "SSH-2.0-") {
+		return fmt.Errorf("server version %q doesn't start with SSH-2.0-", v)
+	}
+
+	if len(v) > maxIdentLength-2 {
+		return fmt.Errorf("server version is longer than %d characters", maxIdentLength-2)
+	}
+
+	softwareVersion, _, _ := strings.Cut(v[len("SSH-2.0-"):], " ")
+	if softwareVersion == "" {
+		return errors.New("server version has no software version")
+	}
+
+	for _, c := range v {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("server version %q has non printable characters", v)
+		}
+	}
+
+	return nil
+}
+
+// RandomServerVersion returns a function for [Server.VersionFunc] which picks one of versions for every connection,
+// or one of [CommonServerVersions] if versions is empty.
+func RandomServerVersion(versions ...string) func() string {
+	if len(versions) == 0 {
+		versions = CommonServerVersions
+	}
+
+	return func() string {
+		return versions[rand.IntN(len(versions))]
+	}
+}
+
+// serverVersion returns the identification string for a new connection, or an empty string for the default.
+func (s *Server) serverVersion() string {
+	if s.VersionFunc == nil {
+		return ""
+	}
+
+	v := s.VersionFunc()
+	if err := ValidateServerVersion(v); err != nil {
+		s.logger().Warn("ignoring invalid server version", "err", err.Error())
+		return ""
+	}
+
+	return v
+}
@@ -0,0 +1,276 @@
+package sshd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is appended to the key of the client to compute the accept key, per RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the opcodes of the websocket frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// maxControlPayload is the largest payload of the control frames.
+const maxControlPayload = 125
+
+// WebSocketHandler returns the handler upgrading the requests to websockets and serving ssh connections over them,
+// for browser clients and http proxies. The client sends the ssh stream in binary messages, split anywhere.
+// checkOrigin, if set, accepts the origins of the requests,
+// otherwise only the requests without an origin or from the same host are accepted.
+func (s *Server) WebSocketHandler(checkOrigin func(r *http.Request) bool) http.Handler {
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.inShutdown.Load() {
+			http.Error(w, ErrServerClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if !checkOrigin(r) {
+			http.Error(w, "origin is not allowed", http.StatusForbidden)
+			return
+		}
+
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			s.logger().Info("failed to upgrade to websocket", "err", err.Error(), "remote", r.RemoteAddr)
+			return
+		}
+
+		if !s.admitConn(conn) {
+			return
+		}
+		defer s.wg.Done()
+
+		s.serveConn(r.Context(), conn)
+	})
+}
+
+// sameOrigin accepts the requests without an origin, which are not from browsers, or from the host of the request.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket does the opening handshake of the websocket and returns its connection.
+// The failures are replied to the client.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "websocket requires GET", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("invalid method %s", r.Method)
+	case !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "websocket upgrade is required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket upgrade")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	case key == "":
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to reply websocket handshake: %w", err)
+	}
+
+	return &wsConn{Conn: conn, r: rw.Reader}, nil
+}
+
+// headerContains checks if the comma separated values of the header name contain token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wsConn is the stream of the payloads of the data messages of a websocket.
+type wsConn struct {
+	net.Conn
+	// r reads the frames, including the ones buffered during the handshake.
+	r *bufio.Reader
+
+	// remaining is the unread payload of the current data frame, masked with mask from the offset pos.
+	remaining uint64
+	mask      [4]byte
+	pos       int
+
+	// wmu serializes the frames written.
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.r.Read(b)
+	for i := range b[:n] {
+		b[i] ^= c.mask[(c.pos+i)%4]
+	}
+	c.pos += n
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+// readHeader reads the header of the next frame, handling the control frames.
+func (c *wsConn) readHeader() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return err
+	}
+
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return errors.New("websocket frame from client is not masked")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.pos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	}
+
+	if length > maxControlPayload {
+		return errors.New("websocket control frame is too long")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= c.mask[i%4]
+	}
+
+	switch opcode {
+	case wsClose:
+		c.sendClose()
+		return io.EOF
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsPong:
+		return nil
+	default:
+		return fmt.Errorf("unknown websocket opcode %d", opcode)
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeFrame writes a final unmasked frame, as sent by servers.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// sendClose sends the close frame once.
+func (c *wsConn) sendClose() {
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsClose, nil)
+	})
+}
+
+func (c *wsConn) Close() error {
+	c.sendClose()
+
+	return c.Conn.Close()
+}
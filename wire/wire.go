@@ -0,0 +1,176 @@
+// Package wire encodes and decodes the payloads of the requests and channels of the ssh connection protocol,
+// RFC 4254, for the handlers of custom requests, channels and subsystems.
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// MaxStringLength is the longest string parsed from the payloads, the largest packet of the ssh package.
+	MaxStringLength = 256 << 10
+	// MaxNameLength is the longest name parsed from the payloads, such as the terminal, subsystem and signal names.
+	MaxNameLength = 256
+)
+
+// ParseString parses a string of at most MaxStringLength bytes.
+func ParseString(
+	b []byte,
+) (
+	result string,
+	consumed int,
+	err error,
+) {
+	return ParseStringMax(b, MaxStringLength)
+}
+
+// ParseStringMax parses a string prefixed by its length, rejecting the ones longer than limit bytes.
+func ParseStringMax(
+	b []byte,
+	limit int,
+) (
+	result string,
+	consumed int,
+	err error,
+) {
+	if len(b) < 4 {
+		return "", 0, fmt.Errorf("number of bytes in less than 4: %d", len(b))
+	}
+
+	l := int64(binary.BigEndian.Uint32(b[:4]))
+	if l > int64(limit) {
+		return "", 0, fmt.Errorf("string length is %d, longer than the maximum %d", l, limit)
+	}
+	if int64(len(b)) < l+4 {
+		return "", 0, fmt.Errorf("string length is %d, but input only has %d bytes (including the 4 bytes length prefix)", l, len(b))
+	}
+
+	result = string(b[4 : l+4])
+	consumed = int(l) + 4
+
+	return result, consumed, nil
+}
+
+// MarshalString appends s prefixed by its length to b, the counterpart of ParseString.
+func MarshalString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// MarshalExitStatus returns the payload of the exit-status request, RFC 4254 section 6.10.
+func MarshalExitStatus(code uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, code)
+}
+
+// MarshalExitSignal returns the payload of the exit-signal request, RFC 4254 section 6.10,
+// where signal is the name without the SIG prefix.
+func MarshalExitSignal(signal string, coreDumped bool, message, lang string) []byte {
+	b := MarshalString(nil, signal)
+	if coreDumped {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = MarshalString(b, message)
+
+	return MarshalString(b, lang)
+}
+
+// MarshalWindowChange returns the payload of the window-change request, RFC 4254 section 6.7,
+// the counterpart of ParseWindowSize.
+func MarshalWindowChange(widthCharacter, heightCharacter, widthPixel, heightPixel uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, widthCharacter)
+	b = binary.BigEndian.AppendUint32(b, heightCharacter)
+	b = binary.BigEndian.AppendUint32(b, widthPixel)
+
+	return binary.BigEndian.AppendUint32(b, heightPixel)
+}
+
+// ParseWindowSize parses the window size of pty-req and window-change requests, RFC 4254 section 6.7,
+// in characters and pixels.
+func ParseWindowSize(b []byte) (
+	widthCharacter uint32,
+	heightCharacter uint32,
+	widthPixel uint32,
+	heightPixel uint32,
+	err error,
+) {
+	if len(b) < 16 {
+		return 0, 0, 0, 0, fmt.Errorf("number of bytes is less than 16: %d", len(b))
+	}
+
+	widthCharacter = binary.BigEndian.Uint32(b[0:4])
+	heightCharacter = binary.BigEndian.Uint32(b[4:8])
+	widthPixel = binary.BigEndian.Uint32(b[8:12])
+	heightPixel = binary.BigEndian.Uint32(b[12:16])
+
+	return
+}
+
+// ParseTerminalModes decodes the encoded terminal modes of pty-req, RFC 4254 section 8.
+// Parsing stops at TTY_OP_END or at an undefined opcode.
+func ParseTerminalModes(b []byte) (ssh.TerminalModes, error) {
+	modes := make(ssh.TerminalModes)
+
+	for len(b) > 0 {
+		opcode := b[0]
+		if opcode == 0 || opcode >= 160 {
+			break
+		}
+
+		if len(b) < 5 {
+			return nil, fmt.Errorf("terminal mode %d is truncated", opcode)
+		}
+
+		modes[opcode] = binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+	}
+
+	return modes, nil
+}
+
+// ParseTCPIPChannel parses the extra data of direct-tcpip and forwarded-tcpip channels, RFC 4254 section 7:
+// the host and port connected, and the address and port of the originator.
+func ParseTCPIPChannel(b []byte) (
+	host string,
+	port uint32,
+	originAddr string,
+	originPort uint32,
+	err error,
+) {
+	host, consumed, err := ParseStringMax(b, MaxNameLength)
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("failed to parse host: %w", err)
+	}
+	b = b[consumed:]
+	if len(b) < 4 {
+		return "", 0, "", 0, fmt.Errorf("number of bytes for port is less than 4: %d", len(b))
+	}
+	port = binary.BigEndian.Uint32(b[:4])
+	b = b[4:]
+
+	originAddr, consumed, err = ParseStringMax(b, MaxNameLength)
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("failed to parse originator address: %w", err)
+	}
+	b = b[consumed:]
+	if len(b) < 4 {
+		return "", 0, "", 0, fmt.Errorf("number of bytes for originator port is less than 4: %d", len(b))
+	}
+	originPort = binary.BigEndian.Uint32(b[:4])
+
+	return host, port, originAddr, originPort, nil
+}
+
+// MarshalTCPIPChannel returns the extra data of direct-tcpip and forwarded-tcpip channels,
+// the counterpart of ParseTCPIPChannel.
+func MarshalTCPIPChannel(host string, port uint32, originAddr string, originPort uint32) []byte {
+	b := MarshalString(nil, host)
+	b = binary.BigEndian.AppendUint32(b, port)
+	b = MarshalString(b, originAddr)
+
+	return binary.BigEndian.AppendUint32(b, originPort)
+}
@@ -0,0 +1,310 @@
+package wire
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseStringMax(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        []byte
+		limit    int
+		want     string
+		consumed int
+		wantErr  bool
+	}{
+		{name: "empty string", b: []byte{0, 0, 0, 0}, limit: 10, want: "", consumed: 4},
+		{name: "string", b: []byte{0, 0, 0, 3, 'a', 'b', 'c'}, limit: 10, want: "abc", consumed: 7},
+		{name: "trailing bytes", b: []byte{0, 0, 0, 1, 'a', 'b'}, limit: 10, want: "a", consumed: 5},
+		{name: "at limit", b: []byte{0, 0, 0, 2, 'a', 'b'}, limit: 2, want: "ab", consumed: 6},
+		{name: "over limit", b: []byte{0, 0, 0, 3, 'a', 'b', 'c'}, limit: 2, wantErr: true},
+		{name: "no length", b: []byte{0, 0, 0}, limit: 10, wantErr: true},
+		{name: "truncated", b: []byte{0, 0, 0, 3, 'a'}, limit: 10, wantErr: true},
+		{name: "huge length", b: []byte{0xff, 0xff, 0xff, 0xff, 'a'}, limit: MaxStringLength, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, consumed, err := ParseStringMax(tt.b, tt.limit)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got != tt.want || consumed != tt.consumed {
+				t.Errorf("got %q %d, want %q %d", got, consumed, tt.want, tt.consumed)
+			}
+		})
+	}
+}
+
+func TestParseString(t *testing.T) {
+	long := strings.Repeat("a", MaxStringLength)
+	if got, _, err := ParseString(MarshalString(nil, long)); err != nil || got != long {
+		t.Errorf("failed to parse a string of MaxStringLength: %v", err)
+	}
+	if _, _, err := ParseString(MarshalString(nil, long+"a")); err == nil {
+		t.Error("expected an error for a string longer than MaxStringLength")
+	}
+}
+
+func TestParseWindowSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    [4]uint32
+		wantErr bool
+	}{
+		{name: "window-change", b: MarshalWindowChange(80, 24, 640, 480), want: [4]uint32{80, 24, 640, 480}},
+		{name: "trailing modes", b: append(MarshalWindowChange(1, 2, 3, 4), 0), want: [4]uint32{1, 2, 3, 4}},
+		{name: "truncated", b: MarshalWindowChange(80, 24, 640, 480)[:15], wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, wp, hp, err := ParseWindowSize(tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got := [4]uint32{w, h, wp, hp}; got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTerminalModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    ssh.TerminalModes
+		wantErr bool
+	}{
+		{name: "empty", want: ssh.TerminalModes{}},
+		{name: "end only", b: []byte{0}, want: ssh.TerminalModes{}},
+		{
+			name: "modes",
+			b:    []byte{ssh.ECHO, 0, 0, 0, 1, ssh.TTY_OP_ISPEED, 0, 0, 0x96, 0, 0},
+			want: ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400},
+		},
+		{name: "stops at end", b: []byte{ssh.ECHO, 0, 0, 0, 1, 0, ssh.ICRNL, 0, 0, 0, 1}, want: ssh.TerminalModes{ssh.ECHO: 1}},
+		{name: "stops at undefined opcode", b: []byte{ssh.ECHO, 0, 0, 0, 1, 200, 1}, want: ssh.TerminalModes{ssh.ECHO: 1}},
+		{name: "truncated", b: []byte{ssh.ECHO, 0, 0}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTerminalModes(tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTCPIPChannel(t *testing.T) {
+	tests := []struct {
+		name       string
+		b          []byte
+		host       string
+		port       uint32
+		originAddr string
+		originPort uint32
+		wantErr    bool
+	}{
+		{
+			name: "channel",
+			b:    MarshalTCPIPChannel("example.com", 443, "10.0.0.1", 51000),
+			host: "example.com", port: 443, originAddr: "10.0.0.1", originPort: 51000,
+		},
+		{name: "long host", b: MarshalTCPIPChannel(strings.Repeat("a", MaxNameLength+1), 443, "10.0.0.1", 51000), wantErr: true},
+		{name: "no port", b: MarshalString(nil, "example.com"), wantErr: true},
+		{name: "no originator", b: MarshalTCPIPChannel("example.com", 443, "", 0)[:19], wantErr: true},
+		{name: "no originator port", b: MarshalTCPIPChannel("example.com", 443, "10.0.0.1", 51000)[:31], wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, originAddr, originPort, err := ParseTCPIPChannel(tt.b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if host != tt.host || port != tt.port || originAddr != tt.originAddr || originPort != tt.originPort {
+				t.Errorf("got %s %d %s %d", host, port, originAddr, originPort)
+			}
+		})
+	}
+}
+
+// the builders are checked against the encoding of the ssh package.
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{
+			name: "string",
+			got:  MarshalString([]byte{1}, "abc"),
+			want: append([]byte{1}, ssh.Marshal(struct{ S string }{"abc"})...),
+		},
+		{
+			name: "exit-status",
+			got:  MarshalExitStatus(127),
+			want: ssh.Marshal(struct{ Status uint32 }{127}),
+		},
+		{
+			name: "exit-signal",
+			got:  MarshalExitSignal("KILL", true, "killed", "en"),
+			want: ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Message    string
+				Lang       string
+			}{"KILL", true, "killed", "en"}),
+		},
+		{
+			name: "exit-signal without core dump",
+			got:  MarshalExitSignal("TERM", false, "", ""),
+			want: ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Message    string
+				Lang       string
+			}{"TERM", false, "", ""}),
+		},
+		{
+			name: "window-change",
+			got:  MarshalWindowChange(80, 24, 640, 480),
+			want: ssh.Marshal(struct{ W, H, WP, HP uint32 }{80, 24, 640, 480}),
+		},
+		{
+			name: "tcpip channel",
+			got:  MarshalTCPIPChannel("example.com", 443, "10.0.0.1", 51000),
+			want: ssh.Marshal(struct {
+				Host       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{"example.com", 443, "10.0.0.1", 51000}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.got, tt.want) {
+				t.Errorf("got %x, want %x", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParseStringMax(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 3, 'a', 'b', 'c'}, 10)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, MaxStringLength)
+	f.Add([]byte{0, 0}, 0)
+
+	f.Fuzz(func(t *testing.T, b []byte, limit int) {
+		s, consumed, err := ParseStringMax(b, limit)
+		if err != nil {
+			return
+		}
+		if len(s) > limit || consumed != len(s)+4 || consumed > len(b) {
+			t.Fatalf("parsed %d bytes consuming %d of %d with limit %d", len(s), consumed, len(b), limit)
+		}
+		if !bytes.Equal(MarshalString(nil, s), b[:consumed]) {
+			t.Fatalf("%q doesn't marshal back to %x", s, b[:consumed])
+		}
+	})
+}
+
+func FuzzParseTCPIPChannel(f *testing.F) {
+	f.Add(MarshalTCPIPChannel("example.com", 443, "10.0.0.1", 51000))
+	f.Add(MarshalTCPIPChannel("", 0, "", 0))
+	f.Add([]byte{0, 0, 1, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		host, port, originAddr, originPort, err := ParseTCPIPChannel(b)
+		if err != nil {
+			return
+		}
+		if len(host) > MaxNameLength || len(originAddr) > MaxNameLength {
+			t.Fatalf("parsed names longer than %d: %d %d", MaxNameLength, len(host), len(originAddr))
+		}
+		if encoded := MarshalTCPIPChannel(host, port, originAddr, originPort); !bytes.HasPrefix(b, encoded) {
+			t.Fatalf("%x doesn't marshal back to a prefix of %x", encoded, b)
+		}
+	})
+}
+
+func FuzzParseTerminalModes(f *testing.F) {
+	f.Add([]byte{ssh.ECHO, 0, 0, 0, 1, ssh.TTY_OP_ISPEED, 0, 0, 0x96, 0, 0})
+	f.Add([]byte{ssh.ECHO, 0, 0})
+	f.Add([]byte{200})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		modes, err := ParseTerminalModes(b)
+		if err != nil {
+			return
+		}
+		for opcode := range modes {
+			if opcode == 0 || opcode >= 160 {
+				t.Fatalf("parsed undefined opcode %d", opcode)
+			}
+		}
+		if len(modes)*5 > len(b) {
+			t.Fatalf("parsed %d modes from %d bytes", len(modes), len(b))
+		}
+	})
+}
+
+func FuzzParseWindowSize(f *testing.F) {
+	f.Add(MarshalWindowChange(80, 24, 640, 480))
+	f.Add([]byte{0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		w, h, wp, hp, err := ParseWindowSize(b)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(MarshalWindowChange(w, h, wp, hp), b[:16]) {
+			t.Fatalf("%d %d %d %d don't marshal back to %x", w, h, wp, hp, b[:16])
+		}
+	})
+}